@@ -189,6 +189,8 @@ let store = new Vuex.Store({
         'document', (evt) => commit('setActiveDocument', JSON.parse(evt.data)))
       eventSource.addEventListener(
         'progress', (evt) => commit('updateProgress', JSON.parse(evt.data)))
+      eventSource.addEventListener(
+        'warning', (evt) => console.warn(JSON.parse(evt.data).error))
       eventSource.addEventListener('lines', (evt) => {
         commit('stopLoading')
         commit('setLines', JSON.parse(evt.data).map(
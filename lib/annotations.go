@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// AnnotationContext is the JSON-LD context of W3C Web Annotations
+const AnnotationContext = "http://www.w3.org/ns/anno.jsonld"
+
+// sourceCanvases maps the page numbers of a document to the IDs of the
+// canvases in its IIIF manifest, for lines that were scraped before their
+// canvas was recorded
+func sourceCanvases(doc *Document) (map[int]string, error) {
+	if doc.Manifest == "" {
+		return nil, fmt.Errorf("Document %s has no manifest", doc.Identifier)
+	}
+	manifest, err := FetchManifest(doc.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	canvases := make(map[int]string, len(manifest.Canvases))
+	for _, canvas := range manifest.Canvases {
+		if canvas.PageNumber >= 0 {
+			canvases[canvas.PageNumber] = canvas.ID
+		}
+	}
+	return canvases, nil
+}
+
+// AnnotationPageURL returns the URL of the annotation page for a page of a
+// document on the archiscribe instance at baseURL
+func AnnotationPageURL(baseURL string, ident string, pageNo int) string {
+	return fmt.Sprintf("%s/api/documents/%s/annotations?page=%d", baseURL, ident, pageNo)
+}
+
+// NewAnnotationPages creates a W3C Annotation Page for every canvas of the
+// source IIIF manifest with transcribed lines. Every annotation targets the
+// box of a line on the canvas and has its transcription as the body.
+func NewAnnotationPages(doc *Document, baseURL string) ([]AnnotationPage, error) {
+	var canvases map[int]string
+	pages, lines := linesByPage(doc)
+	annotationPages := make([]AnnotationPage, 0, len(pages))
+	for _, pageNo := range pages {
+		canvasID := lines[pageNo][0].CanvasID
+		if canvasID == "" && canvases == nil {
+			var err error
+			if canvases, err = sourceCanvases(doc); err != nil {
+				return nil, err
+			}
+		}
+		if canvasID == "" {
+			var ok bool
+			if canvasID, ok = canvases[pageNo]; !ok {
+				return nil, fmt.Errorf(
+					"No canvas for page %d in manifest %s", pageNo, doc.Manifest)
+			}
+		}
+		pageURL := AnnotationPageURL(baseURL, doc.Identifier, pageNo)
+		page := AnnotationPage{
+			Context: AnnotationContext,
+			ID:      pageURL,
+			Type:    "AnnotationPage",
+			Items:   make([]Annotation, 0, len(lines[pageNo])),
+		}
+		for _, line := range lines[pageNo] {
+			page.Items = append(page.Items, lineAnnotation(
+				fmt.Sprintf("%s#%s", pageURL, line.Identifier), canvasID, line))
+		}
+		annotationPages = append(annotationPages, page)
+	}
+	return annotationPages, nil
+}
+
+// AnnotationExporter writes the Web Annotations for a document as a JSON
+// list of annotation pages, one per canvas. Their identifiers point to the
+// archiscribe instance at BaseURL.
+type AnnotationExporter struct {
+	BaseURL string
+}
+
+// ContentType of the exported document
+func (e *AnnotationExporter) ContentType() string {
+	return "application/ld+json"
+}
+
+// Extension of the exported document
+func (e *AnnotationExporter) Extension() string {
+	return ".json"
+}
+
+// Export the annotation pages of the document
+func (e *AnnotationExporter) Export(doc *Document, w io.Writer) error {
+	pages, err := NewAnnotationPages(doc, e.BaseURL)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(pages)
+}
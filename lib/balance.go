@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+)
+
+var yearRangePat = regexp.MustCompile(`^(\d{4})(?:-(\d{4})|(s))?$`)
+
+// ParseYearRange parses a single year (1850), a range of years (1850-1855)
+// or a decade (1850s) into the first and last year of the range
+func ParseYearRange(spec string) (int, int, error) {
+	match := yearRangePat.FindStringSubmatch(spec)
+	if match == nil {
+		return 0, 0, fmt.Errorf("Invalid year or year range '%s'", spec)
+	}
+	fromYear, _ := strconv.Atoi(match[1])
+	toYear := fromYear
+	if match[2] != "" {
+		toYear, _ = strconv.Atoi(match[2])
+	} else if match[3] != "" {
+		if fromYear%10 != 0 {
+			return 0, 0, fmt.Errorf("Invalid decade '%s'", spec)
+		}
+		toYear = fromYear + 9
+	}
+	if toYear < fromYear {
+		return 0, 0, fmt.Errorf("Invalid year range '%s'", spec)
+	}
+	return fromYear, toYear, nil
+}
+
+// PickBalancedDecade returns the decade between fromYear and toYear with
+// the lowest score among the decades that still have available
+// identifiers. Ties are broken at random.
+func PickBalancedDecade(availableByYear map[int]int, decadeScores map[int]float64, fromYear int, toYear int) (int, error) {
+	candidates := []int{}
+	var minScore float64
+	seen := map[int]bool{}
+	for year, numAvailable := range availableByYear {
+		decade := (year / 10) * 10
+		if year <= 0 || year < fromYear || year > toYear ||
+			numAvailable == 0 || seen[decade] {
+			continue
+		}
+		seen[decade] = true
+		if len(candidates) == 0 || decadeScores[decade] < minScore {
+			candidates = []int{decade}
+			minScore = decadeScores[decade]
+		} else if decadeScores[decade] == minScore {
+			candidates = append(candidates, decade)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, ErrNoIdentifiers
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
@@ -0,0 +1,75 @@
+package lib
+
+import "testing"
+
+func TestParseYearRange(t *testing.T) {
+	valid := map[string][2]int{
+		"1850":      {1850, 1850},
+		"1850-1855": {1850, 1855},
+		"1850-1850": {1850, 1850},
+		"1850s":     {1850, 1859},
+		"1900s":     {1900, 1909},
+	}
+	for spec, want := range valid {
+		fromYear, toYear, err := ParseYearRange(spec)
+		if err != nil {
+			t.Errorf("ParseYearRange(%q) failed: %s", spec, err)
+		} else if fromYear != want[0] || toYear != want[1] {
+			t.Errorf("ParseYearRange(%q) = %d, %d, want %d, %d",
+				spec, fromYear, toYear, want[0], want[1])
+		}
+	}
+	for _, spec := range []string{
+		"", "185", "18500", "1855-1850", "1855s", "1850-55", "1850s-1860",
+		"1850-1860s", " 1850", "1850 ", "anno 1850", "1850–1855"} {
+		if fromYear, toYear, err := ParseYearRange(spec); err == nil {
+			t.Errorf("ParseYearRange(%q) = %d, %d, want an error", spec, fromYear, toYear)
+		}
+	}
+}
+
+func TestPickBalancedDecade(t *testing.T) {
+	available := map[int]int{1841: 3, 1852: 1, 1855: 0, 1863: 2, 1877: 0, 0: 5}
+	tests := []struct {
+		name     string
+		scores   map[int]float64
+		fromYear int
+		toYear   int
+		want     []int
+	}{
+		{"lowest score", map[int]float64{1840: 0.5, 1850: 0.1, 1860: 0.3}, 1800, 1900, []int{1850}},
+		{"missing decades score zero", map[int]float64{1840: 0.5, 1850: 0.1}, 1800, 1900, []int{1860}},
+		{"ties", map[int]float64{1840: 0.2, 1850: 0.2, 1860: 0.3}, 1800, 1900, []int{1840, 1850}},
+		{"years outside the range", map[int]float64{1850: 0.1, 1860: 0.3}, 1855, 1870, []int{1860}},
+		{"partial decade", map[int]float64{}, 1852, 1852, []int{1850}},
+		{"decades without available identifiers", map[int]float64{1870: 0}, 1870, 1879, nil},
+		{"unknown years", map[int]float64{}, 1900, 1950, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Ties are broken at random, so every candidate must come up
+			seen := map[int]bool{}
+			for i := 0; i < 100; i++ {
+				decade, err := PickBalancedDecade(available, tt.scores, tt.fromYear, tt.toYear)
+				if tt.want == nil {
+					if err != ErrNoIdentifiers {
+						t.Fatalf("PickBalancedDecade() = %d, %v, want %v", decade, err, ErrNoIdentifiers)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("PickBalancedDecade() failed: %s", err)
+				}
+				seen[decade] = true
+			}
+			if len(seen) != len(tt.want) {
+				t.Errorf("Picked %v, want %v", seen, tt.want)
+			}
+			for _, decade := range tt.want {
+				if !seen[decade] {
+					t.Errorf("Never picked %d, want %v", decade, tt.want)
+				}
+			}
+		})
+	}
+}
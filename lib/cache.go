@@ -1,156 +1,882 @@
 package lib
 
 import (
+	"bytes"
+	"container/list"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	// Registers the JPEG decoder for line images
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
 )
 
 // Identifier Cache
 // ==========================================================================
 
+// States of an identifier in the cache
+const (
+	// IdentifierAvailable identifiers can be picked for a new task
+	IdentifierAvailable = "available"
+	// IdentifierLeased identifiers were picked for a task that has not been
+	// submitted yet, they return to the pool once the lease expired
+	IdentifierLeased = "leased"
+	// IdentifierConsumed identifiers were transcribed or found unsuitable
+	IdentifierConsumed = "consumed"
+)
+
+// DefaultLeaseTimeout is the time after which leased identifiers of
+// abandoned tasks return to the pool
+const DefaultLeaseTimeout = 24 * time.Hour
+
+// ErrNoIdentifiers is returned when all identifiers for the requested years
+// were already used up
+var ErrNoIdentifiers = errors.New("No identifiers available")
+
+// ErrUnknownYear is returned when the cache has never had any identifiers
+// for the requested years
+var ErrUnknownYear = errors.New("No identifiers for this year")
+
+// ErrUnknownIdentifier is returned when an identifier is not in the cache
+var ErrUnknownIdentifier = errors.New("Unknown identifier")
+
+// ErrIdentifierCacheLocked is returned when the cache is opened by another
+// process, e.g. a running server
+var ErrIdentifierCacheLocked = errors.New("Identifier cache is in use by another process")
+
+var (
+	entriesBucket   = []byte("entries")
+	availableBucket = []byte("available")
+	leasesBucket    = []byte("leases")
+)
+
 // IdentifierCacheEntry encodes cached information for a given Archive.org identifier
 type IdentifierCacheEntry struct {
-	Identifier string `json:"id"`
-	NumPages   int    `json:"numPages"`
+	Identifier string    `json:"id"`
+	NumPages   int       `json:"numPages"`
+	Year       int       `json:"year"`
+	State      string    `json:"state"`
+	LeasedAt   time.Time `json:"leasedAt,omitempty"`
+	// Source of the volume and its manifest, if it is not from Archive.org
+	Source   string `json:"source,omitempty"`
+	Manifest string `json:"manifest,omitempty"`
 }
 
-// IdentifierCache stores suitable identifiers
+// IdentifierCache stores suitable identifiers in an embedded key-value
+// store. Every entry is stored in the entries bucket, available entries
+// are additionally indexed by year and leased entries by identifier.
 type IdentifierCache struct {
-	path    string
-	entries map[int][]IdentifierCacheEntry
+	db           *bolt.DB
+	LeaseTimeout time.Duration
 }
 
-// NewIdentifierCache constructs a new cache
-func NewIdentifierCache(path string) *IdentifierCache {
-	return &IdentifierCache{
-		path:    path,
-		entries: map[int][]IdentifierCacheEntry{}}
+// OpenIdentifierCache opens the cache at the given path, creating it if it
+// does not exist yet
+func OpenIdentifierCache(path string) (*IdentifierCache, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, ErrIdentifierCacheLocked
+	} else if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, availableBucket, leasesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &IdentifierCache{db: db, LeaseTimeout: DefaultLeaseTimeout}, nil
 }
 
-// LoadIdentifierCache loads a cache from a JSON file
-func LoadIdentifierCache(path string) *IdentifierCache {
-	cacheJSON, _ := ioutil.ReadFile(path)
-	cache := IdentifierCache{path: path}
-	json.Unmarshal(cacheJSON, &cache.entries)
-	return &cache
+// ImportJSON adds all entries from an identifier cache in the old JSON
+// format, which maps years to lists of entries
+func (c *IdentifierCache) ImportJSON(path string) error {
+	cacheJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var byYear map[int][]IdentifierCacheEntry
+	if err := json.Unmarshal(cacheJSON, &byYear); err != nil {
+		return fmt.Errorf("Could not parse %s: %s", path, err)
+	}
+	entries := make([]IdentifierCacheEntry, 0)
+	for year, yearEntries := range byYear {
+		for _, entry := range yearEntries {
+			entry.Year = year
+			entries = append(entries, entry)
+		}
+	}
+	return c.Add(entries...)
+}
+
+// Close the cache
+func (c *IdentifierCache) Close() error {
+	return c.db.Close()
+}
+
+// Count returns the number of entries in the cache
+func (c *IdentifierCache) Count() int {
+	count := 0
+	c.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(entriesBucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+func yearKey(year int) []byte {
+	return []byte(strconv.Itoa(year))
+}
+
+func putEntry(tx *bolt.Tx, entry IdentifierCacheEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).Put([]byte(entry.Identifier), raw)
+}
+
+func getEntry(tx *bolt.Tx, ident string) (IdentifierCacheEntry, error) {
+	var entry IdentifierCacheEntry
+	raw := tx.Bucket(entriesBucket).Get([]byte(ident))
+	if raw == nil {
+		return entry, ErrUnknownIdentifier
+	}
+	err := json.Unmarshal(raw, &entry)
+	return entry, err
+}
+
+// setState moves an entry into a new state and updates the indexes
+func setState(tx *bolt.Tx, entry IdentifierCacheEntry, state string) (IdentifierCacheEntry, error) {
+	ident := []byte(entry.Identifier)
+	available, err := tx.Bucket(availableBucket).CreateBucketIfNotExists(yearKey(entry.Year))
+	if err != nil {
+		return entry, err
+	}
+	leases := tx.Bucket(leasesBucket)
+	if err := available.Delete(ident); err != nil {
+		return entry, err
+	}
+	if err := leases.Delete(ident); err != nil {
+		return entry, err
+	}
+	entry.State = state
+	entry.LeasedAt = time.Time{}
+	switch state {
+	case IdentifierAvailable:
+		err = available.Put(ident, []byte{})
+	case IdentifierLeased:
+		entry.LeasedAt = time.Now()
+		err = leases.Put(ident, []byte(entry.LeasedAt.Format(time.RFC3339)))
+	}
+	if err != nil {
+		return entry, err
+	}
+	return entry, putEntry(tx, entry)
+}
+
+func removeEntry(tx *bolt.Tx, entry IdentifierCacheEntry) error {
+	ident := []byte(entry.Identifier)
+	if available := tx.Bucket(availableBucket).Bucket(yearKey(entry.Year)); available != nil {
+		if err := available.Delete(ident); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(leasesBucket).Delete(ident); err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).Delete(ident)
 }
 
-// Write the cache to disk
-func (c *IdentifierCache) Write() {
-	cacheJSON, _ := json.Marshal(c.entries)
-	ioutil.WriteFile(c.path, cacheJSON, 0644)
+// Add new entries to the cache, entries that are already in the cache keep
+// their state
+func (c *IdentifierCache) Add(entries ...IdentifierCacheEntry) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range entries {
+			if _, err := getEntry(tx, entry.Identifier); err == nil {
+				continue
+			}
+			if _, err := setState(tx, entry, IdentifierAvailable); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// Add a new entry to the cache
-func (c *IdentifierCache) Add(ident string, numPages int, year int) {
-	c.entries[year] = append(c.entries[year], IdentifierCacheEntry{
-		Identifier: ident,
-		NumPages:   numPages})
+// Sync brings the cache in line with a fresh scrape of the given sources:
+// new identifiers are added, identifiers of these sources that are no longer
+// returned are removed and the identifiers in consumed are marked as
+// consumed. Consumed entries are kept, so they are not added again by the
+// next refresh.
+func (c *IdentifierCache) Sync(scraped []IdentifierCacheEntry, sources []string, consumed []string) (numAdded int, numRemoved int, numConsumed int, err error) {
+	isScrapedSource := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		isScrapedSource[source] = true
+	}
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		scrapedIdents := make(map[string]bool, len(scraped))
+		for _, entry := range scraped {
+			scrapedIdents[entry.Identifier] = true
+			if _, err := getEntry(tx, entry.Identifier); err == nil {
+				continue
+			}
+			if _, err := setState(tx, entry, IdentifierAvailable); err != nil {
+				return err
+			}
+			numAdded++
+		}
+		removed := make([]IdentifierCacheEntry, 0)
+		err := tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			if scrapedIdents[string(k)] {
+				return nil
+			}
+			var entry IdentifierCacheEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			source := entry.Source
+			if source == "" {
+				source = SourceArchive
+			}
+			if !isScrapedSource[source] {
+				// Entries of sources that could not be listed are kept
+				return nil
+			}
+			removed = append(removed, entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Protect against truncated results from the scraping API
+		if len(removed) > len(scrapedIdents) {
+			return fmt.Errorf(
+				"Refusing to remove %d identifiers when only %d were scraped",
+				len(removed), len(scrapedIdents))
+		}
+		for _, entry := range removed {
+			if err := removeEntry(tx, entry); err != nil {
+				return err
+			}
+			numRemoved++
+		}
+		for _, ident := range consumed {
+			entry, err := getEntry(tx, ident)
+			if err == ErrUnknownIdentifier || entry.State == IdentifierConsumed {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if _, err := setState(tx, entry, IdentifierConsumed); err != nil {
+				return err
+			}
+			numConsumed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return numAdded, numRemoved, numConsumed, nil
 }
 
-// Random returns a random identifier for a given year
-func (c *IdentifierCache) Random(year int) IdentifierCacheEntry {
-	pickIdx := rand.Intn(len(c.entries[year]))
-	entry := c.entries[year][pickIdx]
-	c.entries[year] = append(c.entries[year][:pickIdx], c.entries[year][pickIdx+1:]...)
-	c.Write()
-	return entry
+// Lease picks a random available identifier published between fromYear and
+// toYear (inclusive) and marks it as leased, so it is not handed out again
+// until it is either consumed or the lease expired
+func (c *IdentifierCache) Lease(fromYear int, toYear int) (IdentifierCacheEntry, error) {
+	var entry IdentifierCacheEntry
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		if _, err := releaseExpired(tx, c.LeaseTimeout); err != nil {
+			return err
+		}
+		isKnown := false
+		candidates := make([][]byte, 0)
+		for year := fromYear; year <= toYear; year++ {
+			available := tx.Bucket(availableBucket).Bucket(yearKey(year))
+			if available == nil {
+				continue
+			}
+			isKnown = true
+			available.ForEach(func(k, v []byte) error {
+				candidates = append(candidates, k)
+				return nil
+			})
+		}
+		if !isKnown {
+			return ErrUnknownYear
+		} else if len(candidates) == 0 {
+			return ErrNoIdentifiers
+		}
+		picked, err := getEntry(tx, string(candidates[rand.Intn(len(candidates))]))
+		if err != nil {
+			return err
+		}
+		entry, err = setState(tx, picked, IdentifierLeased)
+		return err
+	})
+	return entry, err
+}
+
+// AvailableByYear returns the number of available identifiers per year
+func (c *IdentifierCache) AvailableByYear() map[int]int {
+	counts := map[int]int{}
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(availableBucket).ForEach(func(k, v []byte) error {
+			year, err := strconv.Atoi(string(k))
+			if err != nil {
+				return nil
+			}
+			counts[year] = tx.Bucket(availableBucket).Bucket(k).Stats().KeyN
+			return nil
+		})
+	})
+	return counts
+}
+
+// Consume marks an identifier as used up, it is never handed out again
+func (c *IdentifierCache) Consume(ident string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		entry, err := getEntry(tx, ident)
+		if err != nil {
+			return err
+		}
+		_, err = setState(tx, entry, IdentifierConsumed)
+		return err
+	})
+}
+
+// Release returns a leased identifier to the pool
+func (c *IdentifierCache) Release(ident string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		entry, err := getEntry(tx, ident)
+		if err != nil {
+			return err
+		}
+		if entry.State != IdentifierLeased {
+			return nil
+		}
+		_, err = setState(tx, entry, IdentifierAvailable)
+		return err
+	})
+}
+
+func releaseExpired(tx *bolt.Tx, timeout time.Duration) (int, error) {
+	expired := make([]string, 0)
+	err := tx.Bucket(leasesBucket).ForEach(func(k, v []byte) error {
+		leasedAt, err := time.Parse(time.RFC3339, string(v))
+		if err != nil || time.Since(leasedAt) > timeout {
+			expired = append(expired, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, ident := range expired {
+		entry, err := getEntry(tx, ident)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := setState(tx, entry, IdentifierAvailable); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
 }
 
 // Line Image Cache
 // ==========================================================================
 
-// LineImageCache handles cached line images on disk
+// Limits for line image downloads
+const (
+	maxConcurrentDownloads = 8
+	maxDownloadAttempts    = 3
+	maxLineImageSize       = 32 << 20
+	// The URLs of line images that can be fetched on demand are forgotten
+	// once there are more of them
+	maxRegisteredURLs = 100000
+)
+
+// LineCacheOptions controls the size of the line image cache and how long
+// images are kept
+type LineCacheOptions struct {
+	// Least recently used images are evicted beyond this size, 0 for no limit
+	MaxBytes int64
+	// Images that were not accessed for this long are evicted, 0 to keep them
+	TTL time.Duration
+	// How often expired images are evicted, 0 disables the background worker
+	PurgeInterval time.Duration
+}
+
+// DefaultLineCacheOptions are the line image cache options used if none
+// are given
+var DefaultLineCacheOptions = LineCacheOptions{
+	MaxBytes:      1 << 30,
+	TTL:           7 * 24 * time.Hour,
+	PurgeInterval: time.Hour,
+}
+
+// LineCacheMetrics reports on the usage of the line image cache
+type LineCacheMetrics struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Bytes     int64 `json:"bytes"`
+	NumImages int   `json:"numImages"`
+}
+
+type lineCacheEntry struct {
+	id string
+	// File extension of the image, depending on its format
+	ext      string
+	size     int64
+	accessed time.Time
+}
+
+// cachedImageExtensions maps the formats of cached images to their file
+// extension, images in other formats are converted to PNG
+var cachedImageExtensions = map[string]string{
+	"png":  ".png",
+	"jpeg": ".jpg",
+}
+
+// LineImageCache handles cached line images on disk, the least recently
+// used images are evicted once the cache grows too large or they expire
 type LineImageCache struct {
-	path string
+	path    string
+	options LineCacheOptions
+	mutex   sync.Mutex
+	// Most recently used entries are at the front
+	lru     *list.List
+	entries map[string]*list.Element
+	metrics LineCacheMetrics
+	urls    map[string]string
+	// Lines that were handed out to clients, as they came from their source
+	lines map[string]OCRLine
+	// Bounds the number of concurrent downloads across all callers
+	slots chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
 }
 
-// NewLineImageCache creates a new line image cache
-func NewLineImageCache(cacheDir string) *LineImageCache {
+// NewLineImageCache creates a new line image cache, images that are already
+// on disk are ordered by their modification time, which is updated on every
+// access
+func NewLineImageCache(cacheDir string, options LineCacheOptions) *LineImageCache {
 	path := filepath.Join(cacheDir, "line_images")
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		os.MkdirAll(path, 0755)
 	}
 	cache := LineImageCache{
-		path: filepath.Join(cacheDir, "line_images"),
+		path:    path,
+		options: options,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		urls:    map[string]string{},
+		lines:   map[string]OCRLine{},
+		slots:   make(chan struct{}, maxConcurrentDownloads),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	files, _ := ioutil.ReadDir(path)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for _, finfo := range files {
+		if filepath.Ext(finfo.Name()) == ".tmp" {
+			// Left over from an interrupted download
+			os.Remove(filepath.Join(path, finfo.Name()))
+			continue
+		}
+		ext := filepath.Ext(finfo.Name())
+		if ext != ".png" && ext != ".jpg" {
+			continue
+		}
+		id := strings.TrimSuffix(finfo.Name(), ext)
+		if _, ok := cache.entries[id]; ok {
+			// The image was cached in a different format before
+			os.Remove(filepath.Join(path, finfo.Name()))
+			continue
+		}
+		cache.entries[id] = cache.lru.PushBack(
+			&lineCacheEntry{id, ext, finfo.Size(), finfo.ModTime()})
+		cache.metrics.Bytes += finfo.Size()
+	}
+	cache.evict()
+	if options.PurgeInterval > 0 {
+		go cache.purgeCacheWorker()
+	} else {
+		close(cache.done)
 	}
-	go cache.purgeCacheWorker()
 	return &cache
 }
 
-// Purges files older than 7 days, once a day
+// Evicts expired images periodically until the cache is closed
 func (c *LineImageCache) purgeCacheWorker() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.options.PurgeInterval)
+	defer ticker.Stop()
 	for {
-		currentTime := time.Now()
-		files, _ := ioutil.ReadDir(c.path)
-		for _, finfo := range files {
-			if currentTime.Sub(finfo.ModTime()).Hours() >= 7.0*24 {
-				os.Remove(filepath.Join(c.path, finfo.Name()))
-			}
+		select {
+		case <-ticker.C:
+			c.mutex.Lock()
+			c.evict()
+			c.mutex.Unlock()
+		case <-c.stop:
+			return
 		}
-		time.Sleep(24 * time.Hour)
 	}
 }
 
-// CacheLine downloads a line image and stores it on disk
+// Close stops the background worker of the cache
+func (c *LineImageCache) Close() {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	<-c.done
+}
+
+// evict removes expired images and the least recently used images beyond
+// the maximum size, the caller needs to hold the lock
+func (c *LineImageCache) evict() {
+	now := time.Now()
+	for elem := c.lru.Back(); elem != nil; elem = c.lru.Back() {
+		entry := elem.Value.(*lineCacheEntry)
+		expired := c.options.TTL > 0 && now.Sub(entry.accessed) >= c.options.TTL
+		tooLarge := c.options.MaxBytes > 0 && c.metrics.Bytes > c.options.MaxBytes &&
+			c.lru.Len() > 1
+		if !expired && !tooLarge {
+			return
+		}
+		os.Remove(c.entryPath(entry))
+		c.forget(entry.id)
+		c.metrics.Evictions++
+	}
+}
+
+// entryPath returns the file path of a cached image
+func (c *LineImageCache) entryPath(entry *lineCacheEntry) string {
+	return filepath.Join(c.path, entry.id+entry.ext)
+}
+
+// forget drops an image from the cache index, the caller needs to hold the
+// lock
+func (c *LineImageCache) forget(id string) {
+	if elem, ok := c.entries[id]; ok {
+		c.metrics.Bytes -= elem.Value.(*lineCacheEntry).size
+		c.lru.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+// add records a new image in the cache index and evicts images if the cache
+// grew too large
+func (c *LineImageCache) add(id string, ext string, size int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[id]; ok && elem.Value.(*lineCacheEntry).ext != ext {
+		os.Remove(c.entryPath(elem.Value.(*lineCacheEntry)))
+	}
+	c.forget(id)
+	c.entries[id] = c.lru.PushFront(&lineCacheEntry{id, ext, size, time.Now()})
+	c.metrics.Bytes += size
+	c.evict()
+}
+
+// Metrics returns the current usage of the cache
+func (c *LineImageCache) Metrics() LineCacheMetrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	metrics := c.metrics
+	metrics.NumImages = c.lru.Len()
+	return metrics
+}
+
+// transientError is a download error that is worth retrying
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string {
+	return e.err.Error()
+}
+
+// downloadImage fetches an image and makes sure that it can be decoded.
+// Images are converted to PNG, unless keepFormat is set and the image is
+// already in a format with a known file extension. Returns the image data
+// and its file extension.
+func downloadImage(url string, keepFormat bool) ([]byte, string, error) {
+	if isLocalImageURL(url) {
+		return readLocalImage(url, keepFormat)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, "", transientError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("Status %d while getting %s", resp.StatusCode, url)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, "", transientError{err}
+		}
+		return nil, "", err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("Content type '%s' while getting %s", contentType, url)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLineImageSize+1))
+	if err != nil {
+		return nil, "", transientError{err}
+	} else if len(data) > maxLineImageSize {
+		return nil, "", fmt.Errorf("Image at %s is larger than %d bytes", url, maxLineImageSize)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not decode image at %s: %s", url, err)
+	}
+	return encodeCachedImage(data, img, format, keepFormat)
+}
+
+// encodeCachedImage returns the data and file extension an image is cached
+// with, converting it to PNG if needed
+func encodeCachedImage(data []byte, img image.Image, format string, keepFormat bool) ([]byte, string, error) {
+	if ext, ok := cachedImageExtensions[format]; ok && (keepFormat || format == "png") {
+		return data, ext, nil
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, "", err
+	}
+	return out.Bytes(), ".png", nil
+}
+
+// CacheLine downloads a line image and stores it on disk as PNG. Transient
+// failures are retried, the image is only stored once it was verified.
 func (c *LineImageCache) CacheLine(url string, id string) (string, error) {
-	imgPath := filepath.Join(c.path, id+".png")
-	imgOut, err := os.Create(imgPath)
+	return c.cacheImage(url, id, false)
+}
+
+// CachePage downloads a page image and stores it on disk, JPEG images are
+// kept in their original format
+func (c *LineImageCache) CachePage(url string, id string) (string, error) {
+	return c.cacheImage(url, id, true)
+}
+
+func (c *LineImageCache) cacheImage(url string, id string, keepFormat bool) (string, error) {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+	var data []byte
+	var ext string
+	var err error
+	for attempt := 0; attempt < maxDownloadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		data, ext, err = downloadImage(url, keepFormat)
+		if _, ok := err.(transientError); !ok {
+			break
+		}
+		log.Warn().Err(err).Str("url", url).Int("attempt", attempt+1).Msg("Retrying download")
+	}
+	if err != nil {
+		return "", err
+	}
+	tmpFile, err := ioutil.TempFile(c.path, id+".*.tmp")
 	if err != nil {
 		return "", err
 	}
-	defer imgOut.Close()
-	imgResp, err := http.Get(url)
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(tmpFile.Name())
 		return "", err
 	}
-	defer imgResp.Body.Close()
-	if _, err := io.Copy(imgOut, imgResp.Body); err != nil {
+	imgPath := filepath.Join(c.path, id+ext)
+	if err := os.Rename(tmpFile.Name(), imgPath); err != nil {
+		os.Remove(tmpFile.Name())
 		return "", err
 	}
+	c.add(id, ext, int64(len(data)))
 	return imgPath, nil
 }
 
-// CacheLines caches all passed lines
-func (c *LineImageCache) CacheLines(lines []OCRLine, ident string) {
+// CacheLines caches all passed lines that are not cached yet. The downloads
+// share the bounded number of concurrent downloads of the cache.
+func (c *LineImageCache) CacheLines(lines []OCRLine, ident string) error {
 	log.Info().
 		Str("identifier", ident).
 		Int("numLines", len(lines)).
 		Msg("Caching lines")
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	numFailed := 0
 	for _, line := range lines {
-		c.CacheLine(line.ImageURL, MakeLineIdentifier(ident, line))
+		id := MakeLineIdentifier(ident, line)
+		c.mutex.Lock()
+		_, isCached := c.entries[id]
+		c.mutex.Unlock()
+		if isCached {
+			continue
+		}
+		wg.Add(1)
+		go func(url string, id string) {
+			defer wg.Done()
+			if _, err := c.CacheLine(url, id); err != nil {
+				log.Error().Err(err).Str("url", url).Msg("Could not cache line image")
+				failedMutex.Lock()
+				numFailed++
+				failedMutex.Unlock()
+			}
+		}(line.ImageURL, id)
 	}
+	wg.Wait()
 	log.Info().
 		Str("identifier", ident).
 		Int("numLines", len(lines)).
+		Int("numFailed", numFailed).
 		Msg("Cached lines")
+	if numFailed > 0 {
+		return fmt.Errorf("Could not cache %d of %d line images", numFailed, len(lines))
+	}
+	return nil
 }
 
-// GetLinePath returns the file path for a given line image
+// GetLinePath returns the file path for a given line image and marks it as
+// recently used
 func (c *LineImageCache) GetLinePath(id string) string {
-	imgPath := filepath.Join(c.path, id+".png")
-	if _, err := os.Stat(imgPath); os.IsNotExist(err) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[id]
+	var imgPath string
+	if ok {
+		imgPath = c.entryPath(elem.Value.(*lineCacheEntry))
+		if _, err := os.Stat(imgPath); os.IsNotExist(err) {
+			c.forget(id)
+			ok = false
+		}
+	}
+	if !ok {
+		c.metrics.Misses++
 		return ""
 	}
+	c.metrics.Hits++
+	entry := elem.Value.(*lineCacheEntry)
+	entry.accessed = time.Now()
+	c.lru.MoveToFront(elem)
+	os.Chtimes(imgPath, entry.accessed, entry.accessed)
 	absPath, _ := filepath.Abs(imgPath)
 	return absPath
 }
 
+// Register remembers the URL of a line image, so it can be fetched into the
+// cache when it is requested
+func (c *LineImageCache) Register(id string, url string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.urls) >= maxRegisteredURLs {
+		c.urls = map[string]string{}
+	}
+	c.urls[id] = url
+}
+
+// RegisterLine remembers a line that is handed out to a client along with
+// the URL of its image, so that lines sent back by the client can be checked
+// against it
+func (c *LineImageCache) RegisterLine(id string, line OCRLine) {
+	line.Transcription = ""
+	line.Levels = nil
+	c.Register(id, line.ImageURL)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.lines) >= maxRegisteredURLs {
+		c.lines = map[string]OCRLine{}
+	}
+	c.lines[id] = line
+}
+
+// RegisteredLine returns the line that was registered for a line image
+func (c *LineImageCache) RegisteredLine(id string) (OCRLine, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	line, ok := c.lines[id]
+	return line, ok
+}
+
+// FetchLine returns the file path for a given line image, images that are
+// not cached yet are downloaded if their URL was registered
+func (c *LineImageCache) FetchLine(id string) (string, error) {
+	if imgPath := c.GetLinePath(id); imgPath != "" {
+		return imgPath, nil
+	}
+	c.mutex.Lock()
+	url, ok := c.urls[id]
+	c.mutex.Unlock()
+	if !ok {
+		return "", ErrUnknownLine
+	}
+	imgPath, err := c.CacheLine(url, id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(imgPath)
+}
+
+// MoveLine moves a cached line image out of the cache
+func (c *LineImageCache) MoveLine(id string, dst string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	imgPath := filepath.Join(c.path, id+".png")
+	if elem, ok := c.entries[id]; ok {
+		imgPath = c.entryPath(elem.Value.(*lineCacheEntry))
+	}
+	if err := moveFile(imgPath, dst); err != nil {
+		return err
+	}
+	c.forget(id)
+	return nil
+}
+
 // PurgeLines removes all cached line images that match the prefix
 func (c *LineImageCache) PurgeLines(prefix string) error {
-	lines, _ := filepath.Glob(filepath.Join(c.path, prefix+"*.png"))
-	for _, fpath := range lines {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	images, _ := filepath.Glob(filepath.Join(c.path, prefix+"*"))
+	for _, fpath := range images {
+		ext := filepath.Ext(fpath)
+		if ext != ".png" && ext != ".jpg" {
+			continue
+		}
 		if err := os.Remove(fpath); err != nil {
 			return err
 		}
+		c.forget(strings.TrimSuffix(filepath.Base(fpath), ext))
 	}
 	return nil
 }
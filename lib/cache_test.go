@@ -0,0 +1,346 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeCachedImage puts an image of the given size into the directory of a
+// line image cache, as if it was last accessed at the given time
+func writeCachedImage(t *testing.T, cacheDir string, name string, size int, accessed time.Time) {
+	t.Helper()
+	imgPath := filepath.Join(cacheDir, "line_images", name)
+	if err := os.MkdirAll(filepath.Dir(imgPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(imgPath, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(imgPath, accessed, accessed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cachedFiles lists the files in the directory of a line image cache
+func cachedFiles(t *testing.T, cacheDir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(filepath.Join(cacheDir, "line_images"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, finfo := range files {
+		names = append(names, finfo.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLineImageCacheEviction(t *testing.T) {
+	type cachedImage struct {
+		name string
+		size int
+		age  time.Duration
+	}
+	tests := []struct {
+		name          string
+		images        []cachedImage
+		options       LineCacheOptions
+		want          []string
+		wantBytes     int64
+		wantEvictions int64
+	}{
+		{
+			name: "within limits",
+			images: []cachedImage{
+				{"a.png", 100, 3 * time.Hour}, {"b.jpg", 100, 2 * time.Hour}},
+			options:   LineCacheOptions{MaxBytes: 200, TTL: 4 * time.Hour},
+			want:      []string{"a.png", "b.jpg"},
+			wantBytes: 200,
+		},
+		{
+			name: "oldest beyond size",
+			images: []cachedImage{
+				{"a.png", 100, 3 * time.Hour}, {"b.png", 100, 2 * time.Hour},
+				{"c.png", 100, time.Hour}},
+			options:       LineCacheOptions{MaxBytes: 250},
+			want:          []string{"b.png", "c.png"},
+			wantBytes:     200,
+			wantEvictions: 1,
+		},
+		{
+			name: "newest is kept even if too large",
+			images: []cachedImage{
+				{"a.png", 100, 2 * time.Hour}, {"b.png", 500, time.Hour}},
+			options:       LineCacheOptions{MaxBytes: 250},
+			want:          []string{"b.png"},
+			wantBytes:     500,
+			wantEvictions: 1,
+		},
+		{
+			name: "expired",
+			images: []cachedImage{
+				{"a.png", 100, 3 * time.Hour}, {"b.png", 100, 2 * time.Hour},
+				{"c.png", 100, time.Hour}},
+			options:       LineCacheOptions{TTL: 90 * time.Minute},
+			want:          []string{"c.png"},
+			wantBytes:     100,
+			wantEvictions: 2,
+		},
+		{
+			name: "expired and beyond size",
+			images: []cachedImage{
+				{"a.png", 100, 3 * time.Hour}, {"b.png", 100, 2 * time.Hour},
+				{"c.png", 100, time.Hour}, {"d.png", 100, time.Minute}},
+			options:       LineCacheOptions{MaxBytes: 150, TTL: 150 * time.Minute},
+			want:          []string{"d.png"},
+			wantBytes:     100,
+			wantEvictions: 3,
+		},
+		{
+			name: "no limits",
+			images: []cachedImage{
+				{"a.png", 100, 300 * time.Hour}, {"b.png", 1000, time.Hour}},
+			want:      []string{"a.png", "b.png"},
+			wantBytes: 1100,
+		},
+		{
+			name: "older format is removed",
+			images: []cachedImage{
+				{"a.png", 100, 3 * time.Hour}, {"a.jpg", 50, time.Hour}},
+			want:      []string{"a.jpg"},
+			wantBytes: 50,
+		},
+		{
+			name: "leftovers are removed",
+			images: []cachedImage{
+				{"a.png", 100, time.Hour}, {"a.png.123.tmp", 100, time.Hour},
+				{"notes.txt", 100, time.Hour}},
+			want:      []string{"a.png", "notes.txt"},
+			wantBytes: 100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir, err := ioutil.TempDir("", "archiscribe-cache")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(cacheDir)
+			now := time.Now()
+			for _, img := range tt.images {
+				writeCachedImage(t, cacheDir, img.name, img.size, now.Add(-img.age))
+			}
+			cache := NewLineImageCache(cacheDir, tt.options)
+			defer cache.Close()
+			if got := cachedFiles(t, cacheDir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cached files = %v, want %v", got, tt.want)
+			}
+			metrics := cache.Metrics()
+			if metrics.Bytes != tt.wantBytes {
+				t.Errorf("Bytes = %d, want %d", metrics.Bytes, tt.wantBytes)
+			}
+			if metrics.Evictions != tt.wantEvictions {
+				t.Errorf("Evictions = %d, want %d", metrics.Evictions, tt.wantEvictions)
+			}
+		})
+	}
+}
+
+func TestLineImageCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "archiscribe-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	now := time.Now()
+	writeCachedImage(t, cacheDir, "a.png", 100, now.Add(-3*time.Hour))
+	writeCachedImage(t, cacheDir, "b.png", 100, now.Add(-2*time.Hour))
+	cache := NewLineImageCache(cacheDir, LineCacheOptions{MaxBytes: 200})
+	defer cache.Close()
+
+	// Accessing the oldest image makes the other one the least recently used
+	if cache.GetLinePath("a") == "" {
+		t.Fatal("GetLinePath(a) did not find the cached image")
+	}
+	writeCachedImage(t, cacheDir, "c.png", 100, now)
+	cache.add("c", ".png", 100)
+
+	if got, want := cachedFiles(t, cacheDir), []string{"a.png", "c.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Cached files = %v, want %v", got, want)
+	}
+	if cache.GetLinePath("b") != "" {
+		t.Error("GetLinePath(b) found the evicted image")
+	}
+	metrics := cache.Metrics()
+	if metrics.Hits != 1 || metrics.Misses != 1 || metrics.Evictions != 1 {
+		t.Errorf("Hits, Misses, Evictions = %d, %d, %d, want 1, 1, 1",
+			metrics.Hits, metrics.Misses, metrics.Evictions)
+	}
+}
+
+func TestLineImageCacheExpiresUnusedImages(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "archiscribe-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	cache := NewLineImageCache(cacheDir, LineCacheOptions{
+		TTL: 50 * time.Millisecond, PurgeInterval: 10 * time.Millisecond})
+	defer cache.Close()
+	writeCachedImage(t, cacheDir, "a.jpg", 100, time.Now())
+	cache.add("a", ".jpg", 100)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.Metrics().NumImages > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := cachedFiles(t, cacheDir); len(got) != 0 {
+		t.Errorf("Cached files = %v, want none", got)
+	}
+	if metrics := cache.Metrics(); metrics.Evictions != 1 || metrics.Bytes != 0 {
+		t.Errorf("Evictions, Bytes = %d, %d, want 1, 0", metrics.Evictions, metrics.Bytes)
+	}
+}
+
+// openTestIdentifierCache opens an empty identifier cache in a temporary
+// directory, which is removed by the returned function
+func openTestIdentifierCache(t *testing.T) (*IdentifierCache, func()) {
+	t.Helper()
+	cacheDir, err := ioutil.TempDir("", "archiscribe-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := OpenIdentifierCache(filepath.Join(cacheDir, "identifiers.db"))
+	if err != nil {
+		os.RemoveAll(cacheDir)
+		t.Fatal(err)
+	}
+	return cache, func() {
+		cache.Close()
+		os.RemoveAll(cacheDir)
+	}
+}
+
+// identifierStates returns the state of every identifier in the cache
+func identifierStates(t *testing.T, cache *IdentifierCache) map[string]string {
+	t.Helper()
+	states := map[string]string{}
+	err := cache.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			var entry IdentifierCacheEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			states[entry.Identifier] = entry.State
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return states
+}
+
+func TestIdentifierCacheTransitions(t *testing.T) {
+	cache, cleanUp := openTestIdentifierCache(t)
+	defer cleanUp()
+	if err := cache.Add(
+		IdentifierCacheEntry{Identifier: "a", Year: 1850},
+		IdentifierCacheEntry{Identifier: "b", Year: 1850}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := cache.Lease(1850, 1850)
+	if err != nil {
+		t.Fatalf("Lease() failed: %s", err)
+	}
+	if first.State != IdentifierLeased || first.LeasedAt.IsZero() {
+		t.Errorf("Leased entry has state %q at %v", first.State, first.LeasedAt)
+	}
+	second, err := cache.Lease(1840, 1860)
+	if err != nil {
+		t.Fatalf("Lease() failed: %s", err)
+	}
+	if second.Identifier == first.Identifier {
+		t.Fatalf("%s was leased twice", first.Identifier)
+	}
+	if _, err := cache.Lease(1850, 1850); err != ErrNoIdentifiers {
+		t.Errorf("Lease() with everything leased = %v, want %v", err, ErrNoIdentifiers)
+	}
+
+	// A released identifier is handed out again, a consumed one never
+	if err := cache.Release(first.Identifier); err != nil {
+		t.Fatalf("Release() failed: %s", err)
+	}
+	if err := cache.Consume(second.Identifier); err != nil {
+		t.Fatalf("Consume() failed: %s", err)
+	}
+	want := map[string]string{
+		first.Identifier:  IdentifierAvailable,
+		second.Identifier: IdentifierConsumed,
+	}
+	if got := identifierStates(t, cache); !reflect.DeepEqual(got, want) {
+		t.Errorf("States = %v, want %v", got, want)
+	}
+	if got := cache.AvailableByYear(); !reflect.DeepEqual(got, map[int]int{1850: 1}) {
+		t.Errorf("AvailableByYear() = %v, want map[1850:1]", got)
+	}
+	again, err := cache.Lease(1850, 1850)
+	if err != nil || again.Identifier != first.Identifier {
+		t.Errorf("Lease() after release = %q, %v, want %q", again.Identifier, err, first.Identifier)
+	}
+
+	// Releasing is a no-op for identifiers that are not leased
+	if err := cache.Release(second.Identifier); err != nil {
+		t.Fatalf("Release() of a consumed identifier failed: %s", err)
+	}
+	if got := identifierStates(t, cache)[second.Identifier]; got != IdentifierConsumed {
+		t.Errorf("State after releasing a consumed identifier = %q", got)
+	}
+	if err := cache.Consume("missing"); err != ErrUnknownIdentifier {
+		t.Errorf("Consume(missing) = %v, want %v", err, ErrUnknownIdentifier)
+	}
+	if _, err := cache.Lease(1900, 1910); err != ErrUnknownYear {
+		t.Errorf("Lease() for unknown years = %v, want %v", err, ErrUnknownYear)
+	}
+}
+
+func TestIdentifierCacheExpiresLeases(t *testing.T) {
+	cache, cleanUp := openTestIdentifierCache(t)
+	defer cleanUp()
+	cache.LeaseTimeout = time.Hour
+	if err := cache.Add(IdentifierCacheEntry{Identifier: "a", Year: 1850}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Lease(1850, 1850); err != nil {
+		t.Fatalf("Lease() failed: %s", err)
+	}
+	if _, err := cache.Lease(1850, 1850); err != ErrNoIdentifiers {
+		t.Fatalf("Lease() of a fresh lease = %v, want %v", err, ErrNoIdentifiers)
+	}
+
+	// Pretend the task was abandoned two hours ago
+	err := cache.db.Update(func(tx *bolt.Tx) error {
+		leasedAt := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+		return tx.Bucket(leasesBucket).Put([]byte("a"), []byte(leasedAt))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.Lease(1850, 1850)
+	if err != nil {
+		t.Fatalf("Lease() of an expired lease failed: %s", err)
+	}
+	if entry.Identifier != "a" || time.Since(entry.LeasedAt) > time.Minute {
+		t.Errorf("Lease() = %+v, want a new lease of a", entry)
+	}
+}
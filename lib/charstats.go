@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/rivo/uniseg"
+)
+
+// Characters that occur at most this often in the corpus are considered rare
+const rareCharThreshold = 10
+
+// Maximum number of example lines recorded for every rare character
+const maxCharExamples = 5
+
+// LineRef references a single line in the corpus
+type LineRef struct {
+	Document string `json:"document"`
+	Year     int    `json:"year"`
+	Line     string `json:"line"`
+}
+
+// CharCount holds the frequency of a single code point or grapheme cluster
+type CharCount struct {
+	Char       string    `json:"char"`
+	CodePoints []string  `json:"codePoints"`
+	Count      int       `json:"count"`
+	Examples   []LineRef `json:"examples,omitempty"`
+}
+
+// CharStats holds the character frequencies for a set of lines
+type CharStats struct {
+	NumChars   int         `json:"numChars"`
+	CodePoints []CharCount `json:"codePoints"`
+	Graphemes  []CharCount `json:"graphemes"`
+}
+
+// DecadeCharStats holds the character frequencies for a single decade
+type DecadeCharStats struct {
+	Decade int `json:"decade"`
+	CharStats
+}
+
+// CharInventory holds the character frequencies for the whole corpus and
+// broken down by decade
+type CharInventory struct {
+	CharStats
+	Decades []DecadeCharStats `json:"decades"`
+}
+
+type charCounter struct {
+	numChars   int
+	codePoints map[string]*CharCount
+	graphemes  map[string]*CharCount
+}
+
+func newCharCounter() *charCounter {
+	return &charCounter{
+		codePoints: map[string]*CharCount{},
+		graphemes:  map[string]*CharCount{},
+	}
+}
+
+func countChar(counts map[string]*CharCount, char string, ref LineRef) {
+	count, ok := counts[char]
+	if !ok {
+		count = &CharCount{Char: char, CodePoints: codePointNames(char)}
+		counts[char] = count
+	}
+	count.Count++
+	if len(count.Examples) < maxCharExamples {
+		// Only record a line once per character
+		for _, example := range count.Examples {
+			if example == ref {
+				return
+			}
+		}
+		count.Examples = append(count.Examples, ref)
+	}
+}
+
+func (c *charCounter) add(text string, ref LineRef) {
+	graphemes := uniseg.NewGraphemes(text)
+	for graphemes.Next() {
+		cluster := graphemes.Str()
+		if strings.TrimSpace(cluster) == "" {
+			continue
+		}
+		c.numChars++
+		countChar(c.graphemes, cluster, ref)
+		for _, r := range graphemes.Runes() {
+			countChar(c.codePoints, string(r), ref)
+		}
+	}
+}
+
+func sortedCharCounts(counts map[string]*CharCount) []CharCount {
+	out := make([]CharCount, 0, len(counts))
+	for _, count := range counts {
+		if count.Count > rareCharThreshold {
+			count.Examples = nil
+		}
+		out = append(out, *count)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Char < out[j].Char
+	})
+	return out
+}
+
+func (c *charCounter) stats() CharStats {
+	return CharStats{
+		NumChars:   c.numChars,
+		CodePoints: sortedCharCounts(c.codePoints),
+		Graphemes:  sortedCharCounts(c.graphemes),
+	}
+}
+
+func codePointNames(char string) []string {
+	names := []string{}
+	for _, r := range char {
+		names = append(names, fmt.Sprintf("U+%04X", r))
+	}
+	return names
+}
+
+// ComputeCharInventory counts the code points and grapheme clusters in the
+// transcriptions of the given documents, which need to include their lines
+func ComputeCharInventory(documents []*Document) CharInventory {
+	total := newCharCounter()
+	decades := map[int]*charCounter{}
+	for _, doc := range documents {
+		decade := (doc.Year / 10) * 10
+		if _, ok := decades[decade]; !ok {
+			decades[decade] = newCharCounter()
+		}
+		for _, line := range doc.Lines {
+			ref := LineRef{Document: doc.Identifier, Year: doc.Year, Line: line.Identifier}
+			text := StripMarkup(line.Transcription, "")
+			total.add(text, ref)
+			decades[decade].add(text, ref)
+		}
+	}
+	inventory := CharInventory{
+		CharStats: total.stats(),
+		Decades:   []DecadeCharStats{},
+	}
+	for decade, counter := range decades {
+		inventory.Decades = append(inventory.Decades, DecadeCharStats{
+			Decade: decade, CharStats: counter.stats()})
+	}
+	sort.Slice(inventory.Decades, func(i, j int) bool {
+		return inventory.Decades[i].Decade < inventory.Decades[j].Decade
+	})
+	return inventory
+}
+
+// CharTable renders the grapheme frequencies as a Markdown table
+func (s CharStats) CharTable() string {
+	var out bytes.Buffer
+	t := tablewriter.NewWriter(&out)
+	t.SetAutoFormatHeaders(false)
+	t.SetAutoWrapText(false)
+	t.SetHeader([]string{"Character", "Code points", "Count", "Examples"})
+	t.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	t.SetCenterSeparator("|")
+	for _, count := range s.Graphemes {
+		examples := make([]string, 0, len(count.Examples))
+		for _, ref := range count.Examples {
+			examples = append(examples, fmt.Sprintf("%s_%s", ref.Document, ref.Line))
+		}
+		char := count.Char
+		if !unicode.IsGraphic([]rune(char)[0]) || char == "|" {
+			char = strings.Join(count.CodePoints, " ")
+		}
+		t.Append([]string{
+			char, strings.Join(count.CodePoints, " "), strconv.Itoa(count.Count),
+			strings.Join(examples, ", ")})
+	}
+	t.Render()
+	return out.String()
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CorpusConfigFile is the name of the configuration file in the root of
+// the corpus repository
+const CorpusConfigFile = "archiscribe.json"
+
+// SamplingConfig controls how lines are picked from a volume for a task
+type SamplingConfig struct {
+	Strategy string `json:"strategy"`
+}
+
+// ReadmeConfig controls the optional sections of the generated README
+type ReadmeConfig struct {
+	CharacterStats bool `json:"characterStats"`
+}
+
+// ExportConfig controls which lines are included in exports
+type ExportConfig struct {
+	// Lines with any of these flags are left out, unless the request
+	// specifies its own flags to exclude
+	ExcludeFlags []string `json:"excludeFlags"`
+}
+
+// CorpusConfig holds the per-corpus settings
+type CorpusConfig struct {
+	Sampling      SamplingConfig      `json:"sampling"`
+	Pages         PageConfig          `json:"pages"`
+	Filters       FilterConfig        `json:"filters"`
+	Targets       TargetConfig        `json:"targets"`
+	Readme        ReadmeConfig        `json:"readme"`
+	Validation    ValidationConfig    `json:"validation"`
+	Normalization NormalizationConfig `json:"normalization"`
+	Levels        []LevelConfig       `json:"levels"`
+	Export        ExportConfig        `json:"export"`
+	Crop          CropConfig          `json:"crop"`
+	Preprocess    PreprocessConfig    `json:"preprocess"`
+	Sources       SourcesConfig       `json:"sources"`
+}
+
+// DefaultCorpusConfig returns the settings used when the corpus does not
+// provide a configuration file
+func DefaultCorpusConfig() *CorpusConfig {
+	return &CorpusConfig{
+		Sampling: SamplingConfig{Strategy: SampleUniform},
+		Pages: PageConfig{
+			SkipClasses: []PageClass{
+				PageBlank, PageCover, PageTitle, PageTOC, PagePlate, PageIndex,
+				PageFront, PageBack},
+			MinLines:        10,
+			MinTextDensity:  0.15,
+			SkipPageNumbers: true,
+		},
+		Filters: FilterConfig{
+			MinWidth:           200,
+			MinAspectRatio:     3,
+			MaxAspectRatio:     80,
+			MaxHeightDeviation: 0.5,
+			MinChars:           5,
+			MaxNonLetterRatio:  0.5,
+			RejectBlockTypes:   []string{"Table", "Picture", "Barcode"},
+		},
+		Targets: TargetConfig{FromDecade: 1800, ToDecade: 1940},
+		Validation: ValidationConfig{
+			Rules:      map[string]string{RuleLookAlikes: SeverityError},
+			LookAlikes: map[string]string{"ʃ": "ſ", "∫": "ſ"},
+		},
+		Export: ExportConfig{
+			ExcludeFlags: []string{FlagIllegible, FlagCut, FlagUncertain},
+		},
+		Sources: SourcesConfig{Archive: true},
+	}
+}
+
+// LoadCorpusConfig reads the configuration from the corpus repository,
+// options that are missing from the file keep their default values
+func LoadCorpusConfig(repoPath string) (*CorpusConfig, error) {
+	config := DefaultCorpusConfig()
+	raw, err := ioutil.ReadFile(filepath.Join(repoPath, CorpusConfigFile))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,132 @@
+package lib
+
+import "sort"
+
+// TargetConfig holds the collection targets for the corpus, a zero value
+// disables the respective target
+type TargetConfig struct {
+	// First and last decade the corpus should cover
+	FromDecade        int `json:"fromDecade"`
+	ToDecade          int `json:"toDecade"`
+	LinesPerDecade    int `json:"linesPerDecade"`
+	MinWorksPerDecade int `json:"minWorksPerDecade"`
+	// Lines from a single work beyond this limit do not count towards the
+	// decade targets and tasks never contain more lines
+	MaxLinesPerWork int `json:"maxLinesPerWork"`
+	// Pick the most under-filled decade when a task is requested for a
+	// range of years that spans multiple decades
+	Prioritize bool `json:"prioritize"`
+}
+
+// DecadeCoverage reports the progress of a single decade against the targets
+type DecadeCoverage struct {
+	Decade      int     `json:"decade"`
+	NumLines    int     `json:"numLines"`
+	NumWorks    int     `json:"numWorks"`
+	TargetLines int     `json:"targetLines,omitempty"`
+	TargetWorks int     `json:"targetWorks,omitempty"`
+	Progress    float64 `json:"progress"`
+	IsFilled    bool    `json:"filled"`
+}
+
+// WorkCoverage reports a work that has more lines than the per-work limit
+type WorkCoverage struct {
+	Identifier string `json:"id"`
+	Year       int    `json:"year"`
+	NumLines   int    `json:"numLines"`
+}
+
+// CoverageReport holds the progress of the corpus against its targets
+type CoverageReport struct {
+	Targets       TargetConfig     `json:"targets"`
+	Decades       []DecadeCoverage `json:"decades"`
+	OverfullWorks []WorkCoverage   `json:"overfullWorks"`
+	Progress      float64          `json:"progress"`
+	// Commit the report was computed for
+	Commit string `json:"commit,omitempty"`
+}
+
+// ComputeCoverage determines the progress of the documents against the
+// targets
+func ComputeCoverage(documents []*Document, targets TargetConfig) CoverageReport {
+	report := CoverageReport{
+		Targets:       targets,
+		Decades:       []DecadeCoverage{},
+		OverfullWorks: []WorkCoverage{},
+	}
+	byDecade := map[int]*DecadeCoverage{}
+	if targets.FromDecade > 0 && targets.ToDecade >= targets.FromDecade {
+		for decade := targets.FromDecade; decade <= targets.ToDecade; decade += 10 {
+			byDecade[decade] = &DecadeCoverage{Decade: decade}
+		}
+	}
+	for _, doc := range documents {
+		decade := (doc.Year / 10) * 10
+		if _, ok := byDecade[decade]; !ok {
+			byDecade[decade] = &DecadeCoverage{Decade: decade}
+		}
+		numLines := doc.NumLines
+		if targets.MaxLinesPerWork > 0 && numLines > targets.MaxLinesPerWork {
+			report.OverfullWorks = append(report.OverfullWorks, WorkCoverage{
+				Identifier: doc.Identifier,
+				Year:       doc.Year,
+				NumLines:   doc.NumLines,
+			})
+			numLines = targets.MaxLinesPerWork
+		}
+		byDecade[decade].NumLines += numLines
+		byDecade[decade].NumWorks++
+	}
+	progressSum := 0.0
+	for _, dc := range byDecade {
+		dc.TargetLines = targets.LinesPerDecade
+		dc.TargetWorks = targets.MinWorksPerDecade
+		dc.Progress = decadeProgress(dc.NumLines, dc.NumWorks, targets)
+		dc.IsFilled = dc.Progress >= 1
+		progressSum += dc.Progress
+		report.Decades = append(report.Decades, *dc)
+	}
+	sort.Slice(report.Decades, func(i, j int) bool {
+		return report.Decades[i].Decade < report.Decades[j].Decade
+	})
+	if len(report.Decades) > 0 {
+		report.Progress = progressSum / float64(len(report.Decades))
+	}
+	return report
+}
+
+// decadeProgress is the progress towards the weakest of the targets, capped
+// at 1. Without any targets every decade counts as filled.
+func decadeProgress(numLines int, numWorks int, targets TargetConfig) float64 {
+	progress := 1.0
+	if targets.LinesPerDecade > 0 {
+		progress = minFloat(progress, float64(numLines)/float64(targets.LinesPerDecade))
+	}
+	if targets.MinWorksPerDecade > 0 {
+		progress = minFloat(progress, float64(numWorks)/float64(targets.MinWorksPerDecade))
+	}
+	return progress
+}
+
+func minFloat(a float64, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// DecadeScores returns the score by which the decades are prioritized for
+// new tasks, lower scores come first. Without any targets the number of
+// lines is used, so the decade with the fewest lines comes first.
+func (r CoverageReport) DecadeScores() map[int]float64 {
+	scores := map[int]float64{}
+	hasTargets := r.Targets.LinesPerDecade > 0 || r.Targets.MinWorksPerDecade > 0
+	for _, dc := range r.Decades {
+		if hasTargets {
+			scores[dc.Decade] = dc.Progress
+		} else {
+			scores[dc.Decade] = float64(dc.NumLines)
+		}
+	}
+	return scores
+}
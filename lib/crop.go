@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnknownLine is returned when a line is not part of a document
+var ErrUnknownLine = errors.New("Unknown line")
+
+// ErrForeignLine is returned for lines that were not handed out for the
+// document they are edited in
+var ErrForeignLine = errors.New("Line does not belong to the document")
+
+// ErrInvalidBox is returned for box corrections that do not result in a box
+// that can be cropped
+var ErrInvalidBox = errors.New("Invalid line box")
+
+// Matches the page number in the IIIF URLs of line images
+var iiifPagePat = regexp.MustCompile(`\$(\d+)/`)
+
+// Matches the region in the IIIF URLs of line images
+var iiifRegionPat = regexp.MustCompile(`/(\d+),(\d+),(\d+),(\d+)/full/`)
+
+// Padding is added around the box of a line when its image is cropped
+type Padding struct {
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+	Left   int `json:"left"`
+}
+
+// CropConfig controls how line images are cropped from the page images
+type CropConfig struct {
+	// Padding that is added to the ABBYY line boxes, e.g. to avoid cutting
+	// off descenders and umlaut dots
+	Padding Padding `json:"padding"`
+}
+
+// BoxCorrection replaces the box of a line in the corpus, adds padding to
+// it or both
+type BoxCorrection struct {
+	Box     *LineBox `json:"box,omitempty"`
+	Padding *Padding `json:"padding,omitempty"`
+	Author  string   `json:"author,omitempty"`
+	Email   string   `json:"email,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+}
+
+// Pad grows the box by the padding, without extending it beyond the
+// origin of the page or, if they are known, the page dimensions
+func (b LineBox) Pad(p Padding, pageWidth int, pageHeight int) LineBox {
+	x0, y0 := b.X-p.Left, b.Y-p.Top
+	x1, y1 := b.X+b.Width+p.Right, b.Y+b.Height+p.Bottom
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if pageWidth > 0 && x1 > pageWidth {
+		x1 = pageWidth
+	}
+	if pageHeight > 0 && y1 > pageHeight {
+		y1 = pageHeight
+	}
+	return LineBox{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+}
+
+// Valid checks if the box can be cropped from a page
+func (b LineBox) Valid() bool {
+	return b.X >= 0 && b.Y >= 0 && b.Width > 0 && b.Height > 0
+}
+
+// lineImageURL builds the IIIF URL for the image of a line box on a page
+func lineImageURL(ident string, pageNo int, box LineBox) string {
+	return fmt.Sprintf(
+		"https://iiif.archivelab.org/iiif/%s$%d/%d,%d,%d,%d/full/0/default.png",
+		ident, pageNo, box.X, box.Y, box.Width, box.Height)
+}
+
+// CorrectLineBox replaces the geometry of a line in the corpus, fetches a
+// new image for it and commits the changes
+func (s *DocumentStore) CorrectLineBox(ident string, lineID string, correction BoxCorrection) (*Document, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	logger := log.With().Str("identifier", ident).Str("lineId", lineID).Logger()
+	if err := s.repo.CleanUp(); err != nil {
+		return nil, err
+	}
+	if err := s.repo.Pull("origin", "master", true); err != nil {
+		return nil, err
+	}
+	doc := s.Details(ident)
+	if doc == nil {
+		return nil, ErrUnknownLine
+	}
+	lineIdx := -1
+	for idx, line := range doc.Lines {
+		if line.Identifier == lineID {
+			lineIdx = idx
+		}
+	}
+	if lineIdx < 0 {
+		return nil, ErrUnknownLine
+	}
+	line := &doc.Lines[lineIdx]
+	box := line.lineBox()
+	if correction.Box != nil {
+		box = *correction.Box
+	} else if !box.Valid() {
+		// Padding can not be added to a box we do not know
+		logger.Warn().Msg("Line has no box, a box has to be passed")
+		return nil, ErrInvalidBox
+	}
+	if correction.Padding != nil {
+		box = box.Pad(*correction.Padding, 0, 0)
+	}
+	if !box.Valid() {
+		logger.Warn().Interface("box", box).Msg("Corrected box is invalid")
+		return nil, ErrInvalidBox
+	}
+	source, err := s.Source(doc.Source)
+	if err != nil {
+		return nil, err
+	}
+	line.PageNumber = line.pageNumber()
+	oldURL := line.ImageURL
+	line.Box = box
+	line.ImageURL = source.CropURL(ident, *line, box)
+	for idx := range doc.Lines {
+		if doc.Lines[idx].PreviousImageURL == oldURL {
+			doc.Lines[idx].PreviousImageURL = line.ImageURL
+		}
+		if doc.Lines[idx].NextImageURL == oldURL {
+			doc.Lines[idx].NextImageURL = line.ImageURL
+		}
+	}
+
+	// Flagged lines without a transcription have no image in the corpus
+	if line.Transcription != "" {
+		logger.Info().Str("url", line.ImageURL).Msg("Fetching re-cropped line image")
+		cacheID := MakeLineIdentifier(ident, *line)
+		if _, err := LineCache.CacheLine(line.ImageURL, cacheID); err != nil {
+			return nil, err
+		}
+		imgPath := filepath.Join(
+			s.basePath, "transcriptions", strconv.Itoa(doc.Year),
+			fmt.Sprintf("%s_%s.png", ident, lineID))
+		if err := LineCache.MoveLine(cacheID, imgPath); err != nil {
+			return nil, err
+		}
+		if err := s.repo.Add(imgPath); err != nil {
+			return nil, err
+		}
+		if err := s.writeImageVariants(imgPath, line.Skew); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.writeMetadata(*doc); err != nil {
+		return nil, err
+	}
+	commitMessage := fmt.Sprintf(
+		"Corrected box of line %s in %s (%d)", lineID, ident, doc.Year)
+	if correction.Comment != "" {
+		commitMessage += ("\n" + correction.Comment)
+	}
+	if _, err := s.repo.Commit(commitMessage, correction.Author, correction.Email); err != nil {
+		return nil, err
+	}
+	logger.Info().Msg("Committed")
+	s.repo.Push("origin", "master")
+	return s.Details(ident), nil
+}
+
+// moveFile copies a file to its destination and removes the original
+func moveFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	_, err = io.Copy(out, in)
+	in.Close()
+	out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
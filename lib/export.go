@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the export formats
+const (
+	ExportText = "txt"
+	ExportPAGE = "page"
+	ExportALTO = "alto"
+	// W3C Web Annotations on the canvases of the source IIIF manifest
+	ExportAnnotations = "annotations"
+)
+
+// Exporter writes a document with its transcribed lines in a given format
+type Exporter interface {
+	ContentType() string
+	Extension() string
+	Export(doc *Document, w io.Writer) error
+}
+
+// NewExporter creates an exporter for the format with the given name, formats
+// that include the line images use the processed variant of the images
+// with the given name or the original images if it is empty
+func (s *DocumentStore) NewExporter(format string, imageVariant string) (Exporter, error) {
+	switch format {
+	case ExportText:
+		return &TextExporter{}, nil
+	case ExportPAGE:
+		return &lineArchiveExporter{s, ".xml", imageVariant, writePAGE}, nil
+	case ExportALTO:
+		return &lineArchiveExporter{s, ".xml", imageVariant, writeALTO}, nil
+	case ExportAnnotations:
+		return &AnnotationExporter{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown export format '%s'", format)
+	}
+}
+
+// TextExporter writes the transcriptions as plain text, one line per line.
+// Uncertain readings are kept as is, unreadable characters are replaced
+// with GapChar.
+type TextExporter struct{}
+
+// ContentType of the exported document
+func (e *TextExporter) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+// Extension of the exported document
+func (e *TextExporter) Extension() string {
+	return ".txt"
+}
+
+// Export the transcriptions of all lines
+func (e *TextExporter) Export(doc *Document, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for _, line := range doc.Lines {
+		if line.Transcription == "" {
+			continue
+		}
+		if _, err := out.WriteString(StripMarkup(line.Transcription, GapChar) + "\n"); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// lineArchiveExporter writes a ZIP archive with the image of every line,
+// named <ident>_<lineId>.png or <ident>_<lineId>.<variant>.png, and a file
+// next to it that describes the image
+type lineArchiveExporter struct {
+	store     *DocumentStore
+	extension string
+	variant   string
+	writeLine func(imageName string, width int, height int, line OCRLine, w io.Writer) error
+}
+
+func (e *lineArchiveExporter) ContentType() string {
+	return "application/zip"
+}
+
+func (e *lineArchiveExporter) Extension() string {
+	return ".zip"
+}
+
+func (e *lineArchiveExporter) Export(doc *Document, w io.Writer) error {
+	archive := zip.NewWriter(w)
+	for _, line := range doc.Lines {
+		if line.Transcription == "" {
+			continue
+		}
+		baseName := fmt.Sprintf("%s_%s", doc.Identifier, line.Identifier)
+		imgPath := e.store.LineImagePath(baseName, e.variant)
+		if imgPath == "" {
+			return fmt.Errorf("Image of line %s is not in the corpus", baseName)
+		}
+		// Processed variants can be scaled or padded, the layout describes
+		// the image in the archive
+		width, height, err := ImageSize(imgPath)
+		if err != nil {
+			return err
+		}
+		imageName := filepath.Base(imgPath)
+		if err := addFile(archive, imageName, imgPath); err != nil {
+			return err
+		}
+		out, err := archive.Create(baseName + e.extension)
+		if err != nil {
+			return err
+		}
+		if err := e.writeLine(imageName, width, height, line, out); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// addFile copies a file into an archive
+func addFile(archive *zip.Writer, name string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Images are already compressed
+	out, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, file)
+	return err
+}
+
+func writeXML(value interface{}, w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(value)
+}
+
+// Character confidences for ALTO, 0 is certain and 9 unreadable
+const (
+	altoCertain   = '0'
+	altoUncertain = '5'
+	altoGap       = '9'
+)
+
+type pageCoords struct {
+	Points string `xml:"points,attr"`
+}
+
+type pageTextEquiv struct {
+	Conf    string `xml:"conf,attr,omitempty"`
+	Unicode string `xml:"Unicode"`
+}
+
+type pageXML struct {
+	XMLName  xml.Name `xml:"http://schema.primaresearch.org/PAGE/gts/pagecontent/2019-07-15 PcGts"`
+	Metadata struct {
+		Creator    string `xml:"Creator"`
+		Created    string `xml:"Created"`
+		LastChange string `xml:"LastChange"`
+	} `xml:"Metadata"`
+	Page struct {
+		ImageFilename string `xml:"imageFilename,attr"`
+		ImageWidth    int    `xml:"imageWidth,attr"`
+		ImageHeight   int    `xml:"imageHeight,attr"`
+		TextRegion    struct {
+			ID       string     `xml:"id,attr"`
+			Coords   pageCoords `xml:"Coords"`
+			TextLine struct {
+				ID        string        `xml:"id,attr"`
+				Custom    string        `xml:"custom,attr,omitempty"`
+				Coords    pageCoords    `xml:"Coords"`
+				TextEquiv pageTextEquiv `xml:"TextEquiv"`
+			} `xml:"TextLine"`
+		} `xml:"TextRegion"`
+	} `xml:"Page"`
+}
+
+// writePAGE writes a PAGE XML file for a single line image. Uncertain
+// readings and gaps are marked with `unclear` and `gap` tags in the custom
+// attribute of the line, unreadable characters are replaced with GapChar.
+// The line covers the whole image of the given size.
+func writePAGE(imageName string, width int, height int, line OCRLine, w io.Writer) error {
+	text, spans := markupSpans(line.Transcription)
+	now := time.Now().UTC().Format(time.RFC3339)
+	coords := pageCoords{fmt.Sprintf(
+		"0,0 %d,0 %d,%d 0,%d", width, width, height, height)}
+	doc := pageXML{}
+	doc.Metadata.Creator = "archiscribe"
+	doc.Metadata.Created = now
+	doc.Metadata.LastChange = now
+	doc.Page.ImageFilename = imageName
+	doc.Page.ImageWidth = width
+	doc.Page.ImageHeight = height
+	doc.Page.TextRegion.ID = "r_" + line.Identifier
+	doc.Page.TextRegion.Coords = coords
+	doc.Page.TextRegion.TextLine.ID = "l_" + line.Identifier
+	doc.Page.TextRegion.TextLine.Coords = coords
+	doc.Page.TextRegion.TextLine.TextEquiv.Unicode = text
+	tags := []string{}
+	for _, span := range spans {
+		tag := "unclear"
+		if span.IsGap {
+			tag = "gap"
+		}
+		tags = append(tags, fmt.Sprintf(
+			"%s {offset:%d; length:%d;}", tag, span.Offset, span.Length))
+	}
+	doc.Page.TextRegion.TextLine.Custom = strings.Join(tags, " ")
+	if len(spans) > 0 {
+		doc.Page.TextRegion.TextLine.TextEquiv.Conf = fmt.Sprintf(
+			"%.2f", markupConfidence(altoConfidences(text, spans)))
+	}
+	return writeXML(doc, w)
+}
+
+type altoString struct {
+	XMLName xml.Name `xml:"String"`
+	Content string   `xml:"CONTENT,attr"`
+	WC      string   `xml:"WC,attr"`
+	CC      string   `xml:"CC,attr"`
+}
+
+type altoTextLine struct {
+	ID     string        `xml:"ID,attr"`
+	HPOS   int           `xml:"HPOS,attr"`
+	VPOS   int           `xml:"VPOS,attr"`
+	Width  int           `xml:"WIDTH,attr"`
+	Height int           `xml:"HEIGHT,attr"`
+	Items  []interface{} `xml:",any"`
+}
+
+type altoSpace struct {
+	XMLName xml.Name `xml:"SP"`
+}
+
+type altoXML struct {
+	XMLName     xml.Name `xml:"http://www.loc.gov/standards/alto/ns-v4# alto"`
+	Description struct {
+		MeasurementUnit string `xml:"MeasurementUnit"`
+		FileName        string `xml:"sourceImageInformation>fileName"`
+	} `xml:"Description"`
+	Page struct {
+		ID         string `xml:"ID,attr"`
+		Width      int    `xml:"WIDTH,attr"`
+		Height     int    `xml:"HEIGHT,attr"`
+		PhysImgNr  int    `xml:"PHYSICAL_IMG_NR,attr"`
+		PrintSpace struct {
+			HPOS      int `xml:"HPOS,attr"`
+			VPOS      int `xml:"VPOS,attr"`
+			Width     int `xml:"WIDTH,attr"`
+			Height    int `xml:"HEIGHT,attr"`
+			TextBlock struct {
+				ID       string       `xml:"ID,attr"`
+				HPOS     int          `xml:"HPOS,attr"`
+				VPOS     int          `xml:"VPOS,attr"`
+				Width    int          `xml:"WIDTH,attr"`
+				Height   int          `xml:"HEIGHT,attr"`
+				TextLine altoTextLine `xml:"TextLine"`
+			} `xml:"TextBlock"`
+		} `xml:"PrintSpace"`
+	} `xml:"Layout>Page"`
+}
+
+// altoConfidences returns the ALTO character confidence for every
+// character of the text without markup
+func altoConfidences(text string, spans []markupSpan) []rune {
+	confs := []rune(strings.Repeat(string(altoCertain), len([]rune(text))))
+	for _, span := range spans {
+		conf := altoUncertain
+		if span.IsGap {
+			conf = altoGap
+		}
+		for idx := span.Offset; idx < span.Offset+span.Length; idx++ {
+			confs[idx] = conf
+		}
+	}
+	return confs
+}
+
+// markupConfidence maps ALTO character confidences to a confidence between
+// 0 and 1
+func markupConfidence(confs []rune) float64 {
+	if len(confs) == 0 {
+		return 1
+	}
+	sum := 0
+	for _, conf := range confs {
+		sum += int(conf - '0')
+	}
+	return 1 - float64(sum)/float64(9*len(confs))
+}
+
+// writeALTO writes an ALTO XML file for a single line image. Every word
+// carries a word confidence and the confidences of its characters,
+// unreadable characters are replaced with GapChar. The line covers the whole
+// image of the given size.
+func writeALTO(imageName string, width int, height int, line OCRLine, w io.Writer) error {
+	text, spans := markupSpans(line.Transcription)
+	confs := altoConfidences(text, spans)
+	doc := altoXML{}
+	doc.Description.MeasurementUnit = "pixel"
+	doc.Description.FileName = imageName
+	doc.Page.ID = "p_" + line.Identifier
+	doc.Page.Width = width
+	doc.Page.Height = height
+	doc.Page.PhysImgNr = 1
+	doc.Page.PrintSpace.Width = width
+	doc.Page.PrintSpace.Height = height
+	block := &doc.Page.PrintSpace.TextBlock
+	block.ID = "b_" + line.Identifier
+	block.Width = width
+	block.Height = height
+	block.TextLine = altoTextLine{
+		ID: "l_" + line.Identifier, Width: width, Height: height}
+	offset := 0
+	for _, word := range strings.Split(text, " ") {
+		length := len([]rune(word))
+		if length > 0 {
+			if len(block.TextLine.Items) > 0 {
+				block.TextLine.Items = append(block.TextLine.Items, altoSpace{})
+			}
+			wordConfs := confs[offset : offset+length]
+			block.TextLine.Items = append(block.TextLine.Items, altoString{
+				Content: word,
+				WC:      fmt.Sprintf("%.2f", markupConfidence(wordConfs)),
+				CC:      strings.Join(strings.Split(string(wordConfs), ""), " "),
+			})
+		}
+		offset += length + 1
+	}
+	return writeXML(doc, w)
+}
@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"sort"
+	"unicode"
+)
+
+// FilterConfig controls which lines are rejected before they are used for
+// tasks, a zero value disables the respective check
+type FilterConfig struct {
+	MinWidth       int     `json:"minWidth"`
+	MinAspectRatio float64 `json:"minAspectRatio"`
+	MaxAspectRatio float64 `json:"maxAspectRatio"`
+	// Maximum relative deviation of the line height from the median line
+	// height of the page
+	MaxHeightDeviation float64 `json:"maxHeightDeviation"`
+	MinConfidence      float64 `json:"minConfidence"`
+	MinChars           int     `json:"minChars"`
+	// Maximum share of characters that are neither letters nor spaces
+	MaxNonLetterRatio float64 `json:"maxNonLetterRatio"`
+	// ABBYY block types whose lines are rejected, e.g. Table or Picture
+	RejectBlockTypes []string `json:"rejectBlockTypes"`
+}
+
+// LineContext holds information about the page a line is on
+type LineContext struct {
+	Page         PageInfo
+	MedianHeight int
+}
+
+// LineFilter rejects lines that are unsuitable for transcription
+type LineFilter interface {
+	// Reason returns the name under which rejections are reported
+	Reason() string
+	Accept(line OCRLine, ctx LineContext) bool
+}
+
+// NewLineFilters builds the filter pipeline for the given configuration
+func NewLineFilters(config *CorpusConfig) []LineFilter {
+	fc := config.Filters
+	filters := []LineFilter{}
+	if fc.MinWidth > 0 {
+		filters = append(filters, minWidthFilter(fc.MinWidth))
+	}
+	if len(fc.RejectBlockTypes) > 0 {
+		filters = append(filters, blockTypeFilter(fc.RejectBlockTypes))
+	}
+	if config.Pages.SkipPageNumbers {
+		filters = append(filters, pageNumberFilter{})
+	}
+	if fc.MinAspectRatio > 0 || fc.MaxAspectRatio > 0 {
+		filters = append(filters, aspectRatioFilter{fc.MinAspectRatio, fc.MaxAspectRatio})
+	}
+	if fc.MaxHeightDeviation > 0 {
+		filters = append(filters, heightFilter(fc.MaxHeightDeviation))
+	}
+	if fc.MinConfidence > 0 {
+		filters = append(filters, confidenceFilter(fc.MinConfidence))
+	}
+	if fc.MinChars > 0 {
+		filters = append(filters, charCountFilter(fc.MinChars))
+	}
+	if fc.MaxNonLetterRatio > 0 {
+		filters = append(filters, nonLetterFilter(fc.MaxNonLetterRatio))
+	}
+	return filters
+}
+
+// FilterLines runs the lines of a single page through the filters and
+// returns the accepted lines. Rejections are counted by reason in rejected.
+func FilterLines(lines []OCRLine, page PageInfo, filters []LineFilter, rejected map[string]int) []OCRLine {
+	ctx := LineContext{Page: page, MedianHeight: medianHeight(lines)}
+	accepted := make([]OCRLine, 0, len(lines))
+	for _, line := range lines {
+		isAccepted := true
+		for _, filter := range filters {
+			if !filter.Accept(line, ctx) {
+				rejected[filter.Reason()]++
+				isAccepted = false
+				break
+			}
+		}
+		if isAccepted {
+			accepted = append(accepted, line)
+		}
+	}
+	return accepted
+}
+
+func medianHeight(lines []OCRLine) int {
+	if len(lines) == 0 {
+		return 0
+	}
+	heights := make([]int, 0, len(lines))
+	for _, line := range lines {
+		heights = append(heights, line.Box.Height)
+	}
+	sort.Ints(heights)
+	return heights[len(heights)/2]
+}
+
+type minWidthFilter int
+
+func (f minWidthFilter) Reason() string { return "width" }
+
+func (f minWidthFilter) Accept(line OCRLine, ctx LineContext) bool {
+	return line.Box.Width >= int(f)
+}
+
+type blockTypeFilter []string
+
+func (f blockTypeFilter) Reason() string { return "blockType" }
+
+func (f blockTypeFilter) Accept(line OCRLine, ctx LineContext) bool {
+	for _, blockType := range f {
+		if line.BlockType == blockType {
+			return false
+		}
+	}
+	return true
+}
+
+type pageNumberFilter struct{}
+
+func (f pageNumberFilter) Reason() string { return "pageNumber" }
+
+func (f pageNumberFilter) Accept(line OCRLine, ctx LineContext) bool {
+	if ctx.Page.Height <= 0 {
+		return true
+	}
+	relY := (float64(line.Box.Y) + float64(line.Box.Height)/2) / float64(ctx.Page.Height)
+	return !isPageNumber(line.OCRText, relY)
+}
+
+type aspectRatioFilter struct {
+	min float64
+	max float64
+}
+
+func (f aspectRatioFilter) Reason() string { return "aspectRatio" }
+
+func (f aspectRatioFilter) Accept(line OCRLine, ctx LineContext) bool {
+	if line.Box.Height <= 0 {
+		return false
+	}
+	ratio := float64(line.Box.Width) / float64(line.Box.Height)
+	return ratio >= f.min && (f.max <= 0 || ratio <= f.max)
+}
+
+type heightFilter float64
+
+func (f heightFilter) Reason() string { return "height" }
+
+func (f heightFilter) Accept(line OCRLine, ctx LineContext) bool {
+	if ctx.MedianHeight <= 0 {
+		return true
+	}
+	deviation := float64(line.Box.Height-ctx.MedianHeight) / float64(ctx.MedianHeight)
+	return deviation <= float64(f) && deviation >= -float64(f)
+}
+
+type confidenceFilter float64
+
+func (f confidenceFilter) Reason() string { return "confidence" }
+
+func (f confidenceFilter) Accept(line OCRLine, ctx LineContext) bool {
+	// Lines without confidence information are kept
+	return line.Confidence < 0 || line.Confidence >= float64(f)
+}
+
+type charCountFilter int
+
+func (f charCountFilter) Reason() string { return "charCount" }
+
+func (f charCountFilter) Accept(line OCRLine, ctx LineContext) bool {
+	return len([]rune(line.OCRText)) >= int(f)
+}
+
+type nonLetterFilter float64
+
+func (f nonLetterFilter) Reason() string { return "nonLetterRatio" }
+
+func (f nonLetterFilter) Accept(line OCRLine, ctx LineContext) bool {
+	numChars := 0
+	numNonLetters := 0
+	for _, c := range line.OCRText {
+		if unicode.IsSpace(c) {
+			continue
+		}
+		numChars++
+		if !unicode.IsLetter(c) {
+			numNonLetters++
+		}
+	}
+	if numChars == 0 {
+		return true
+	}
+	return float64(numNonLetters)/float64(numChars) <= float64(f)
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterLinesReportsReasons(t *testing.T) {
+	config := &CorpusConfig{
+		Pages: PageConfig{SkipPageNumbers: true},
+		Filters: FilterConfig{
+			MinWidth:           100,
+			MinAspectRatio:     3,
+			MaxAspectRatio:     60,
+			MaxHeightDeviation: 0.5,
+			MinConfidence:      0.5,
+			MinChars:           5,
+			MaxNonLetterRatio:  0.3,
+			RejectBlockTypes:   []string{"Table"},
+		},
+	}
+	page := PageInfo{Width: 1000, Height: 2000}
+	text := "Die Wörter"
+	// Every line but the first two fails exactly the check it is named after,
+	// the median height of the page is 40
+	lines := []OCRLine{
+		{Identifier: "ok", OCRText: text, Confidence: 0.9,
+			Box: LineBox{Y: 1000, Width: 800, Height: 40}},
+		{Identifier: "unknownConfidence", OCRText: text, Confidence: -1,
+			Box: LineBox{Y: 1040, Width: 800, Height: 40}},
+		{Identifier: "width", OCRText: text, Confidence: 0.9,
+			Box: LineBox{Y: 1080, Width: 90, Height: 25}},
+		{Identifier: "blockType", OCRText: text, Confidence: 0.9, BlockType: "Table",
+			Box: LineBox{Y: 1120, Width: 800, Height: 40}},
+		{Identifier: "pageNumber", OCRText: "(12)", Confidence: 0.9,
+			Box: LineBox{Y: 1950, Width: 800, Height: 40}},
+		{Identifier: "aspectRatio", OCRText: text, Confidence: 0.9,
+			Box: LineBox{Y: 1160, Width: 150, Height: 55}},
+		{Identifier: "height", OCRText: text, Confidence: 0.9,
+			Box: LineBox{Y: 1200, Width: 800, Height: 61}},
+		{Identifier: "confidence", OCRText: text, Confidence: 0.3,
+			Box: LineBox{Y: 1240, Width: 800, Height: 40}},
+		{Identifier: "charCount", OCRText: "Die", Confidence: 0.9,
+			Box: LineBox{Y: 1280, Width: 800, Height: 40}},
+		{Identifier: "nonLetterRatio", OCRText: "1848, 1849", Confidence: 0.9,
+			Box: LineBox{Y: 1320, Width: 800, Height: 40}},
+	}
+	rejected := map[string]int{}
+	accepted := FilterLines(lines, page, NewLineFilters(config), rejected)
+
+	acceptedIDs := []string{}
+	for _, line := range accepted {
+		acceptedIDs = append(acceptedIDs, line.Identifier)
+	}
+	if want := []string{"ok", "unknownConfidence"}; !reflect.DeepEqual(acceptedIDs, want) {
+		t.Errorf("Accepted %v, want %v", acceptedIDs, want)
+	}
+	wantRejected := map[string]int{}
+	for _, line := range lines[2:] {
+		wantRejected[line.Identifier] = 1
+	}
+	if !reflect.DeepEqual(rejected, wantRejected) {
+		t.Errorf("Rejected %v, want %v", rejected, wantRejected)
+	}
+}
+
+func TestFilterLinesCountsFirstReasonOnly(t *testing.T) {
+	config := &CorpusConfig{Filters: FilterConfig{MinWidth: 100, MinChars: 5}}
+	lines := []OCRLine{
+		{OCRText: "a", Box: LineBox{Width: 10, Height: 10}},
+		{OCRText: "a", Box: LineBox{Width: 200, Height: 10}},
+	}
+	rejected := map[string]int{}
+	if got := FilterLines(lines, PageInfo{}, NewLineFilters(config), rejected); len(got) != 0 {
+		t.Errorf("Accepted %d lines, want none", len(got))
+	}
+	if want := map[string]int{"width": 1, "charCount": 1}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("Rejected %v, want %v", rejected, want)
+	}
+
+	// Without any checks configured every line is kept
+	if got := FilterLines(lines, PageInfo{}, NewLineFilters(&CorpusConfig{}), rejected); len(got) != 2 {
+		t.Errorf("Accepted %d lines without filters, want 2", len(got))
+	}
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Flags that transcribers can set on a line
+const (
+	FlagIllegible = "illegible"
+	FlagCut       = "cut"
+	FlagForeign   = "foreign"
+	FlagGreek     = "greek"
+	FlagUncertain = "uncertain"
+)
+
+// LineFlags are all flags that can be set on a line
+var LineFlags = []string{FlagIllegible, FlagCut, FlagForeign, FlagGreek, FlagUncertain}
+
+// HasFlag checks if the line has the given flag set
+func (l OCRLine) HasFlag(flag string) bool {
+	for _, f := range l.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFlags makes sure that all lines in the document only use known flags
+func CheckFlags(doc Document) error {
+	for _, line := range doc.Lines {
+		for _, flag := range line.Flags {
+			known := false
+			for _, f := range LineFlags {
+				known = known || f == flag
+			}
+			if !known {
+				return fmt.Errorf("Unknown flag '%s' on line %s, must be one of %s",
+					flag, line.Identifier, strings.Join(LineFlags, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// FilterFlags only keeps the lines of the document that have all of the
+// flags in `with` and none of the flags in `without`
+func (doc *Document) FilterFlags(with []string, without []string) {
+	filtered := make([]OCRLine, 0, len(doc.Lines))
+	for _, line := range doc.Lines {
+		keep := true
+		for _, flag := range with {
+			keep = keep && line.HasFlag(flag)
+		}
+		for _, flag := range without {
+			keep = keep && !line.HasFlag(flag)
+		}
+		if keep {
+			filtered = append(filtered, line)
+		}
+	}
+	doc.Lines = filtered
+}
@@ -0,0 +1,383 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// ErrUnknownImage is returned when an image is neither part of the corpus
+// nor can be fetched into the cache
+var ErrUnknownImage = errors.New("Unknown image")
+
+// ErrIIIFNotImplemented is returned for valid IIIF Image API requests that
+// use features we do not support, e.g. arbitrary rotations
+var ErrIIIFNotImplemented = errors.New("Not implemented")
+
+// Images are never scaled beyond this width or height
+const maxIIIFDimension = 10000
+
+// Matches the identifiers of page images, <ident>$<pageNo> like on
+// iiif.archivelab.org
+var pageImageIDPat = regexp.MustCompile(`^([\w.-]+)\$(\d+)$`)
+
+// IIIFFormats maps the supported IIIF formats to their content types
+var IIIFFormats = map[string]string{
+	"png": "image/png",
+	"jpg": "image/jpeg",
+}
+
+// pageImageID builds the IIIF identifier of a page image
+func pageImageID(ident string, pageNo int) string {
+	return fmt.Sprintf("%s$%d", ident, pageNo)
+}
+
+// pageImageURL builds the IIIF URL for the full image of a page
+func pageImageURL(ident string, pageNo int) string {
+	return fmt.Sprintf(
+		"https://iiif.archivelab.org/iiif/%s$%d/full/full/0/default.jpg", ident, pageNo)
+}
+
+// IIIFImagePath returns the path of the image with the given IIIF
+// identifier. Line images are taken from the corpus or the line cache, page
+// images of documents in the corpus are fetched into the cache.
+func (s *DocumentStore) IIIFImagePath(id string) (string, error) {
+	if ValidLineImageID(id) {
+		if imgPath := s.LineImagePath(id, ""); imgPath != "" {
+			return imgPath, nil
+		}
+		imgPath, err := LineCache.FetchLine(id)
+		if err == ErrUnknownLine {
+			return "", ErrUnknownImage
+		}
+		return imgPath, err
+	}
+	match := pageImageIDPat.FindStringSubmatch(id)
+	if match == nil {
+		return "", ErrUnknownImage
+	}
+	metaPaths, _ := filepath.Glob(
+		filepath.Join(s.basePath, "transcriptions", "*", match[1]+".json"))
+	if len(metaPaths) == 0 {
+		return "", ErrUnknownImage
+	}
+	if imgPath := LineCache.GetLinePath(id); imgPath != "" {
+		return imgPath, nil
+	}
+	// The source knows the page image from any line on the page
+	doc := s.Details(match[1])
+	source, err := s.Source(doc.Source)
+	if err != nil {
+		return "", err
+	}
+	pageNo, _ := strconv.Atoi(match[2])
+	for _, line := range doc.Lines {
+		if line.pageNumber() != pageNo {
+			continue
+		}
+		imgPath, err := LineCache.CachePage(source.PageURL(doc.Identifier, line), id)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Abs(imgPath)
+	}
+	return "", ErrUnknownImage
+}
+
+// ImageSize reads the dimensions of the image at the given path
+func ImageSize(imgPath string) (int, int, error) {
+	file, err := os.Open(imgPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// IIIFImageInfo describes an image for the info.json of the IIIF Image API
+// in version 2 or 3
+func IIIFImageInfo(serviceID string, width int, height int, version int) map[string]interface{} {
+	formats := []string{"png", "jpg"}
+	qualities := []string{"default", "color", "gray", "bitonal"}
+	features := []string{
+		"regionByPx", "regionByPct", "regionSquare", "sizeByW", "sizeByH", "sizeByPct",
+		"sizeByWh", "sizeByConfinedWh", "rotationBy90s", "mirroring"}
+	if version == 2 {
+		return map[string]interface{}{
+			"@context": "http://iiif.io/api/image/2/context.json",
+			"@id":      serviceID,
+			"protocol": "http://iiif.io/api/image",
+			"width":    width,
+			"height":   height,
+			"profile": []interface{}{
+				"http://iiif.io/api/image/2/level1.json",
+				map[string]interface{}{
+					"formats":   formats,
+					"qualities": qualities,
+					"supports":  append(features, "sizeAboveFull"),
+				},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"@context":       "http://iiif.io/api/image/3/context.json",
+		"id":             serviceID,
+		"type":           "ImageService3",
+		"protocol":       "http://iiif.io/api/image",
+		"profile":        "level1",
+		"width":          width,
+		"height":         height,
+		"maxWidth":       maxIIIFDimension,
+		"maxHeight":      maxIIIFDimension,
+		"extraQualities": []string{"color", "gray", "bitonal"},
+		"extraFeatures":  append(features, "sizeUpscaling"),
+	}
+}
+
+// IIIFImageRequest holds the parameters of a IIIF Image API request, both
+// the syntax of version 2 and version 3 are accepted
+type IIIFImageRequest struct {
+	Region   string
+	Size     string
+	Rotation string
+	Quality  string
+	Format   string
+	// Version of the Image API, sizes beyond the region are only served for
+	// version 2 or with the "^" prefix of version 3
+	Version int
+}
+
+// ParseIIIFImageRequest parses the last path segments of a IIIF Image API
+// request in the given version, the quality and format are passed as a
+// single segment
+func ParseIIIFImageRequest(region string, size string, rotation string, qualityFormat string, version int) (IIIFImageRequest, error) {
+	dotIdx := strings.LastIndex(qualityFormat, ".")
+	if dotIdx < 0 {
+		return IIIFImageRequest{}, fmt.Errorf("Missing format in '%s'", qualityFormat)
+	}
+	req := IIIFImageRequest{
+		region, size, rotation, qualityFormat[:dotIdx], qualityFormat[dotIdx+1:], version}
+	switch req.Quality {
+	case "default", "color", "gray", "bitonal":
+	default:
+		return req, fmt.Errorf("Invalid quality '%s'", req.Quality)
+	}
+	if _, ok := IIIFFormats[req.Format]; !ok {
+		return req, fmt.Errorf("Unsupported format '%s'", req.Format)
+	}
+	return req, nil
+}
+
+// ContentType of the requested image
+func (r IIIFImageRequest) ContentType() string {
+	return IIIFFormats[r.Format]
+}
+
+// Apply the region, size, rotation and quality of the request to an image
+func (r IIIFImageRequest) Apply(img image.Image) (image.Image, error) {
+	region, err := r.region(img.Bounds())
+	if err != nil {
+		return nil, err
+	}
+	width, height, err := r.size(region.Dx(), region.Dy())
+	if err != nil {
+		return nil, err
+	}
+	out := newCanvas(img, width, height)
+	draw.BiLinear.Scale(out, out.Bounds(), img, region, draw.Src, nil)
+	if out, err = r.rotate(out); err != nil {
+		return nil, err
+	}
+	switch r.Quality {
+	case "gray":
+		return toGray(out), nil
+	case "bitonal":
+		gray := toGray(out)
+		binarize(gray, otsuThresholds(gray))
+		return gray, nil
+	}
+	return out, nil
+}
+
+// Encode an image in the requested format
+func (r IIIFImageRequest) Encode(w io.Writer, img image.Image) error {
+	if r.Format == "jpg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	}
+	return png.Encode(w, img)
+}
+
+// region returns the requested region, clipped to the image bounds
+func (r IIIFImageRequest) region(bounds image.Rectangle) (image.Rectangle, error) {
+	width, height := bounds.Dx(), bounds.Dy()
+	var region image.Rectangle
+	switch {
+	case r.Region == "full":
+		return bounds, nil
+	case r.Region == "square":
+		side := minInt(width, height)
+		x, y := (width-side)/2, (height-side)/2
+		region = image.Rect(x, y, x+side, y+side)
+	case strings.HasPrefix(r.Region, "pct:"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(r.Region, "pct:"), 4)
+		if err != nil {
+			return region, fmt.Errorf("Invalid region '%s'", r.Region)
+		}
+		region = image.Rect(
+			int(values[0]*float64(width)/100), int(values[1]*float64(height)/100),
+			int(math.Round((values[0]+values[2])*float64(width)/100)),
+			int(math.Round((values[1]+values[3])*float64(height)/100)))
+	default:
+		values, err := parseIIIFNumbers(r.Region, 4)
+		if err != nil {
+			return region, fmt.Errorf("Invalid region '%s'", r.Region)
+		}
+		x, y, w, h := int(values[0]), int(values[1]), int(values[2]), int(values[3])
+		region = image.Rect(x, y, x+w, y+h)
+	}
+	region = region.Add(bounds.Min).Intersect(bounds)
+	if region.Empty() {
+		return region, fmt.Errorf("Region '%s' is outside of the image", r.Region)
+	}
+	return region, nil
+}
+
+// size returns the dimensions the region is scaled to
+func (r IIIFImageRequest) size(width int, height int) (int, int, error) {
+	size := strings.TrimPrefix(r.Size, "^")
+	canUpscale := r.Version == 2 || size != r.Size
+	invalid := fmt.Errorf("Invalid size '%s'", r.Size)
+	var w, h int
+	switch {
+	case size == "full" || size == "max":
+		w, h = width, height
+	case strings.HasPrefix(size, "pct:"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(size, "pct:"), 1)
+		if err != nil {
+			return 0, 0, invalid
+		}
+		w = int(math.Round(float64(width) * values[0] / 100))
+		h = int(math.Round(float64(height) * values[0] / 100))
+	case strings.HasPrefix(size, "!"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(size, "!"), 2)
+		if err != nil {
+			return 0, 0, invalid
+		}
+		scale := math.Min(values[0]/float64(width), values[1]/float64(height))
+		if !canUpscale {
+			// Fits into the region as well as into the given box
+			scale = math.Min(scale, 1)
+		}
+		w = int(math.Round(float64(width) * scale))
+		h = int(math.Round(float64(height) * scale))
+	default:
+		parts := strings.Split(size, ",")
+		if len(parts) != 2 || (parts[0] == "" && parts[1] == "") {
+			return 0, 0, invalid
+		}
+		if parts[0] != "" {
+			value, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return 0, 0, invalid
+			}
+			w = value
+		}
+		if parts[1] != "" {
+			value, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return 0, 0, invalid
+			}
+			h = value
+		}
+		// Keep the aspect ratio if only one dimension is given
+		if parts[0] == "" {
+			w = int(math.Round(float64(width) * float64(h) / float64(height)))
+		} else if parts[1] == "" {
+			h = int(math.Round(float64(height) * float64(w) / float64(width)))
+		}
+	}
+	if w <= 0 || h <= 0 || w > maxIIIFDimension || h > maxIIIFDimension {
+		return 0, 0, fmt.Errorf("Size '%s' is out of range", r.Size)
+	}
+	if !canUpscale && (w > width || h > height) {
+		return 0, 0, fmt.Errorf("Size '%s' is larger than the region, upscaling needs '^'", r.Size)
+	}
+	return w, h, nil
+}
+
+// rotate mirrors and rotates the image, only multiples of 90 degrees are
+// supported
+func (r IIIFImageRequest) rotate(img draw.Image) (draw.Image, error) {
+	mirror := strings.HasPrefix(r.Rotation, "!")
+	degrees, err := strconv.ParseFloat(strings.TrimPrefix(r.Rotation, "!"), 64)
+	if err != nil || degrees < 0 || degrees > 360 {
+		return nil, fmt.Errorf("Invalid rotation '%s'", r.Rotation)
+	}
+	if math.Mod(degrees, 90) != 0 {
+		return nil, ErrIIIFNotImplemented
+	}
+	turns := int(degrees/90) % 4
+	if !mirror && turns == 0 {
+		return img, nil
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if turns%2 == 1 {
+		outWidth, outHeight = height, width
+	}
+	out := newCanvas(img, outWidth, outHeight)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			srcX := x
+			if mirror {
+				srcX = width - 1 - x
+			}
+			var dstX, dstY int
+			switch turns {
+			case 0:
+				dstX, dstY = x, y
+			case 1:
+				dstX, dstY = height-1-y, x
+			case 2:
+				dstX, dstY = width-1-x, height-1-y
+			case 3:
+				dstX, dstY = y, width-1-x
+			}
+			out.Set(dstX, dstY, img.At(bounds.Min.X+srcX, bounds.Min.Y+y))
+		}
+	}
+	return out, nil
+}
+
+// parseIIIFNumbers parses a comma-separated list of non-negative numbers
+func parseIIIFNumbers(value string, count int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != count {
+		return nil, fmt.Errorf("Expected %d numbers in '%s'", count, value)
+	}
+	numbers := make([]float64, count)
+	for idx, part := range parts {
+		number, err := strconv.ParseFloat(part, 64)
+		if err != nil || number < 0 {
+			return nil, fmt.Errorf("Invalid number '%s'", part)
+		}
+		numbers[idx] = number
+	}
+	return numbers, nil
+}
@@ -0,0 +1,279 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	simplejson "github.com/bitly/go-simplejson"
+	"github.com/rs/zerolog/log"
+)
+
+// Collections are only followed this deep into nested collections
+const maxCollectionDepth = 3
+
+// Matches years in the dates of manifests
+var manifestYearPat = regexp.MustCompile(`\b(1[5-9]\d\d)\b`)
+
+// Labels of the manifest metadata that hold the date of publication
+var manifestDateLabels = []string{
+	"date", "datum", "year", "jahr", "erscheinungsjahr", "publication date",
+	"erscheinungsdatum", "date of publication"}
+
+// IIIFSourceConfig configures a repository that publishes IIIF manifests
+// whose canvases link their ALTO or hOCR via `seeAlso`
+type IIIFSourceConfig struct {
+	// Name of the source, identifiers of its volumes are <name>-<hash>
+	Name string `json:"name"`
+	// IIIF collections whose manifests are used as volumes
+	Collections []string `json:"collections"`
+	// Manifests of further volumes
+	Manifests []string `json:"manifests"`
+}
+
+// iiifSource ingests volumes from a IIIF repository and crops their lines
+// via the repository's Image API
+type iiifSource struct {
+	config IIIFSourceConfig
+}
+
+func (s *iiifSource) Name() string {
+	return s.config.Name
+}
+
+// identifier derives the identifier of a volume from its manifest URL
+func (s *iiifSource) identifier(manifestURL string) string {
+	return fmt.Sprintf("%s-%s", s.config.Name, Sha1Digest([]byte(manifestURL)))
+}
+
+// collectionManifests returns the URLs of all manifests in a collection and
+// its nested collections
+func collectionManifests(collectionURL string, depth int) ([]string, error) {
+	resp, err := http.Get(collectionURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 200 {
+		return nil, fmt.Errorf("Status %d while getting %s", resp.StatusCode, collectionURL)
+	}
+	json, err := simplejson.NewFromReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	manifests := json.Get("manifests")
+	for i := range manifests.MustArray() {
+		urls = append(urls, manifests.GetIndex(i).Get("@id").MustString())
+	}
+	collections := json.Get("collections")
+	for i := range collections.MustArray() {
+		if depth >= maxCollectionDepth {
+			break
+		}
+		nested, err := collectionManifests(
+			collections.GetIndex(i).Get("@id").MustString(), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, nested...)
+	}
+	return urls, nil
+}
+
+// manifestYear takes the year of publication from the navDate or the
+// metadata of a manifest, -1 if there is none
+func manifestYear(manifest *Manifest) int {
+	candidates := []string{manifest.NavDate}
+	for label, value := range manifest.Metadata {
+		for _, dateLabel := range manifestDateLabels {
+			if strings.ToLower(strings.TrimSpace(label)) == dateLabel {
+				candidates = append(candidates, value)
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		if match := manifestYearPat.FindStringSubmatch(candidate); match != nil {
+			year, _ := strconv.Atoi(match[1])
+			return year
+		}
+	}
+	return -1
+}
+
+func (s *iiifSource) Volumes(showProgress bool) ([]IdentifierCacheEntry, error) {
+	manifestURLs := append([]string{}, s.config.Manifests...)
+	for _, collectionURL := range s.config.Collections {
+		urls, err := collectionManifests(collectionURL, 0)
+		if err != nil {
+			return nil, err
+		}
+		manifestURLs = append(manifestURLs, urls...)
+	}
+	entries := make([]IdentifierCacheEntry, 0, len(manifestURLs))
+	for _, manifestURL := range manifestURLs {
+		manifest, err := FetchManifest(manifestURL)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("source", s.config.Name).
+				Str("manifest", manifestURL).
+				Msg("Could not fetch manifest, skipping volume")
+			continue
+		}
+		entries = append(entries, IdentifierCacheEntry{
+			Identifier: s.identifier(manifestURL),
+			NumPages:   len(manifest.Canvases),
+			Year:       manifestYear(manifest),
+			Source:     s.config.Name,
+			Manifest:   manifestURL,
+		})
+	}
+	log.Info().
+		Str("source", s.config.Name).
+		Int("numVolumes", len(entries)).
+		Msg("Listed volumes")
+	return entries, nil
+}
+
+func (s *iiifSource) Metadata(volume IdentifierCacheEntry) (*Document, error) {
+	manifest, err := FetchManifest(volume.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &Document{
+		Identifier: volume.Identifier,
+		Title:      manifest.Label,
+		Year:       volume.Year,
+		Manifest:   volume.Manifest,
+		Source:     s.config.Name,
+	}, nil
+}
+
+// IsSuitable accepts all volumes, since they were picked for the corpus
+func (s *iiifSource) IsSuitable(volume IdentifierCacheEntry) (bool, error) {
+	return true, nil
+}
+
+// layoutLink returns the link to the ALTO or hOCR of a canvas and its
+// format
+func layoutLink(canvas ManifestCanvas) (string, string) {
+	for _, link := range canvas.SeeAlso {
+		description := strings.ToLower(link.Format + " " + link.Profile + " " + link.ID)
+		if strings.Contains(description, "alto") {
+			return link.ID, LayoutALTO
+		} else if strings.Contains(description, "hocr") {
+			return link.ID, LayoutHOCR
+		}
+	}
+	return "", ""
+}
+
+// fetchLayout downloads and parses the layout of a page
+func fetchLayout(layoutURL string, format string) (*layoutPage, error) {
+	resp, err := http.Get(layoutURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 200 {
+		return nil, fmt.Errorf("Status %d while getting %s", resp.StatusCode, layoutURL)
+	}
+	return parseLayout(format, resp.Body)
+}
+
+func (s *iiifSource) fetchLinesWorker(volume IdentifierCacheEntry, config *CorpusConfig, out lineChannels) {
+	defer out.close()
+	logger := log.With().Str("source", s.config.Name).Str("identifier", volume.Identifier).Logger()
+	manifest, err := FetchManifest(volume.Manifest)
+	if err != nil {
+		out.sendProgress(ProgressMessage{Error: err, Step: "fetch"})
+		return
+	}
+	pageLabels, pageRanges := manifest.PageLabels()
+	pages := make([]PageInfo, 0, len(manifest.Canvases))
+	pageLines := make([][]OCRLine, 0, len(manifest.Canvases))
+	numLines := 0
+	for idx, canvas := range manifest.Canvases {
+		page := PageInfo{
+			Index:  idx,
+			Width:  canvas.Width,
+			Height: canvas.Height,
+			Label:  pageLabels[idx],
+			Ranges: pageRanges[idx],
+		}
+		var lines []OCRLine
+		layoutURL, format := layoutLink(canvas)
+		if layoutURL != "" && canvas.ImageService != "" {
+			layout, err := fetchLayout(layoutURL, format)
+			if err != nil {
+				// The page is treated as blank
+				logger.Warn().Err(err).Str("canvas", canvas.ID).Msg("Could not read page layout")
+			} else {
+				service := strings.TrimSuffix(canvas.ImageService, "/")
+				lines = layout.ocrLines(&page, config.Crop.Padding, func(box LineBox) string {
+					return iiifRegionURL(service, box)
+				})
+			}
+		}
+		for lineIdx := range lines {
+			lines[lineIdx].PageNumber = idx + 1
+			lines[lineIdx].PageLabel = canvas.Label
+			lines[lineIdx].CanvasID = canvas.ID
+		}
+		numLines += len(lines)
+		pages = append(pages, page)
+		pageLines = append(pageLines, lines)
+		isReceived := out.sendProgress(ProgressMessage{
+			Step:       "fetch",
+			Progress:   float64(idx+1) / float64(len(manifest.Canvases)),
+			PageNumber: idx + 1,
+			LineNumber: numLines,
+		})
+		if !isReceived {
+			return
+		}
+	}
+	selectLines(volume.Identifier, config, pages, pageLines, out)
+}
+
+func (s *iiifSource) FetchLines(volume IdentifierCacheEntry, config *CorpusConfig, done <-chan struct{}) (chan ProgressMessage, chan []OCRLine) {
+	out := newLineChannels(done)
+	go s.fetchLinesWorker(volume, config, out)
+	return out.progress, out.lines
+}
+
+// iiifRegionURL builds the URL for a region of the image with the given
+// IIIF Image API service
+func iiifRegionURL(service string, box LineBox) string {
+	return fmt.Sprintf("%s/%d,%d,%d,%d/full/0/default.png",
+		service, box.X, box.Y, box.Width, box.Height)
+}
+
+// iiifServiceURL takes the Image API service from the URL of an image
+// region, i.e. strips the region, size, rotation and quality
+func iiifServiceURL(imageURL string) string {
+	parts := strings.Split(imageURL, "/")
+	if len(parts) < 5 {
+		return imageURL
+	}
+	return strings.Join(parts[:len(parts)-4], "/")
+}
+
+func (s *iiifSource) CropURL(ident string, line OCRLine, box LineBox) string {
+	return iiifRegionURL(iiifServiceURL(line.ImageURL), box)
+}
+
+func (s *iiifSource) PageURL(ident string, line OCRLine) string {
+	return iiifServiceURL(line.ImageURL) + "/full/full/0/default.jpg"
+}
+
+func (s *iiifSource) DetailsURL(doc *Document) string {
+	return ""
+}
+
+func (s *iiifSource) ViewerURL(doc *Document) string {
+	return ""
+}
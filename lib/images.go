@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Matches the identifiers of line images, <ident>_<lineId>
+var lineImageIDPat = regexp.MustCompile(`^[\w.-]+_[a-z0-9]{8}$`)
+
+// LineImagesPath is the path of the API endpoint that serves line images
+const LineImagesPath = "/api/images/lines/"
+
+// ValidLineImageID checks if the identifier of a line image is well-formed
+func ValidLineImageID(id string) bool {
+	return lineImageIDPat.MatchString(id)
+}
+
+// localImageURL returns the URL of the API endpoint for the line image at
+// the given IIIF URL and registers it with the line cache, so it can be
+// fetched on demand
+func localImageURL(ident string, imageURL string) string {
+	if imageURL == "" {
+		return ""
+	}
+	id := fmt.Sprintf("%s_%s", ident, Sha1Digest([]byte(imageURL)))
+	LineCache.Register(id, imageURL)
+	return LineImagesPath + id
+}
+
+// SetLocalURLs points the local image URLs of the line to the API endpoint
+// for line images
+func (l *OCRLine) SetLocalURLs(ident string) {
+	// Lines in the corpus keep their identifier when their box was corrected
+	id := fmt.Sprintf("%s_%s", ident, l.Identifier)
+	LineCache.RegisterLine(id, *l)
+	l.LocalImageURL = LineImagesPath + id
+	l.PreviousLocalURL = localImageURL(ident, l.PreviousImageURL)
+	l.NextLocalURL = localImageURL(ident, l.NextImageURL)
+}
+
+// LineImagePath returns the path of a line image in the corpus, or of its
+// processed variant with the given name, or an empty string if it is not
+// part of the corpus
+func (s *DocumentStore) LineImagePath(id string, variant string) string {
+	if !ValidLineImageID(id) || (variant != "" && !levelNamePat.MatchString(variant)) {
+		return ""
+	}
+	fname := id + ".png"
+	if variant != "" {
+		fname = variantPath(id, variant)
+	}
+	paths, _ := filepath.Glob(filepath.Join(s.basePath, "transcriptions", "*", fname))
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
@@ -0,0 +1,487 @@
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Formats of the page layouts that can be read from other sources
+const (
+	LayoutALTO = "alto"
+	LayoutHOCR = "hocr"
+	LayoutPAGE = "page"
+)
+
+var hocrBoxPat = regexp.MustCompile(`bbox (-?\d+) (-?\d+) (-?\d+) (-?\d+)`)
+var hocrConfidencePat = regexp.MustCompile(`x_wconf (\d+(?:\.\d+)?)`)
+
+// layoutBlock is a region of a page, with the same block types as in the
+// ABBYY OCR
+type layoutBlock struct {
+	Type string
+	Box  LineBox
+}
+
+// layoutLine is a line of text from a page layout
+type layoutLine struct {
+	Box       LineBox
+	BlockType string
+	Words     []string
+	// Mean word confidence (0-1), -1 if unknown
+	Confidence float64
+	WordBoxes  []LineBox
+}
+
+// layoutPage is the layout of a single page, in the coordinates of the page
+// image the layout was created from
+type layoutPage struct {
+	Width  int
+	Height int
+	Blocks []layoutBlock
+	Lines  []layoutLine
+}
+
+// parseLayout parses a page layout in the given format
+func parseLayout(format string, r io.Reader) (*layoutPage, error) {
+	switch format {
+	case LayoutALTO:
+		return parseALTO(r)
+	case LayoutHOCR:
+		return parseHOCR(r)
+	case LayoutPAGE:
+		return parsePAGE(r)
+	default:
+		return nil, fmt.Errorf("Unknown layout format '%s'", format)
+	}
+}
+
+// finish computes the mean confidence of a line from its words
+func (l *layoutLine) finish(confidenceSum float64, numConfident int) {
+	l.Confidence = -1
+	if numConfident > 0 {
+		l.Confidence = confidenceSum / float64(numConfident)
+	}
+}
+
+// xmlAttr returns the value of an attribute regardless of its namespace
+func xmlAttr(elem xml.StartElement, name string) string {
+	for _, attr := range elem.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// xmlNumber returns the rounded value of a numeric attribute, ALTO allows
+// fractional coordinates
+func xmlNumber(elem xml.StartElement, name string) int {
+	value, _ := strconv.ParseFloat(xmlAttr(elem, name), 64)
+	return int(math.Round(value))
+}
+
+func altoBox(elem xml.StartElement) LineBox {
+	return LineBox{
+		X: xmlNumber(elem, "HPOS"), Y: xmlNumber(elem, "VPOS"),
+		Width: xmlNumber(elem, "WIDTH"), Height: xmlNumber(elem, "HEIGHT")}
+}
+
+// parseALTO reads the first page of an ALTO file
+func parseALTO(r io.Reader) (*layoutPage, error) {
+	dec := xml.NewDecoder(r)
+	page := layoutPage{}
+	var line *layoutLine
+	blockType := "Text"
+	confidenceSum, numConfident := 0., 0
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not parse ALTO: %s", err)
+		}
+		switch elem := token.(type) {
+		case xml.StartElement:
+			switch elem.Name.Local {
+			case "Page":
+				page.Width, page.Height = xmlNumber(elem, "WIDTH"), xmlNumber(elem, "HEIGHT")
+			case "TextBlock":
+				blockType = "Text"
+				page.Blocks = append(page.Blocks, layoutBlock{blockType, altoBox(elem)})
+			case "Illustration", "GraphicalElement":
+				page.Blocks = append(page.Blocks, layoutBlock{"Picture", altoBox(elem)})
+			case "ComposedBlock":
+				if strings.EqualFold(xmlAttr(elem, "TYPE"), "table") {
+					page.Blocks = append(page.Blocks, layoutBlock{"Table", altoBox(elem)})
+				}
+			case "TextLine":
+				line = &layoutLine{Box: altoBox(elem), BlockType: blockType}
+				confidenceSum, numConfident = 0, 0
+			case "String":
+				if line == nil {
+					continue
+				}
+				line.Words = append(line.Words, xmlAttr(elem, "CONTENT"))
+				line.WordBoxes = append(line.WordBoxes, altoBox(elem))
+				if wc, err := strconv.ParseFloat(xmlAttr(elem, "WC"), 64); err == nil {
+					confidenceSum += wc
+					numConfident++
+				}
+			case "HYP":
+				if line != nil && len(line.Words) > 0 {
+					line.Words[len(line.Words)-1] += xmlAttr(elem, "CONTENT")
+				}
+			}
+		case xml.EndElement:
+			if elem.Name.Local == "TextLine" && line != nil {
+				line.finish(confidenceSum, numConfident)
+				page.Lines = append(page.Lines, *line)
+				line = nil
+			} else if elem.Name.Local == "Page" {
+				return &page, nil
+			}
+		}
+	}
+	return &page, nil
+}
+
+// hocrBox parses the bounding box from the title of a hOCR element
+func hocrBox(title string) (LineBox, bool) {
+	match := hocrBoxPat.FindStringSubmatch(title)
+	if match == nil {
+		return LineBox{}, false
+	}
+	x0, _ := strconv.Atoi(match[1])
+	y0, _ := strconv.Atoi(match[2])
+	x1, _ := strconv.Atoi(match[3])
+	y1, _ := strconv.Atoi(match[4])
+	return LineBox{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}, true
+}
+
+// hasClass checks if an element has one of the given classes
+func hasClass(elem xml.StartElement, classes ...string) bool {
+	for _, class := range strings.Fields(xmlAttr(elem, "class")) {
+		for _, wanted := range classes {
+			if class == wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseHOCR reads the first page of a hOCR file
+func parseHOCR(r io.Reader) (*layoutPage, error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	page := layoutPage{}
+	// What every open element is, to know which part of the page ends
+	var open []string
+	var line *layoutLine
+	var word *strings.Builder
+	blockType := "Text"
+	confidenceSum, numConfident := 0., 0
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not parse hOCR: %s", err)
+		}
+		switch elem := token.(type) {
+		case xml.StartElement:
+			title := xmlAttr(elem, "title")
+			box, hasBox := hocrBox(title)
+			role := ""
+			switch {
+			case hasClass(elem, "ocr_page"):
+				if page.Width > 0 {
+					// Only the first page is read
+					return &page, nil
+				}
+				page.Width, page.Height = box.Width, box.Height
+			case hasClass(elem, "ocr_carea", "ocrx_block"):
+				blockType = "Text"
+				if hasBox {
+					page.Blocks = append(page.Blocks, layoutBlock{blockType, box})
+				}
+			case hasClass(elem, "ocr_photo", "ocr_image", "ocr_linedrawing"):
+				if hasBox {
+					page.Blocks = append(page.Blocks, layoutBlock{"Picture", box})
+				}
+			case hasClass(elem, "ocr_table"):
+				if hasBox {
+					page.Blocks = append(page.Blocks, layoutBlock{"Table", box})
+				}
+			case hasClass(elem, "ocr_line", "ocrx_line", "ocr_textfloat", "ocr_header", "ocr_caption"):
+				if hasBox && line == nil {
+					role = "line"
+					line = &layoutLine{Box: box, BlockType: blockType}
+					confidenceSum, numConfident = 0, 0
+				}
+			case hasClass(elem, "ocrx_word"):
+				if line != nil && word == nil {
+					role = "word"
+					word = &strings.Builder{}
+					line.WordBoxes = append(line.WordBoxes, box)
+					if match := hocrConfidencePat.FindStringSubmatch(title); match != nil {
+						conf, _ := strconv.ParseFloat(match[1], 64)
+						confidenceSum += conf / 100
+						numConfident++
+					}
+				}
+			}
+			open = append(open, role)
+		case xml.CharData:
+			if word != nil {
+				word.Write(elem)
+			}
+		case xml.EndElement:
+			if len(open) == 0 {
+				continue
+			}
+			role := open[len(open)-1]
+			open = open[:len(open)-1]
+			switch role {
+			case "word":
+				line.Words = append(line.Words, strings.TrimSpace(word.String()))
+				word = nil
+			case "line":
+				line.finish(confidenceSum, numConfident)
+				page.Lines = append(page.Lines, *line)
+				line = nil
+			}
+		}
+	}
+	return &page, nil
+}
+
+// pageBox computes the bounding box of the points of a PAGE polygon,
+// `x1,y1 x2,y2 ...`
+func pageBox(points string) (LineBox, bool) {
+	x0, y0, x1, y1 := math.MaxInt32, math.MaxInt32, math.MinInt32, math.MinInt32
+	for _, point := range strings.Fields(points) {
+		coords := strings.Split(point, ",")
+		if len(coords) != 2 {
+			return LineBox{}, false
+		}
+		x, errX := strconv.Atoi(coords[0])
+		y, errY := strconv.Atoi(coords[1])
+		if errX != nil || errY != nil {
+			return LineBox{}, false
+		}
+		x0, y0 = minInt(x0, x), minInt(y0, y)
+		x1, y1 = maxInt(x1, x), maxInt(y1, y)
+	}
+	if x0 > x1 {
+		return LineBox{}, false
+	}
+	return LineBox{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}, true
+}
+
+// parsePAGE reads a PAGE XML file. The text of a line is taken from its own
+// TextEquiv, or joined from its words if it has none.
+func parsePAGE(r io.Reader) (*layoutPage, error) {
+	dec := xml.NewDecoder(r)
+	page := layoutPage{}
+	// Local names of all open elements, the parents of Coords and TextEquiv
+	// tell what they belong to
+	var open []string
+	var line *layoutLine
+	var lineText *string
+	var word *strings.Builder
+	var points []string
+	var text *strings.Builder
+	// Only the first TextEquiv of an element is used
+	hasText := false
+	lineConfidence, confidenceSum, numConfident := -1., 0., 0
+	parent := func() string {
+		if len(open) < 2 {
+			return ""
+		}
+		return open[len(open)-2]
+	}
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not parse PAGE: %s", err)
+		}
+		switch elem := token.(type) {
+		case xml.StartElement:
+			open = append(open, elem.Name.Local)
+			switch elem.Name.Local {
+			case "Page":
+				page.Width, page.Height = xmlNumber(elem, "imageWidth"), xmlNumber(elem, "imageHeight")
+			case "TextLine":
+				line = &layoutLine{BlockType: "Text"}
+				lineText = nil
+				lineConfidence, confidenceSum, numConfident = -1, 0, 0
+			case "Word":
+				if line != nil {
+					word = &strings.Builder{}
+					hasText = false
+				}
+			case "Coords":
+				// PAGE 2009 lists the points as children
+				points = []string{}
+				if value := xmlAttr(elem, "points"); value != "" {
+					points = append(points, value)
+				}
+			case "Point":
+				if points != nil {
+					points = append(points, xmlAttr(elem, "x")+","+xmlAttr(elem, "y"))
+				}
+			case "TextEquiv":
+				owner := parent()
+				if (owner == "TextLine" && line != nil && lineText == nil) ||
+					(owner == "Word" && word != nil && !hasText) {
+					text = &strings.Builder{}
+					if conf, err := strconv.ParseFloat(xmlAttr(elem, "conf"), 64); err == nil {
+						if owner == "TextLine" {
+							lineConfidence = conf
+						} else {
+							confidenceSum += conf
+							numConfident++
+						}
+					}
+				}
+			}
+		case xml.CharData:
+			if text != nil && len(open) > 0 && open[len(open)-1] == "Unicode" {
+				text.Write(elem)
+			}
+		case xml.EndElement:
+			switch elem.Name.Local {
+			case "Coords":
+				box, ok := pageBox(strings.Join(points, " "))
+				points = nil
+				if !ok {
+					break
+				}
+				switch parent() {
+				case "TextRegion":
+					page.Blocks = append(page.Blocks, layoutBlock{"Text", box})
+				case "ImageRegion", "GraphicRegion", "ChartRegion":
+					page.Blocks = append(page.Blocks, layoutBlock{"Picture", box})
+				case "TableRegion":
+					page.Blocks = append(page.Blocks, layoutBlock{"Table", box})
+				case "TextLine":
+					if line != nil {
+						line.Box = box
+					}
+				case "Word":
+					if line != nil {
+						line.WordBoxes = append(line.WordBoxes, box)
+					}
+				}
+			case "TextEquiv":
+				if text == nil {
+					break
+				}
+				value := strings.TrimSpace(text.String())
+				text = nil
+				if parent() == "TextLine" {
+					lineText = &value
+				} else {
+					word.WriteString(value)
+					hasText = true
+				}
+			case "Word":
+				if line != nil && word != nil {
+					line.Words = append(line.Words, word.String())
+					word = nil
+				}
+			case "TextLine":
+				if line == nil {
+					break
+				}
+				if lineText != nil {
+					line.Words = []string{*lineText}
+				}
+				line.finish(confidenceSum, numConfident)
+				if lineConfidence >= 0 {
+					line.Confidence = lineConfidence
+				}
+				page.Lines = append(page.Lines, *line)
+				line = nil
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	return &page, nil
+}
+
+// ocrLines converts the layout of a page into OCR lines and records its
+// layout statistics. The layout coordinates are scaled to the dimensions of
+// the page, if they are known. cropURL returns the image URL for a box.
+func (p *layoutPage) ocrLines(page *PageInfo, padding Padding, cropURL func(box LineBox) string) []OCRLine {
+	scaleX, scaleY := 1., 1.
+	if page.Width > 0 && page.Height > 0 && p.Width > 0 && p.Height > 0 {
+		scaleX = float64(page.Width) / float64(p.Width)
+		scaleY = float64(page.Height) / float64(p.Height)
+	} else if page.Width <= 0 || page.Height <= 0 {
+		page.Width, page.Height = p.Width, p.Height
+	}
+	scale := func(box LineBox) LineBox {
+		x0 := int(math.Round(float64(box.X) * scaleX))
+		y0 := int(math.Round(float64(box.Y) * scaleY))
+		x1 := int(math.Round(float64(box.X+box.Width) * scaleX))
+		y1 := int(math.Round(float64(box.Y+box.Height) * scaleY))
+		return LineBox{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+	}
+	for _, block := range p.Blocks {
+		box := scale(block.Box)
+		area := box.Width * box.Height
+		switch block.Type {
+		case "Text":
+			page.TextArea += area
+		case "Picture":
+			page.PictureArea += area
+		case "Table":
+			page.TableArea += area
+		}
+	}
+	lines := make([]OCRLine, 0, len(p.Lines))
+	for _, layoutLine := range p.Lines {
+		page.NumLines++
+		box := scale(layoutLine.Box).Pad(padding, page.Width, page.Height)
+		if !box.Valid() {
+			continue
+		}
+		text := strings.TrimSpace(strings.Join(layoutLine.Words, " "))
+		for _, c := range text {
+			if unicode.IsSpace(c) {
+				continue
+			}
+			page.NumChars++
+			if unicode.IsDigit(c) {
+				page.NumDigits++
+			}
+		}
+		wordBoxes := make([]LineBox, len(layoutLine.WordBoxes))
+		for idx, wordBox := range layoutLine.WordBoxes {
+			wordBoxes[idx] = scale(wordBox)
+		}
+		url := cropURL(box)
+		lines = append(lines, OCRLine{
+			Identifier: Sha1Digest([]byte(url)),
+			ImageURL:   url,
+			Box:        box,
+			BlockType:  layoutLine.BlockType,
+			OCRText:    text,
+			Confidence: layoutLine.Confidence,
+			Skew:       estimateSkew(wordBoxes, box.Height),
+		})
+	}
+	return lines
+}
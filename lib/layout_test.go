@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const altoFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<alto xmlns="http://www.loc.gov/standards/alto/ns-v4#">
+  <Layout>
+    <Page WIDTH="1000" HEIGHT="1500">
+      <PrintSpace>
+        <TextBlock HPOS="100" VPOS="200" WIDTH="800" HEIGHT="100">
+          <TextLine HPOS="100" VPOS="200" WIDTH="800" HEIGHT="40">
+            <String HPOS="100" VPOS="200" WIDTH="300" HEIGHT="40" CONTENT="Die" WC="0.5"/>
+            <SP/>
+            <String HPOS="450.4" VPOS="199.6" WIDTH="300" HEIGHT="40" CONTENT="Wör" WC="1"/>
+            <HYP CONTENT="-"/>
+          </TextLine>
+        </TextBlock>
+        <Illustration HPOS="100" VPOS="400" WIDTH="500" HEIGHT="500"/>
+        <ComposedBlock TYPE="table" HPOS="100" VPOS="1000" WIDTH="800" HEIGHT="300"/>
+      </PrintSpace>
+    </Page>
+    <Page WIDTH="2000" HEIGHT="3000">
+      <PrintSpace>
+        <TextBlock HPOS="0" VPOS="0" WIDTH="10" HEIGHT="10">
+          <TextLine HPOS="0" VPOS="0" WIDTH="10" HEIGHT="10">
+            <String HPOS="0" VPOS="0" WIDTH="10" HEIGHT="10" CONTENT="Zweite"/>
+          </TextLine>
+        </TextBlock>
+      </PrintSpace>
+    </Page>
+  </Layout>
+</alto>`
+
+const hocrFixture = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>hOCR</title></head>
+<body>
+  <div class="ocr_page" title="image page.png; bbox 0 0 1000 1500">
+    <div class="ocr_carea" title="bbox 100 200 900 300">
+      <p class="ocr_par">
+        <span class="ocr_line" title="bbox 100 200 900 240; baseline 0 -5">
+          <span class="ocrx_word" title="bbox 100 200 400 240; x_wconf 50">Die</span>
+          <span class="ocrx_word" title="bbox 450 200 750 240; x_wconf 100">Wörter&amp;</span>
+        </span><br>
+        <span class="ocr_line" title="bbox 100 250 300 290">
+          <span class="ocrx_word" title="bbox 100 250 300 290">ohne</span>
+        </span>
+      </p>
+    </div>
+    <div class="ocr_photo" title="bbox 100 400 600 900"></div>
+  </div>
+  <div class="ocr_page" title="bbox 0 0 2000 3000">
+    <span class="ocr_line" title="bbox 0 0 10 10"><span class="ocrx_word" title="bbox 0 0 10 10">Zweite</span></span>
+  </div>
+</body>
+</html>`
+
+const pageFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<PcGts xmlns="http://schema.primaresearch.org/PAGE/gts/pagecontent/2019-07-15">
+  <Page imageFilename="page.png" imageWidth="1000" imageHeight="1500">
+    <TextRegion id="r1">
+      <Coords points="100,200 900,200 900,300 100,300"/>
+      <TextLine id="l1">
+        <Coords points="100,200 900,200 900,240 100,240"/>
+        <Word id="w1">
+          <Coords points="100,200 400,200 400,240 100,240"/>
+          <TextEquiv conf="0.5"><Unicode>Die</Unicode></TextEquiv>
+        </Word>
+        <Word id="w2">
+          <Coords points="450,200 750,200 750,240 450,240"/>
+          <TextEquiv conf="1"><Unicode>Wörter</Unicode></TextEquiv>
+        </Word>
+        <TextEquiv conf="0.75"><Unicode>Die Wörter</Unicode></TextEquiv>
+      </TextLine>
+    </TextRegion>
+    <ImageRegion id="r2">
+      <Coords points="100,400 600,400 600,900 100,900"/>
+    </ImageRegion>
+  </Page>
+</PcGts>`
+
+const page2009Fixture = `<?xml version="1.0" encoding="UTF-8"?>
+<PcGts xmlns="http://schema.primaresearch.org/PAGE/gts/pagecontent/2009-03-16">
+  <Page imageFilename="page.png" imageWidth="1000" imageHeight="1500">
+    <TextRegion id="r1">
+      <Coords><Point x="100" y="200"/><Point x="900" y="300"/></Coords>
+      <TextLine id="l1">
+        <Coords><Point x="100" y="200"/><Point x="900" y="240"/></Coords>
+        <Word id="w1">
+          <Coords><Point x="100" y="200"/><Point x="400" y="240"/></Coords>
+          <TextEquiv><Unicode>Die</Unicode></TextEquiv>
+          <TextEquiv><Unicode>Dic</Unicode></TextEquiv>
+        </Word>
+        <Word id="w2">
+          <Coords><Point x="450" y="200"/><Point x="750" y="240"/></Coords>
+          <TextEquiv><Unicode>Wörter</Unicode></TextEquiv>
+        </Word>
+      </TextLine>
+    </TextRegion>
+    <TableRegion id="r2">
+      <Coords><Point x="100" y="1000"/><Point x="900" y="1300"/></Coords>
+    </TableRegion>
+  </Page>
+</PcGts>`
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		input   string
+		want    *layoutPage
+		wantErr bool
+	}{
+		{
+			name:   "alto",
+			format: LayoutALTO,
+			input:  altoFixture,
+			want: &layoutPage{
+				Width: 1000, Height: 1500,
+				Blocks: []layoutBlock{
+					{"Text", LineBox{X: 100, Y: 200, Width: 800, Height: 100}},
+					{"Picture", LineBox{X: 100, Y: 400, Width: 500, Height: 500}},
+					{"Table", LineBox{X: 100, Y: 1000, Width: 800, Height: 300}},
+				},
+				Lines: []layoutLine{{
+					Box:        LineBox{X: 100, Y: 200, Width: 800, Height: 40},
+					BlockType:  "Text",
+					Words:      []string{"Die", "Wör-"},
+					Confidence: 0.75,
+					WordBoxes: []LineBox{
+						{X: 100, Y: 200, Width: 300, Height: 40},
+						{X: 450, Y: 200, Width: 300, Height: 40},
+					},
+				}},
+			},
+		},
+		{
+			name:   "hocr",
+			format: LayoutHOCR,
+			input:  hocrFixture,
+			want: &layoutPage{
+				Width: 1000, Height: 1500,
+				Blocks: []layoutBlock{
+					{"Text", LineBox{X: 100, Y: 200, Width: 800, Height: 100}},
+					{"Picture", LineBox{X: 100, Y: 400, Width: 500, Height: 500}},
+				},
+				Lines: []layoutLine{
+					{
+						Box:        LineBox{X: 100, Y: 200, Width: 800, Height: 40},
+						BlockType:  "Text",
+						Words:      []string{"Die", "Wörter&"},
+						Confidence: 0.75,
+						WordBoxes: []LineBox{
+							{X: 100, Y: 200, Width: 300, Height: 40},
+							{X: 450, Y: 200, Width: 300, Height: 40},
+						},
+					},
+					{
+						Box:        LineBox{X: 100, Y: 250, Width: 200, Height: 40},
+						BlockType:  "Text",
+						Words:      []string{"ohne"},
+						Confidence: -1,
+						WordBoxes:  []LineBox{{X: 100, Y: 250, Width: 200, Height: 40}},
+					},
+				},
+			},
+		},
+		{
+			name:   "page",
+			format: LayoutPAGE,
+			input:  pageFixture,
+			want: &layoutPage{
+				Width: 1000, Height: 1500,
+				Blocks: []layoutBlock{
+					{"Text", LineBox{X: 100, Y: 200, Width: 800, Height: 100}},
+					{"Picture", LineBox{X: 100, Y: 400, Width: 500, Height: 500}},
+				},
+				Lines: []layoutLine{{
+					Box:        LineBox{X: 100, Y: 200, Width: 800, Height: 40},
+					BlockType:  "Text",
+					Words:      []string{"Die Wörter"},
+					Confidence: 0.75,
+					WordBoxes: []LineBox{
+						{X: 100, Y: 200, Width: 300, Height: 40},
+						{X: 450, Y: 200, Width: 300, Height: 40},
+					},
+				}},
+			},
+		},
+		{
+			name:   "page 2009 with words only",
+			format: LayoutPAGE,
+			input:  page2009Fixture,
+			want: &layoutPage{
+				Width: 1000, Height: 1500,
+				Blocks: []layoutBlock{
+					{"Text", LineBox{X: 100, Y: 200, Width: 800, Height: 100}},
+					{"Table", LineBox{X: 100, Y: 1000, Width: 800, Height: 300}},
+				},
+				Lines: []layoutLine{{
+					Box:        LineBox{X: 100, Y: 200, Width: 800, Height: 40},
+					BlockType:  "Text",
+					Words:      []string{"Die", "Wörter"},
+					Confidence: -1,
+					WordBoxes: []LineBox{
+						{X: 100, Y: 200, Width: 300, Height: 40},
+						{X: 450, Y: 200, Width: 300, Height: 40},
+					},
+				}},
+			},
+		},
+		{
+			name:    "malformed alto",
+			format:  LayoutALTO,
+			input:   `<alto><Layout><Page WIDTH="1" HEIGHT="1"></Layout></alto>`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			format:  "abbyy",
+			input:   altoFixture,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLayout(tt.format, strings.NewReader(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseLayout() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLayout() failed: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLayout() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOCRLinesScalesToPage(t *testing.T) {
+	layout, err := parseLayout(LayoutPAGE, strings.NewReader(pageFixture))
+	if err != nil {
+		t.Fatalf("parseLayout() failed: %s", err)
+	}
+	page := PageInfo{Width: 2000, Height: 3000}
+	lines := layout.ocrLines(&page, Padding{}, func(box LineBox) string {
+		return fmt.Sprintf("https://example.org/page.png#xywh=%d,%d,%d,%d", box.X, box.Y, box.Width, box.Height)
+	})
+	if len(lines) != 1 {
+		t.Fatalf("ocrLines() returned %d lines, want 1", len(lines))
+	}
+	wantBox := LineBox{X: 200, Y: 400, Width: 1600, Height: 80}
+	if lines[0].Box != wantBox {
+		t.Errorf("Box = %+v, want %+v", lines[0].Box, wantBox)
+	}
+	if lines[0].OCRText != "Die Wörter" {
+		t.Errorf("OCRText = %q, want %q", lines[0].OCRText, "Die Wörter")
+	}
+	if page.NumLines != 1 || page.NumChars != 9 {
+		t.Errorf("NumLines, NumChars = %d, %d, want 1, 9", page.NumLines, page.NumChars)
+	}
+	if wantArea := 1600 * 200; page.TextArea != wantArea {
+		t.Errorf("TextArea = %d, want %d", page.TextArea, wantArea)
+	}
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// LevelDiplomatic is the transcription as entered by the transcriber, all
+// other levels are derived from it
+const LevelDiplomatic = "diplomatic"
+
+// ErrUnknownLevel is returned when a transcription level is requested that
+// is not configured for the corpus
+var ErrUnknownLevel = errors.New("Unknown transcription level")
+
+var levelNamePat = regexp.MustCompile(`^[a-z]+$`)
+
+// Matches the side files of derived levels, e.g. <ident>_<lineId>.norm.txt
+var levelFilePat = regexp.MustCompile(`_[a-z0-9]{8}\.([a-z]+)\.txt$`)
+
+// LevelConfig defines a transcription level that is derived from the
+// diplomatic transcription with a set of mapping rules
+type LevelConfig struct {
+	Name string `json:"name"`
+	NormalizationConfig
+}
+
+type transcriptionLevel struct {
+	name       string
+	normalizer *Normalizer
+}
+
+func newTranscriptionLevels(configs []LevelConfig) ([]transcriptionLevel, error) {
+	levels := make([]transcriptionLevel, 0, len(configs))
+	seen := map[string]bool{LevelDiplomatic: true}
+	for _, config := range configs {
+		if !levelNamePat.MatchString(config.Name) {
+			return nil, fmt.Errorf(
+				"Invalid transcription level name '%s', only a-z are allowed", config.Name)
+		}
+		if seen[config.Name] {
+			return nil, fmt.Errorf("Duplicate transcription level '%s'", config.Name)
+		}
+		seen[config.Name] = true
+		normalizer, err := NewNormalizer(config.NormalizationConfig)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, transcriptionLevel{config.Name, normalizer})
+	}
+	return levels, nil
+}
+
+func isLevelFile(path string) bool {
+	return levelFilePat.MatchString(path)
+}
+
+func levelPath(basePath string, level string) string {
+	return fmt.Sprintf("%s.%s.txt", basePath, level)
+}
+
+// Levels returns the names of all transcription levels of the corpus
+func (s *DocumentStore) Levels() []string {
+	names := []string{LevelDiplomatic}
+	for _, level := range s.levels {
+		names = append(names, level.name)
+	}
+	return names
+}
+
+// deriveLevels generates the text of all derived levels from the diplomatic
+// transcription
+func (s *DocumentStore) deriveLevels(diplomatic string) map[string]string {
+	if len(s.levels) == 0 {
+		return nil
+	}
+	derived := make(map[string]string, len(s.levels))
+	for _, level := range s.levels {
+		derived[level.name] = level.normalizer.Normalize(diplomatic)
+	}
+	return derived
+}
+
+// readLevels reads the derived levels of a line from their side files,
+// levels without a side file are derived from the diplomatic transcription
+func (s *DocumentStore) readLevels(basePath string, diplomatic string) map[string]string {
+	derived := s.deriveLevels(diplomatic)
+	for name := range derived {
+		text, err := ioutil.ReadFile(levelPath(basePath, name))
+		if err == nil {
+			derived[name] = strings.TrimSpace(string(text))
+		}
+	}
+	return derived
+}
+
+// writeLevels writes the side files for all derived levels of a line and
+// returns the number of files that changed
+func (s *DocumentStore) writeLevels(basePath string, diplomatic string) (int, error) {
+	numChanged := 0
+	for name, text := range s.deriveLevels(diplomatic) {
+		path := levelPath(basePath, name)
+		if old, err := ioutil.ReadFile(path); err == nil && string(old) == text+"\n" {
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte(text+"\n"), 0644); err != nil {
+			return numChanged, err
+		}
+		if err := s.repo.Add(path); err != nil {
+			return numChanged, err
+		}
+		numChanged++
+	}
+	return numChanged, nil
+}
+
+// removeLevels removes the side files of all levels of a line
+func (s *DocumentStore) removeLevels(basePath string) error {
+	paths, err := filepath.Glob(basePath + ".*.txt")
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil && isLevelFile(path) {
+			if err := s.repo.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SelectLevel replaces the transcriptions of all lines in the document with
+// the given level
+func (s *DocumentStore) SelectLevel(doc *Document, level string) error {
+	if level == "" || level == LevelDiplomatic {
+		return nil
+	}
+	found := false
+	for _, name := range s.Levels() {
+		found = found || name == level
+	}
+	if !found {
+		return ErrUnknownLevel
+	}
+	for idx, line := range doc.Lines {
+		text, ok := line.Levels[level]
+		if !ok {
+			text = s.deriveLevels(line.Transcription)[level]
+		}
+		doc.Lines[idx].Transcription = text
+	}
+	return nil
+}
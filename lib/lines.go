@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operations that derive new lines from the ABBYY lines
+const (
+	OperationSplit = "split"
+	OperationMerge = "merge"
+)
+
+// LineProvenance links a line that was split or merged by a transcriber
+// back to the ABBYY lines it was derived from
+type LineProvenance struct {
+	Operation string    `json:"operation"`
+	Lines     []string  `json:"lines"`
+	Boxes     []LineBox `json:"boxes"`
+}
+
+// pageNumber returns the page of a line, for older documents it is taken
+// from the image URL
+func (l OCRLine) pageNumber() int {
+	if l.PageNumber == 0 {
+		if match := iiifPagePat.FindStringSubmatch(l.ImageURL); match != nil {
+			pageNo, _ := strconv.Atoi(match[1])
+			return pageNo
+		}
+	}
+	return l.PageNumber
+}
+
+// lineBox returns the box of a line, for documents from before the boxes
+// were stored it is taken from the image URL
+func (l OCRLine) lineBox() LineBox {
+	if l.Box != (LineBox{}) {
+		return l.Box
+	}
+	if box, ok := imageURLBox(l.ImageURL); ok {
+		return box
+	}
+	return l.Box
+}
+
+// provenance returns the provenance for lines derived from this one
+func (l OCRLine) provenance(operation string) LineProvenance {
+	if l.Provenance != nil {
+		return LineProvenance{operation, l.Provenance.Lines, l.Provenance.Boxes}
+	}
+	return LineProvenance{operation, []string{l.Identifier}, []LineBox{l.Box}}
+}
+
+// newDerivedLine creates a line for a new box on the page of the line
+func newDerivedLine(source Source, ident string, line OCRLine, box LineBox, provenance LineProvenance) OCRLine {
+	url := source.CropURL(ident, line, box)
+	return OCRLine{
+		Identifier: Sha1Digest([]byte(url)),
+		ImageURL:   url,
+		PageNumber: line.pageNumber(),
+		PageLabel:  line.PageLabel,
+		CanvasID:   line.CanvasID,
+		Box:        box,
+		BlockType:  line.BlockType,
+		Skew:       line.Skew,
+		Confidence: -1,
+		Provenance: &provenance,
+	}
+}
+
+// SplitLine splits a line of the volume into several lines at the given
+// horizontal offsets relative to the line box
+func SplitLine(source Source, ident string, line OCRLine, offsets []int) ([]OCRLine, error) {
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("No offsets to split line %s at", line.Identifier)
+	}
+	provenance := line.provenance(OperationSplit)
+	lines := make([]OCRLine, 0, len(offsets)+1)
+	start := 0
+	ends := append(append([]int{}, offsets...), line.Box.Width)
+	for idx, end := range ends {
+		if end <= start || end > line.Box.Width {
+			return nil, fmt.Errorf(
+				"Invalid offset %d for line %s of width %d, offsets must be increasing",
+				end, line.Identifier, line.Box.Width)
+		}
+		box := LineBox{
+			X: line.Box.X + start, Y: line.Box.Y, Width: end - start, Height: line.Box.Height}
+		part := newDerivedLine(source, ident, line, box, provenance)
+		if idx == 0 {
+			part.PreviousImageURL = line.PreviousImageURL
+		} else {
+			lines[idx-1].NextImageURL = part.ImageURL
+			part.PreviousImageURL = lines[idx-1].ImageURL
+		}
+		lines = append(lines, part)
+		start = end
+	}
+	lines[len(lines)-1].NextImageURL = line.NextImageURL
+	return lines, nil
+}
+
+// MergeLines merges adjacent lines from the same page of the volume into a
+// single line. Lines are adjacent if they are next to each other on the
+// same height.
+func MergeLines(source Source, ident string, lines []OCRLine) (OCRLine, error) {
+	if len(lines) < 2 {
+		return OCRLine{}, fmt.Errorf("At least two lines are needed for a merge")
+	}
+	first, last := lines[0], lines[len(lines)-1]
+	x0, y0 := first.Box.X, first.Box.Y
+	x1, y1 := first.Box.X+first.Box.Width, first.Box.Y+first.Box.Height
+	provenance := LineProvenance{Operation: OperationMerge}
+	transcriptions := []string{}
+	for idx, line := range lines {
+		if line.pageNumber() != first.pageNumber() ||
+			source.PageURL(ident, line) != source.PageURL(ident, first) {
+			return OCRLine{}, fmt.Errorf(
+				"Line %s is not on the same page as line %s", line.Identifier, first.Identifier)
+		}
+		if idx > 0 && !linesAdjacent(lines[idx-1], line) {
+			return OCRLine{}, fmt.Errorf(
+				"Lines %s and %s are not adjacent", lines[idx-1].Identifier, line.Identifier)
+		}
+		if line.Box.X < x0 {
+			x0 = line.Box.X
+		}
+		if line.Box.Y < y0 {
+			y0 = line.Box.Y
+		}
+		if line.Box.X+line.Box.Width > x1 {
+			x1 = line.Box.X + line.Box.Width
+		}
+		if line.Box.Y+line.Box.Height > y1 {
+			y1 = line.Box.Y + line.Box.Height
+		}
+		origin := line.provenance(OperationMerge)
+		for originIdx, originID := range origin.Lines {
+			// Parts of a line that was split before only link back to it once
+			known := false
+			for _, id := range provenance.Lines {
+				known = known || id == originID
+			}
+			if !known {
+				provenance.Lines = append(provenance.Lines, originID)
+				provenance.Boxes = append(provenance.Boxes, origin.Boxes[originIdx])
+			}
+		}
+		if line.Transcription != "" {
+			transcriptions = append(transcriptions, line.Transcription)
+		}
+	}
+	box := LineBox{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+	merged := newDerivedLine(source, ident, first, box, provenance)
+	merged.Transcription = strings.Join(transcriptions, " ")
+	merged.PreviousImageURL = first.PreviousImageURL
+	merged.NextImageURL = last.NextImageURL
+	return merged, nil
+}
+
+// linesAdjacent checks if the line b directly follows the line a on the
+// same height. Lines from other rows or columns would not result in an
+// image of a single line.
+func linesAdjacent(a OCRLine, b OCRLine) bool {
+	// Boxes need to overlap vertically by at least half the smaller height
+	overlap := minInt(a.Box.Y+a.Box.Height, b.Box.Y+b.Box.Height) - maxInt(a.Box.Y, b.Box.Y)
+	if 2*overlap < minInt(a.Box.Height, b.Box.Height) {
+		return false
+	}
+	// and be at most twice the line height apart, the gap between columns
+	// is usually larger
+	gap := maxInt(a.Box.X, b.Box.X) - minInt(a.Box.X+a.Box.Width, b.Box.X+b.Box.Width)
+	return gap <= 2*maxInt(a.Box.Height, b.Box.Height)
+}
+
+// VerifyLines makes sure that lines sent by a client belong to the document
+// with the given identifier and takes everything but their transcription
+// from the server side. Lines of documents in the corpus are looked up
+// there, lines of tasks must have been handed out for the document and are
+// taken from what was registered when they were handed out.
+func (s *DocumentStore) VerifyLines(ident string, lines []OCRLine) ([]OCRLine, error) {
+	stored := map[string]OCRLine{}
+	if doc := s.Details(ident); doc != nil {
+		for _, line := range doc.Lines {
+			stored[line.Identifier] = line
+		}
+	}
+	verified := make([]OCRLine, 0, len(lines))
+	for _, line := range lines {
+		if storedLine, ok := stored[line.Identifier]; ok {
+			storedLine.Box = storedLine.lineBox()
+			storedLine.Transcription = line.Transcription
+			verified = append(verified, storedLine)
+			continue
+		}
+		registered, ok := LineCache.RegisteredLine(fmt.Sprintf("%s_%s", ident, line.Identifier))
+		if !ok || registered.ImageURL != line.ImageURL {
+			return nil, fmt.Errorf("%s: %s", ErrForeignLine, line.Identifier)
+		}
+		// Provenance is only ever set by the server when it splits or
+		// merges lines, never taken from the request
+		registered.Box = registered.lineBox()
+		registered.PageNumber = registered.pageNumber()
+		registered.Transcription = line.Transcription
+		verified = append(verified, registered)
+	}
+	return verified, nil
+}
+
+// imageURLBox takes the box of a line from its IIIF or local image URL
+func imageURLBox(imageURL string) (LineBox, bool) {
+	match := iiifRegionPat.FindStringSubmatch(imageURL)
+	if match == nil {
+		match = localBoxPat.FindStringSubmatch(strings.SplitN(imageURL+"#", "#", 2)[1])
+	}
+	if match == nil {
+		return LineBox{}, false
+	}
+	x, _ := strconv.Atoi(match[1])
+	y, _ := strconv.Atoi(match[2])
+	w, _ := strconv.Atoi(match[3])
+	h, _ := strconv.Atoi(match[4])
+	return LineBox{X: x, Y: y, Width: w, Height: h}, true
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
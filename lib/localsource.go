@@ -0,0 +1,451 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	// Scans are often stored as TIFF
+	_ "golang.org/x/image/tiff"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Matches the box of a line in the fragment of a local image URL
+var localBoxPat = regexp.MustCompile(`^xywh=(\d+),(\d+),(\d+),(\d+)$`)
+
+// Extensions of the page images in a volume directory
+var localImageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true,
+}
+
+// Extensions of the layout files, XML files are either ALTO or PAGE
+var localLayoutExtensions = map[string]string{
+	".xml": "", ".hocr": LayoutHOCR, ".html": LayoutHOCR,
+}
+
+// Directories of all local sources by their name, images outside of them
+// are never read
+var localRoots = map[string]string{}
+var localRootsMutex sync.RWMutex
+
+// LocalSourceConfig configures a directory with a subdirectory of page
+// images and their layout for every volume
+type LocalSourceConfig struct {
+	// Name of the source, identifiers of its volumes are <name>-<hash>
+	Name string `json:"name"`
+	// Directory with the volumes, relative to the corpus repository
+	Path string `json:"path"`
+}
+
+// localMetadata is read from the metadata.json of a volume directory
+type localMetadata struct {
+	Title string `json:"title"`
+	Year  int    `json:"year"`
+}
+
+// localSource ingests volumes from a directory and crops their lines from
+// the page images on disk, without any network access
+type localSource struct {
+	config LocalSourceConfig
+}
+
+// newLocalSource creates a source for a directory and allows reading images
+// from it
+func newLocalSource(config LocalSourceConfig) (*localSource, error) {
+	path, err := filepath.Abs(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := os.Stat(path); err != nil || !stat.IsDir() {
+		return nil, fmt.Errorf("Directory of source '%s' does not exist: %s", config.Name, path)
+	}
+	config.Path = path
+	localRootsMutex.Lock()
+	localRoots[config.Name] = path
+	localRootsMutex.Unlock()
+	return &localSource{config}, nil
+}
+
+func (s *localSource) Name() string {
+	return s.config.Name
+}
+
+// identifier derives the identifier of a volume from its directory name
+func (s *localSource) identifier(dirName string) string {
+	return fmt.Sprintf("%s-%s", s.config.Name, Sha1Digest([]byte(dirName)))
+}
+
+// volumeDirs returns the directories of all volumes by their identifier
+func (s *localSource) volumeDirs() (map[string]string, error) {
+	infos, err := ioutil.ReadDir(s.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]string{}
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			dirs[s.identifier(info.Name())] = filepath.Join(s.config.Path, info.Name())
+		}
+	}
+	return dirs, nil
+}
+
+// volumeDir returns the directory of a single volume
+func (s *localSource) volumeDir(ident string) (string, error) {
+	dirs, err := s.volumeDirs()
+	if err != nil {
+		return "", err
+	}
+	dir, ok := dirs[ident]
+	if !ok {
+		return "", fmt.Errorf("No directory for volume %s in %s", ident, s.config.Path)
+	}
+	return dir, nil
+}
+
+// readMetadata takes the title and year of a volume from its metadata.json,
+// or else from the name of its directory
+func readMetadata(dir string) localMetadata {
+	meta := localMetadata{Year: -1}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "metadata.json")); err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			log.Warn().Err(err).Str("dir", dir).Msg("Could not parse metadata.json")
+		}
+	}
+	name := filepath.Base(dir)
+	if meta.Title == "" {
+		meta.Title = name
+	}
+	if meta.Year <= 0 {
+		meta.Year = -1
+		if match := manifestYearPat.FindStringSubmatch(name); match != nil {
+			meta.Year, _ = strconv.Atoi(match[1])
+		}
+	}
+	return meta
+}
+
+// pageImages lists the page images of a volume in the order of their names
+func pageImages(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	images := []string{}
+	for _, info := range infos {
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		if !info.IsDir() && localImageExtensions[ext] {
+			images = append(images, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// layoutFiles maps the base names of the layout files in a volume directory
+// and its subdirectories to their paths
+func layoutFiles(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && filepath.Dir(path) != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if _, ok := localLayoutExtensions[ext]; !ok || info.Name() == "metadata.json" {
+			return nil
+		}
+		base := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		// Files next to the images take precedence over subdirectories
+		if _, ok := files[base]; !ok || filepath.Dir(path) == dir {
+			files[base] = path
+		}
+		return nil
+	})
+	return files, err
+}
+
+// layoutFormat determines the format of a layout file, the root element
+// tells ALTO and PAGE apart
+func layoutFormat(path string) (string, error) {
+	if format := localLayoutExtensions[strings.ToLower(filepath.Ext(path))]; format != "" {
+		return format, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	dec := xml.NewDecoder(file)
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return "", fmt.Errorf("Could not determine layout format of %s: %s", path, err)
+		}
+		if elem, ok := token.(xml.StartElement); ok {
+			switch elem.Name.Local {
+			case "alto":
+				return LayoutALTO, nil
+			case "PcGts":
+				return LayoutPAGE, nil
+			default:
+				return "", fmt.Errorf("Unknown layout format '%s' in %s", elem.Name.Local, path)
+			}
+		}
+	}
+}
+
+// readLayout parses a layout file
+func readLayout(path string) (*layoutPage, error) {
+	format, err := layoutFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseLayout(format, file)
+}
+
+func (s *localSource) Volumes(showProgress bool) ([]IdentifierCacheEntry, error) {
+	dirs, err := s.volumeDirs()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]IdentifierCacheEntry, 0, len(dirs))
+	for ident, dir := range dirs {
+		images, err := pageImages(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(images) == 0 {
+			continue
+		}
+		entries = append(entries, IdentifierCacheEntry{
+			Identifier: ident,
+			NumPages:   len(images),
+			Year:       readMetadata(dir).Year,
+			Source:     s.config.Name,
+		})
+	}
+	log.Info().
+		Str("source", s.config.Name).
+		Int("numVolumes", len(entries)).
+		Msg("Listed volumes")
+	return entries, nil
+}
+
+func (s *localSource) Metadata(volume IdentifierCacheEntry) (*Document, error) {
+	dir, err := s.volumeDir(volume.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	meta := readMetadata(dir)
+	return &Document{
+		Identifier: volume.Identifier,
+		Title:      meta.Title,
+		Year:       volume.Year,
+		Source:     s.config.Name,
+	}, nil
+}
+
+// IsSuitable accepts all volumes, since they were picked for the corpus
+func (s *localSource) IsSuitable(volume IdentifierCacheEntry) (bool, error) {
+	return true, nil
+}
+
+func (s *localSource) fetchLinesWorker(volume IdentifierCacheEntry, config *CorpusConfig, out lineChannels) {
+	defer out.close()
+	logger := log.With().Str("source", s.config.Name).Str("identifier", volume.Identifier).Logger()
+	dir, err := s.volumeDir(volume.Identifier)
+	if err != nil {
+		out.sendProgress(ProgressMessage{Error: err, Step: "fetch"})
+		return
+	}
+	images, err := pageImages(dir)
+	if err != nil {
+		out.sendProgress(ProgressMessage{Error: err, Step: "fetch"})
+		return
+	}
+	layouts, err := layoutFiles(dir)
+	if err != nil {
+		out.sendProgress(ProgressMessage{Error: err, Step: "fetch"})
+		return
+	}
+	pages := make([]PageInfo, 0, len(images))
+	pageLines := make([][]OCRLine, 0, len(images))
+	numLines := 0
+	for idx, imgPath := range images {
+		page := PageInfo{Index: idx}
+		if width, height, err := ImageSize(imgPath); err == nil {
+			page.Width, page.Height = width, height
+		} else {
+			logger.Warn().Err(err).Str("image", imgPath).Msg("Could not read page image")
+		}
+		var lines []OCRLine
+		base := filepath.Base(imgPath)
+		layoutPath, ok := layouts[strings.TrimSuffix(base, filepath.Ext(base))]
+		if ok && page.Width > 0 {
+			layout, err := readLayout(layoutPath)
+			if err != nil {
+				// The page is treated as blank
+				logger.Warn().Err(err).Str("layout", layoutPath).Msg("Could not read page layout")
+			} else {
+				relPath, _ := filepath.Rel(s.config.Path, imgPath)
+				lines = layout.ocrLines(&page, config.Crop.Padding, func(box LineBox) string {
+					return localSourceURL(s.config.Name, relPath, &box)
+				})
+			}
+		}
+		for lineIdx := range lines {
+			lines[lineIdx].PageNumber = idx + 1
+		}
+		numLines += len(lines)
+		pages = append(pages, page)
+		pageLines = append(pageLines, lines)
+		isReceived := out.sendProgress(ProgressMessage{
+			Step:       "fetch",
+			Progress:   float64(idx+1) / float64(len(images)),
+			PageNumber: idx + 1,
+			LineNumber: numLines,
+		})
+		if !isReceived {
+			return
+		}
+	}
+	selectLines(volume.Identifier, config, pages, pageLines, out)
+}
+
+func (s *localSource) FetchLines(volume IdentifierCacheEntry, config *CorpusConfig, done <-chan struct{}) (chan ProgressMessage, chan []OCRLine) {
+	out := newLineChannels(done)
+	go s.fetchLinesWorker(volume, config, out)
+	return out.progress, out.lines
+}
+
+// localSourceURL builds the URL of a page image, relative to the
+// directory of its source, with the box of a line as its fragment if it is
+// given. The URLs are stored in the corpus, so they must not depend on
+// where the source is on disk: local:<source>/<volume>/<file>#xywh=x,y,w,h
+func localSourceURL(source string, relPath string, box *LineBox) string {
+	segments := strings.Split(filepath.ToSlash(relPath), "/")
+	for idx, segment := range segments {
+		segments[idx] = url.PathEscape(segment)
+	}
+	imgURL := url.URL{Scheme: "local", Opaque: source + "/" + strings.Join(segments, "/")}
+	if box != nil {
+		imgURL.Fragment = fmt.Sprintf("xywh=%d,%d,%d,%d", box.X, box.Y, box.Width, box.Height)
+	}
+	return imgURL.String()
+}
+
+// localPageURL strips the box from a local image URL
+func localPageURL(imageURL string) string {
+	return strings.SplitN(imageURL, "#", 2)[0]
+}
+
+func (s *localSource) CropURL(ident string, line OCRLine, box LineBox) string {
+	return fmt.Sprintf("%s#xywh=%d,%d,%d,%d",
+		localPageURL(line.ImageURL), box.X, box.Y, box.Width, box.Height)
+}
+
+func (s *localSource) PageURL(ident string, line OCRLine) string {
+	return localPageURL(line.ImageURL)
+}
+
+func (s *localSource) DetailsURL(doc *Document) string {
+	return ""
+}
+
+func (s *localSource) ViewerURL(doc *Document) string {
+	return ""
+}
+
+// isLocalImageURL checks if an image has to be read from disk
+func isLocalImageURL(imageURL string) bool {
+	return strings.HasPrefix(imageURL, "local:")
+}
+
+// localImagePath resolves a local image URL against the directory of its
+// source, the path has to stay within that directory
+func localImagePath(imgURL *url.URL) (string, error) {
+	parts := strings.SplitN(imgURL.Opaque, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid local image URL '%s'", imgURL)
+	}
+	localRootsMutex.RLock()
+	root, ok := localRoots[parts[0]]
+	localRootsMutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("Image %s is not part of a local source", imgURL)
+	}
+	relPath, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return "", err
+	}
+	imgPath := filepath.Join(root, filepath.FromSlash(relPath))
+	if !strings.HasPrefix(imgPath, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("Image %s is not part of a local source", imgURL)
+	}
+	return imgPath, nil
+}
+
+// readLocalImage reads the image at a local image URL, cropped to the box in
+// its fragment. Cropped images are always converted to PNG, whole images only
+// if keepFormat is not set. Only images in the directory of a local source
+// can be read.
+func readLocalImage(imageURL string, keepFormat bool) ([]byte, string, error) {
+	imgURL, err := url.Parse(imageURL)
+	if err != nil {
+		return nil, "", err
+	}
+	imgPath, err := localImagePath(imgURL)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(imgPath)
+	if err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not decode image at %s: %s", imgPath, err)
+	}
+	if imgURL.Fragment != "" {
+		match := localBoxPat.FindStringSubmatch(imgURL.Fragment)
+		if match == nil {
+			return nil, "", fmt.Errorf("Invalid box '%s' for image %s", imgURL.Fragment, imgPath)
+		}
+		x, _ := strconv.Atoi(match[1])
+		y, _ := strconv.Atoi(match[2])
+		w, _ := strconv.Atoi(match[3])
+		h, _ := strconv.Atoi(match[4])
+		region := image.Rect(x, y, x+w, y+h).Intersect(img.Bounds())
+		if region.Empty() {
+			return nil, "", fmt.Errorf("Box '%s' is outside of image %s", imgURL.Fragment, imgPath)
+		}
+		cropped := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+		draw.Draw(cropped, cropped.Bounds(), img, region.Min, draw.Src)
+		return encodeCachedImage(nil, cropped, "", false)
+	}
+	return encodeCachedImage(data, img, format, keepFormat)
+}
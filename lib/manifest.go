@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	simplejson "github.com/bitly/go-simplejson"
+)
+
+// ErrPageCountMismatch is returned when the OCR of a volume has a different
+// number of pages than its IIIF manifest has canvases
+var ErrPageCountMismatch = errors.New("Number of OCR pages does not match the manifest")
+
+// ManifestLink references an external resource, e.g. the OCR of a page
+type ManifestLink struct {
+	ID      string
+	Format  string
+	Profile string
+}
+
+// ManifestCanvas is a single page from a IIIF Presentation manifest
+type ManifestCanvas struct {
+	ID     string
+	Label  string
+	Width  int
+	Height int
+	// Identifier of the IIIF Image API service for the page image
+	ImageService string
+	SeeAlso      []ManifestLink
+	// Page number in the IIIF URLs of the page image, -1 if the canvas does
+	// not follow the iiif.archivelab.org URL scheme
+	PageNumber int
+}
+
+// ManifestRange is a logical section from a IIIF Presentation manifest,
+// e.g. the table of contents or a chapter
+type ManifestRange struct {
+	Label    string
+	Canvases []string
+}
+
+// Manifest holds the parts of a IIIF Presentation manifest we are
+// interested in
+type Manifest struct {
+	ID       string
+	Label    string
+	NavDate  string
+	Metadata map[string]string
+	Canvases []ManifestCanvas
+	Ranges   []ManifestRange
+}
+
+// ManifestURL returns the URL of the IIIF Presentation manifest for an
+// Archive.org identifier
+func ManifestURL(ident string) string {
+	return fmt.Sprintf("https://iiif.archivelab.org/iiif/%s/manifest.json", ident)
+}
+
+// canvasPageNumber takes the page number from the image service or the
+// identifier of a canvas, e.g. https://iiif.archivelab.org/iiif/<ident>$3
+func canvasPageNumber(ids ...string) int {
+	for _, id := range ids {
+		if match := iiifPagePat.FindStringSubmatch(id + "/"); match != nil {
+			pageNo, _ := strconv.Atoi(match[1])
+			return pageNo
+		}
+	}
+	return -1
+}
+
+// FetchManifest downloads and parses the IIIF Presentation manifest at the
+// given URL
+func FetchManifest(manifestURL string) (*Manifest, error) {
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode > 200 {
+		return nil, fmt.Errorf("Status %d while getting %s", resp.StatusCode, manifestURL)
+	}
+	defer resp.Body.Close()
+	json, err := simplejson.NewFromReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	manifest := Manifest{
+		ID:       json.Get("@id").MustString(),
+		Label:    manifestValue(json.Get("label")),
+		NavDate:  json.Get("navDate").MustString(),
+		Metadata: map[string]string{},
+	}
+	metadata := json.Get("metadata")
+	for i := range metadata.MustArray() {
+		entry := metadata.GetIndex(i)
+		manifest.Metadata[manifestValue(entry.Get("label"))] = manifestValue(entry.Get("value"))
+	}
+	canvases := json.Get("sequences").GetIndex(0).Get("canvases")
+	for i := range canvases.MustArray() {
+		canvas := canvases.GetIndex(i)
+		canvasID := canvas.Get("@id").MustString()
+		serviceID := canvas.Get("images").GetIndex(0).
+			Get("resource").Get("service").Get("@id").MustString()
+		manifest.Canvases = append(manifest.Canvases, ManifestCanvas{
+			ID:           canvasID,
+			Label:        manifestValue(canvas.Get("label")),
+			Width:        canvas.Get("width").MustInt(),
+			Height:       canvas.Get("height").MustInt(),
+			ImageService: serviceID,
+			SeeAlso:      manifestLinks(canvas.Get("seeAlso")),
+			PageNumber:   canvasPageNumber(serviceID, canvasID),
+		})
+	}
+	structures := json.Get("structures")
+	for i := range structures.MustArray() {
+		rng := structures.GetIndex(i)
+		manifest.Ranges = append(manifest.Ranges, ManifestRange{
+			Label:    rng.Get("label").MustString(),
+			Canvases: rng.Get("canvases").MustStringArray(),
+		})
+	}
+	return &manifest, nil
+}
+
+// manifestValue returns a string value from a manifest, which can also be
+// a list of values or language-tagged values, of which the first is used
+func manifestValue(value *simplejson.Json) string {
+	if str, err := value.String(); err == nil {
+		return str
+	}
+	if _, err := value.Array(); err == nil {
+		return manifestValue(value.GetIndex(0))
+	}
+	return value.Get("@value").MustString()
+}
+
+// manifestLinks parses a single link or a list of links, which can be
+// objects or plain URLs
+func manifestLinks(value *simplejson.Json) []ManifestLink {
+	items := []*simplejson.Json{}
+	if values, err := value.Array(); err == nil {
+		for i := range values {
+			items = append(items, value.GetIndex(i))
+		}
+	} else if value.Interface() != nil {
+		items = append(items, value)
+	}
+	links := make([]ManifestLink, 0, len(items))
+	for _, link := range items {
+		if url, err := link.String(); err == nil {
+			links = append(links, ManifestLink{ID: url})
+			continue
+		}
+		links = append(links, ManifestLink{
+			ID:      link.Get("@id").MustString(),
+			Format:  link.Get("format").MustString(),
+			Profile: manifestValue(link.Get("profile")),
+		})
+	}
+	return links
+}
+
+// Ranges with more canvases are sections like chapters, whose labels say
+// nothing about the role of the single pages
+const maxLabeledRangeSize = 8
+
+// PageLabels returns the label and the labels of all short ranges that
+// contain it for every canvas, in manifest order
+func (m *Manifest) PageLabels() ([]string, [][]string) {
+	labels := make([]string, len(m.Canvases))
+	ranges := make([][]string, len(m.Canvases))
+	canvasIdx := make(map[string]int, len(m.Canvases))
+	for idx, canvas := range m.Canvases {
+		labels[idx] = canvas.Label
+		canvasIdx[canvas.ID] = idx
+	}
+	for _, rng := range m.Ranges {
+		if len(rng.Canvases) > maxLabeledRangeSize {
+			continue
+		}
+		for _, canvasID := range rng.Canvases {
+			if idx, ok := canvasIdx[canvasID]; ok {
+				ranges[idx] = append(ranges[idx], rng.Label)
+			}
+		}
+	}
+	return labels, ranges
+}
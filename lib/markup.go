@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Inline markup for uncertain readings in transcriptions:
+//
+//   {text}  the enclosed text is an uncertain reading
+//   {?}     a single unreadable character
+//   {?3}    a gap of three unreadable characters
+//
+// Literal braces, question marks at the start of an uncertain reading and
+// backslashes are escaped with a backslash.
+
+// GapChar stands in for unreadable characters in exports that cannot
+// represent gaps otherwise
+const GapChar = "�"
+
+// Maximum length of a single gap
+const maxGapLength = 99
+
+// MarkupSegment is a part of a transcription that is either certain,
+// an uncertain reading or a gap of unreadable characters
+type MarkupSegment struct {
+	Text      string `json:"text,omitempty"`
+	Uncertain bool   `json:"uncertain,omitempty"`
+	Gap       int    `json:"gap,omitempty"`
+}
+
+// ParseMarkup splits a transcription into its certain, uncertain and
+// unreadable segments
+func ParseMarkup(text string) ([]MarkupSegment, error) {
+	segments := []MarkupSegment{}
+	var current strings.Builder
+	inBraces := false
+	escaped := false
+	isGap := false
+	openPos := 0
+	pos := 0
+	flush := func(uncertain bool) {
+		if current.Len() > 0 {
+			segments = append(segments, MarkupSegment{Text: current.String(), Uncertain: uncertain})
+		}
+		current.Reset()
+	}
+	for _, c := range text {
+		pos++
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '{':
+			if inBraces {
+				return nil, fmt.Errorf("Nested '{' at position %d", pos)
+			}
+			flush(false)
+			inBraces = true
+			openPos = pos
+		case c == '}':
+			if !inBraces {
+				return nil, fmt.Errorf("Unexpected '}' at position %d", pos)
+			}
+			if isGap {
+				gap := 1
+				if current.Len() > 0 {
+					var err error
+					gap, err = strconv.Atoi(current.String())
+					if err != nil || gap < 1 || gap > maxGapLength {
+						return nil, fmt.Errorf(
+							"Invalid gap length '%s' at position %d", current.String(), openPos)
+					}
+				}
+				segments = append(segments, MarkupSegment{Gap: gap})
+				current.Reset()
+			} else if current.Len() == 0 {
+				return nil, fmt.Errorf("Empty uncertain reading at position %d", openPos)
+			} else {
+				flush(true)
+			}
+			inBraces = false
+			isGap = false
+		case c == '?' && inBraces && pos == openPos+1:
+			isGap = true
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("Trailing '\\' at position %d", pos)
+	}
+	if inBraces {
+		return nil, fmt.Errorf("Unclosed '{' at position %d", openPos)
+	}
+	flush(false)
+	return segments, nil
+}
+
+// StripMarkup removes the markup from a transcription and replaces every
+// unreadable character with `gap`. Transcriptions with invalid markup are
+// returned unchanged.
+func StripMarkup(text string, gap string) string {
+	if !strings.ContainsAny(text, "{}\\") {
+		return text
+	}
+	segments, err := ParseMarkup(text)
+	if err != nil {
+		return text
+	}
+	var out strings.Builder
+	for _, segment := range segments {
+		if segment.Gap > 0 {
+			out.WriteString(strings.Repeat(gap, segment.Gap))
+		} else {
+			out.WriteString(segment.Text)
+		}
+	}
+	return out.String()
+}
+
+// markupSpan is the position of an uncertain reading or a gap in a
+// transcription without markup, in characters
+type markupSpan struct {
+	Offset int
+	Length int
+	IsGap  bool
+}
+
+// markupSpans strips the markup with GapChar for unreadable characters
+// and returns the positions of all uncertain readings and gaps
+func markupSpans(text string) (string, []markupSpan) {
+	segments, err := ParseMarkup(text)
+	if err != nil {
+		return text, nil
+	}
+	var out strings.Builder
+	spans := []markupSpan{}
+	offset := 0
+	for _, segment := range segments {
+		var length int
+		if segment.Gap > 0 {
+			out.WriteString(strings.Repeat(GapChar, segment.Gap))
+			length = segment.Gap
+		} else {
+			out.WriteString(segment.Text)
+			length = utf8.RuneCountInString(segment.Text)
+		}
+		if segment.Gap > 0 || segment.Uncertain {
+			spans = append(spans, markupSpan{offset, length, segment.Gap > 0})
+		}
+		offset += length
+	}
+	return out.String(), spans
+}
+
+// CountMarkup returns the number of uncertain and unreadable characters in
+// a transcription
+func CountMarkup(text string) (numUncertain int, numGaps int) {
+	_, spans := markupSpans(text)
+	for _, span := range spans {
+		if span.IsGap {
+			numGaps += span.Length
+		} else {
+			numUncertain += span.Length
+		}
+	}
+	return numUncertain, numGaps
+}
+
+// CheckMarkup makes sure that the markup in all lines of the document is
+// well-formed
+func CheckMarkup(doc Document) error {
+	for _, line := range doc.Lines {
+		if _, err := ParseMarkup(line.Transcription); err != nil {
+			return fmt.Errorf("Invalid markup in line %s: %s", line.Identifier, err)
+		}
+	}
+	return nil
+}
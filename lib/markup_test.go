@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMarkup(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []MarkupSegment
+		wantErr bool
+	}{
+		{"empty", "", []MarkupSegment{}, false},
+		{"plain", "Die Wörter", []MarkupSegment{{Text: "Die Wörter"}}, false},
+		{
+			"uncertain",
+			"Die {Wör}ter",
+			[]MarkupSegment{{Text: "Die "}, {Text: "Wör", Uncertain: true}, {Text: "ter"}},
+			false,
+		},
+		{"single gap", "W{?}rt", []MarkupSegment{{Text: "W"}, {Gap: 1}, {Text: "rt"}}, false},
+		{"gap with length", "{?3}ter", []MarkupSegment{{Gap: 3}, {Text: "ter"}}, false},
+		{"longest gap", "{?99}", []MarkupSegment{{Gap: 99}}, false},
+		{
+			"adjacent markup",
+			"{a}{?2}{b}",
+			[]MarkupSegment{{Text: "a", Uncertain: true}, {Gap: 2}, {Text: "b", Uncertain: true}},
+			false,
+		},
+		{"escaped braces", `\{a\}`, []MarkupSegment{{Text: "{a}"}}, false},
+		{"escaped backslash", `a\\b`, []MarkupSegment{{Text: `a\b`}}, false},
+		{"question mark outside braces", "Wie?", []MarkupSegment{{Text: "Wie?"}}, false},
+		{
+			"escaped question mark in uncertain reading",
+			`{\?a}`,
+			[]MarkupSegment{{Text: "?a", Uncertain: true}},
+			false,
+		},
+		{
+			"question mark inside uncertain reading",
+			"{a?}",
+			[]MarkupSegment{{Text: "a?", Uncertain: true}},
+			false,
+		},
+		{
+			"escaped brace in uncertain reading",
+			`{a\}}`,
+			[]MarkupSegment{{Text: "a}", Uncertain: true}},
+			false,
+		},
+		{"nested braces", "{a{b}}", nil, true},
+		{"unexpected closing brace", "a}", nil, true},
+		{"unclosed brace", "{abc", nil, true},
+		{"empty uncertain reading", "a{}b", nil, true},
+		{"zero gap", "{?0}", nil, true},
+		{"gap too long", "{?100}", nil, true},
+		{"gap with text", "{?ab}", nil, true},
+		{"trailing backslash", `abc\`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMarkup(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseMarkup(%q) = %+v, want an error", tt.text, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMarkup(%q) failed: %s", tt.text, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMarkup(%q) = %+v, want %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripMarkup(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		gap  string
+		want string
+	}{
+		{"plain", "Die Wörter", GapChar, "Die Wörter"},
+		{"uncertain", "Die {Wör}ter", GapChar, "Die Wörter"},
+		{"gaps", "W{?}r{?2}r", GapChar, "W�r��r"},
+		{"gaps removed", "W{?}rt{?3}", "", "Wrt"},
+		{"escapes", `\{a\}\\`, GapChar, `{a}\`},
+		{"invalid markup", "{a", GapChar, "{a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StripMarkup(tt.text, tt.gap); got != tt.want {
+				t.Errorf("StripMarkup(%q, %q) = %q, want %q", tt.text, tt.gap, got, tt.want)
+			}
+		})
+	}
+}
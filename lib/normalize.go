@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizationConfig is the policy that is applied to transcriptions
+// before they are written to the corpus
+type NormalizationConfig struct {
+	// Unicode normalization form, NFC, NFD or empty to keep the text as is
+	Form string `json:"form"`
+	// Replacements that are applied before the normalization form,
+	// e.g. "ä" to "aͤ"
+	Mappings map[string]string `json:"mappings"`
+}
+
+// Normalizer applies a normalization policy to transcriptions
+type Normalizer struct {
+	form     *norm.Form
+	mappings []Replacement
+	replacer *strings.Replacer
+}
+
+// Replacement counts how often a mapping was applied
+type Replacement struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+// NormalizationReport describes the changes of a corpus-wide normalization
+type NormalizationReport struct {
+	NumLines     int           `json:"numLines"`
+	NumChanged   int           `json:"numChanged"`
+	NumDerived   int           `json:"numDerived"`
+	Replacements []Replacement `json:"replacements"`
+	ChangedFiles []string      `json:"changedFiles"`
+	Commit       string        `json:"commit,omitempty"`
+}
+
+// NewNormalizer creates a normalizer for the given policy
+func NewNormalizer(config NormalizationConfig) (*Normalizer, error) {
+	n := Normalizer{}
+	switch strings.ToUpper(config.Form) {
+	case "":
+	case "NFC":
+		form := norm.NFC
+		n.form = &form
+	case "NFD":
+		form := norm.NFD
+		n.form = &form
+	default:
+		return nil, fmt.Errorf("Unknown normalization form '%s'", config.Form)
+	}
+	// Mappings are matched against NFC text, longer ones take precedence
+	for from, to := range config.Mappings {
+		n.mappings = append(n.mappings, Replacement{From: norm.NFC.String(from), To: to})
+	}
+	sort.Slice(n.mappings, func(i, j int) bool {
+		a, b := n.mappings[i].From, n.mappings[j].From
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	pairs := make([]string, 0, 2*len(n.mappings))
+	for _, mapping := range n.mappings {
+		pairs = append(pairs, mapping.From, mapping.To)
+	}
+	if len(pairs) > 0 {
+		n.replacer = strings.NewReplacer(pairs...)
+	}
+	return &n, nil
+}
+
+// Normalize applies the policy to a transcription
+func (n *Normalizer) Normalize(text string) string {
+	if n.replacer != nil {
+		text = n.replacer.Replace(norm.NFC.String(text))
+	}
+	if n.form != nil {
+		text = n.form.String(text)
+	}
+	return text
+}
+
+// NormalizeDocument applies the normalization policy of the corpus to the
+// transcriptions of a document, like they are when the document is saved
+func (s *DocumentStore) NormalizeDocument(doc Document) Document {
+	lines := make([]OCRLine, len(doc.Lines))
+	for idx, line := range doc.Lines {
+		line.Transcription = s.normalizer.Normalize(line.Transcription)
+		lines[idx] = line
+	}
+	doc.Lines = lines
+	return doc
+}
+
+// countReplacements counts how often every mapping applies to the text
+func (n *Normalizer) countReplacements(text string, counts []Replacement) {
+	text = norm.NFC.String(text)
+	for idx, mapping := range n.mappings {
+		if count := strings.Count(text, mapping.From); count > 0 {
+			counts[idx].Count += count
+			// Longer mappings take precedence over the ones they contain
+			text = strings.Replace(text, mapping.From, "", -1)
+		}
+	}
+}
+
+// NormalizeCorpus applies the normalization policy to every transcription
+// in the corpus, brings the derived transcription levels up to date and
+// commits the changes in a single commit. With dryRun, only the changes to
+// the transcriptions are reported.
+func (s *DocumentStore) NormalizeCorpus(dryRun bool, author string, email string) (*NormalizationReport, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	report := NormalizationReport{
+		Replacements: make([]Replacement, len(s.normalizer.mappings)),
+		ChangedFiles: []string{},
+	}
+	copy(report.Replacements, s.normalizer.mappings)
+	transPaths, err := filepath.Glob(
+		filepath.Join(s.basePath, "transcriptions", "*", "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(transPaths)
+	for _, transPath := range transPaths {
+		if isLevelFile(transPath) {
+			continue
+		}
+		raw, err := ioutil.ReadFile(transPath)
+		if err != nil {
+			return nil, err
+		}
+		report.NumLines++
+		text := strings.TrimSuffix(string(raw), "\n")
+		normalized := s.normalizer.Normalize(text)
+		if !dryRun {
+			numDerived, err := s.writeLevels(strings.TrimSuffix(transPath, ".txt"), normalized)
+			if err != nil {
+				return nil, err
+			}
+			report.NumDerived += numDerived
+		}
+		if normalized == text {
+			continue
+		}
+		s.normalizer.countReplacements(text, report.Replacements)
+		report.NumChanged++
+		relPath, _ := filepath.Rel(s.basePath, transPath)
+		report.ChangedFiles = append(report.ChangedFiles, relPath)
+		if dryRun {
+			continue
+		}
+		if err := ioutil.WriteFile(transPath, []byte(normalized+"\n"), 0644); err != nil {
+			return nil, err
+		}
+		if err := s.repo.Add(transPath); err != nil {
+			return nil, err
+		}
+	}
+	if dryRun || (report.NumChanged == 0 && report.NumDerived == 0) {
+		return &report, nil
+	}
+	if err := s.writeReadme(); err != nil {
+		return nil, err
+	}
+	commit, err := s.repo.Commit(s.normalizationMessage(report), author, email)
+	if err != nil {
+		return nil, err
+	}
+	report.Commit = commit
+	return &report, nil
+}
+
+func (s *DocumentStore) normalizationMessage(report NormalizationReport) string {
+	config := s.Config.Normalization
+	var msg string
+	if report.NumChanged > 0 {
+		msg = fmt.Sprintf("Normalized %d of %d lines", report.NumChanged, report.NumLines)
+	} else {
+		msg = "Updated derived transcription levels"
+	}
+	msg += "\n\nApplied the normalization policy of the corpus"
+	if config.Form != "" {
+		msg += fmt.Sprintf(" (Unicode %s)", strings.ToUpper(config.Form))
+	}
+	msg += " to all transcriptions."
+	if report.NumDerived > 0 {
+		msg += fmt.Sprintf("\nUpdated %d derived transcription levels.", report.NumDerived)
+	}
+	replacements := ""
+	for _, r := range report.Replacements {
+		if r.Count > 0 {
+			replacements += fmt.Sprintf("- %s (%s) → %s (%s): %d\n",
+				r.From, strings.Join(codePointNames(r.From), " "),
+				r.To, strings.Join(codePointNames(r.To), " "), r.Count)
+		}
+	}
+	if replacements != "" {
+		msg += "\n\nReplacements:\n" + replacements
+	}
+	return msg
+}
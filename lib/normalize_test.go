@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizer(t *testing.T) {
+	// "ä" precomposed and decomposed, and with a combining small e above
+	const (
+		nfcUmlaut = "\u00e4"
+		nfdUmlaut = "a\u0308"
+		superE    = "a\u0364"
+	)
+	policies := []struct {
+		name   string
+		config NormalizationConfig
+		cases  map[string]string
+	}{
+		{
+			name:   "unchanged",
+			config: NormalizationConfig{},
+			cases: map[string]string{
+				"W" + nfdUmlaut + "rter": "W" + nfdUmlaut + "rter",
+				"W" + nfcUmlaut + "rter": "W" + nfcUmlaut + "rter",
+			},
+		},
+		{
+			name:   "NFC",
+			config: NormalizationConfig{Form: "nfc"},
+			cases: map[string]string{
+				"W" + nfdUmlaut + "rter": "W" + nfcUmlaut + "rter",
+				"W" + nfcUmlaut + "rter": "W" + nfcUmlaut + "rter",
+				"W" + superE + "rter":    "W" + superE + "rter",
+			},
+		},
+		{
+			name:   "NFD",
+			config: NormalizationConfig{Form: "NFD"},
+			cases: map[string]string{
+				"W" + nfcUmlaut + "rter": "W" + nfdUmlaut + "rter",
+				"\u017fch\u00f6n":        "\u017fcho\u0308n",
+			},
+		},
+		{
+			// Mappings match both forms of their source, since they are
+			// matched against NFC text
+			name: "mappings",
+			config: NormalizationConfig{
+				Mappings: map[string]string{nfdUmlaut: superE, "ſ": "s"}},
+			cases: map[string]string{
+				"W" + nfdUmlaut + "rter": "W" + superE + "rter",
+				"W" + nfcUmlaut + "rter": "W" + superE + "rter",
+				"ſchön":                  "schön",
+			},
+		},
+		{
+			name: "mappings before NFD",
+			config: NormalizationConfig{
+				Form: "NFD", Mappings: map[string]string{"ſ": "s"}},
+			cases: map[string]string{"\u017fch\u00f6n": "scho\u0308n"},
+		},
+		{
+			name: "longest mapping first",
+			config: NormalizationConfig{
+				Mappings: map[string]string{"s": "z", "ſs": "ß", "ſ": "s"}},
+			cases: map[string]string{"Straſſe": "Strasse", "Maſs": "Maß"},
+		},
+	}
+	for _, policy := range policies {
+		n, err := NewNormalizer(policy.config)
+		if err != nil {
+			t.Fatalf("%s: NewNormalizer() failed: %s", policy.name, err)
+		}
+		for text, want := range policy.cases {
+			if got := n.Normalize(text); got != want {
+				t.Errorf("%s: Normalize(%+q) = %+q, want %+q", policy.name, text, got, want)
+			}
+		}
+	}
+
+	if _, err := NewNormalizer(NormalizationConfig{Form: "NFKC"}); err == nil {
+		t.Error("NewNormalizer() with NFKC did not fail")
+	}
+}
+
+func TestNormalizerCountsReplacements(t *testing.T) {
+	n, err := NewNormalizer(NormalizationConfig{
+		Mappings: map[string]string{"ſ": "s", "ſs": "ß", "ä": "aͤ"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make([]Replacement, len(n.mappings))
+	copy(counts, n.mappings)
+	n.countReplacements("Maſs und Waſſer", counts)
+	n.countReplacements("Sätze", counts)
+
+	// Mappings are sorted by the length of their source
+	want := []Replacement{
+		{From: "ſs", To: "ß", Count: 1},
+		{From: "ä", To: "aͤ", Count: 1},
+		{From: "ſ", To: "s", Count: 2},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("Replacements = %+v, want %+v", counts, want)
+	}
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PageClass describes the role of a page inside a volume
+type PageClass string
+
+// Page classes, only PageBody pages are used for tasks by default
+const (
+	PageBody  PageClass = "body"
+	PageBlank PageClass = "blank"
+	PageCover PageClass = "cover"
+	PageTitle PageClass = "title"
+	PageTOC   PageClass = "toc"
+	PagePlate PageClass = "plate"
+	PageIndex PageClass = "index"
+	PageFront PageClass = "front"
+	PageBack  PageClass = "back"
+)
+
+// Share of pages at the beginning and the end of a volume that are
+// considered front and back matter
+const frontBackShare = 0.1
+
+// Labels are only classified by the words they start with, after any
+// brackets or numbering, so that e.g. a chapter about a title or a page
+// mentioning a plate keep their class
+var pageLabelClasses = []struct {
+	pattern *regexp.Regexp
+	class   PageClass
+}{
+	{regexp.MustCompile(
+		`(?i)^[\W\d]*((front|back|vorderer|hinterer)\s+)?(cover|einband|umschlag|spine|rücken)\b`),
+		PageCover},
+	{regexp.MustCompile(`(?i)^[\W\d]*(title(\s+page)?|titel(blatt|seite|ei)?)\b`), PageTitle},
+	{regexp.MustCompile(
+		`(?i)^[\W\d]*((table\s+of\s+)?contents|inhalt|\pL*verzeichnis|übersicht)\b`),
+		PageTOC},
+	{regexp.MustCompile(
+		`(?i)^[\W\d]*(plates?|tafeln?|abbildung(en)?|illustrations?|frontispi(ece|z))\b`),
+		PagePlate},
+	{regexp.MustCompile(`(?i)^[\W\d]*(index|\pL*register)\b`), PageIndex},
+}
+
+var pageNumberPat = regexp.MustCompile(`^[\[(]?([0-9]+|[ivxlcdm]+|[IVXLCDM]+)[\]).]?$`)
+
+// PageConfig controls which pages of a volume lines are taken from
+type PageConfig struct {
+	// Number of pages to always skip at the beginning and end of a volume
+	SkipFirst int `json:"skipFirst"`
+	SkipLast  int `json:"skipLast"`
+	// Classes of pages whose lines are not used for tasks
+	SkipClasses []PageClass `json:"skipClasses"`
+	// Pages in the front or back matter with fewer lines or a lower share
+	// of the page area covered by text blocks are skipped
+	MinLines       int     `json:"minLines"`
+	MinTextDensity float64 `json:"minTextDensity"`
+	// Skip lines in the top and bottom margins that only hold a page number
+	SkipPageNumbers bool `json:"skipPageNumbers"`
+}
+
+// Skips checks if lines from a given page class should be skipped
+func (c PageConfig) Skips(class PageClass) bool {
+	for _, skipped := range c.SkipClasses {
+		if skipped == class {
+			return true
+		}
+	}
+	return false
+}
+
+// PageInfo holds layout statistics about a single page of a volume
+type PageInfo struct {
+	Index       int
+	Width       int
+	Height      int
+	Label       string
+	Ranges      []string
+	NumLines    int
+	NumChars    int
+	NumDigits   int
+	TextArea    int
+	PictureArea int
+	TableArea   int
+}
+
+// TextDensity returns the share of the page area covered by text blocks
+func (p PageInfo) TextDensity() float64 {
+	if p.Width <= 0 || p.Height <= 0 {
+		return 0
+	}
+	return float64(p.TextArea) / float64(p.Width*p.Height)
+}
+
+func (p PageInfo) pictureDensity() float64 {
+	if p.Width <= 0 || p.Height <= 0 {
+		return 0
+	}
+	return float64(p.PictureArea+p.TableArea) / float64(p.Width*p.Height)
+}
+
+// ClassifyPage determines the class of a page from its manifest labels and
+// its layout. numPages is the total number of pages in the volume.
+func ClassifyPage(page PageInfo, numPages int, config PageConfig) PageClass {
+	for _, label := range append([]string{page.Label}, page.Ranges...) {
+		for _, lc := range pageLabelClasses {
+			if lc.pattern.MatchString(label) {
+				return lc.class
+			}
+		}
+	}
+	if page.NumLines == 0 || page.NumChars == 0 {
+		return PageBlank
+	}
+	isSparse := page.NumLines < config.MinLines || page.TextDensity() < config.MinTextDensity
+	if isSparse && page.pictureDensity() > 0.4 {
+		return PagePlate
+	}
+	isFront := float64(page.Index) < frontBackShare*float64(numPages)
+	isBack := float64(page.Index) >= (1-frontBackShare)*float64(numPages)
+	// Tables of content and indices are dominated by page numbers
+	if float64(page.NumDigits)/float64(page.NumChars) > 0.15 {
+		if isFront {
+			return PageTOC
+		} else if isBack {
+			return PageIndex
+		}
+	}
+	if isSparse && isFront {
+		return PageFront
+	} else if isSparse && isBack {
+		return PageBack
+	}
+	return PageBody
+}
+
+// isPageNumber checks if a line only holds a page number and sits in the
+// top or bottom margin of the page
+func isPageNumber(text string, relY float64) bool {
+	if relY > 0.1 && relY < 0.9 {
+		return false
+	}
+	return pageNumberPat.MatchString(strings.TrimSpace(text))
+}
@@ -0,0 +1,448 @@
+package lib
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Binarization methods for processed line images
+const (
+	BinarizeOtsu    = "otsu"
+	BinarizeSauvola = "sauvola"
+)
+
+// Default parameters for Sauvola binarization
+const (
+	defaultSauvolaWindow = 15
+	defaultSauvolaK      = 0.34
+)
+
+// Matches the processed variants of line images, e.g. <ident>_<lineId>.bin.png
+var variantFilePat = regexp.MustCompile(`_[a-z0-9]{8}\.([a-z]+)\.png$`)
+
+// ImageVariant describes a processed variant of the line images that is
+// stored next to the original image
+type ImageVariant struct {
+	// Name of the variant, the image is stored as <id>.<name>.png
+	Name      string `json:"name"`
+	Grayscale bool   `json:"grayscale"`
+	// Binarization method, "otsu", "sauvola" or empty
+	Binarize      string  `json:"binarize"`
+	SauvolaWindow int     `json:"sauvolaWindow"`
+	SauvolaK      float64 `json:"sauvolaK"`
+	// Straighten the line along the baseline from the ABBYY output
+	Deskew bool `json:"deskew"`
+	// Scale the image to this height, 0 keeps the original height
+	Height int `json:"height"`
+	// White border that is added around the image, in pixels
+	Padding int `json:"padding"`
+}
+
+// PreprocessConfig lists the processed variants that are generated for every
+// line image
+type PreprocessConfig struct {
+	Variants []ImageVariant `json:"variants"`
+}
+
+func checkImageVariants(variants []ImageVariant) error {
+	seen := map[string]bool{}
+	for _, variant := range variants {
+		if !levelNamePat.MatchString(variant.Name) {
+			return fmt.Errorf(
+				"Invalid image variant name '%s', only a-z are allowed", variant.Name)
+		}
+		if seen[variant.Name] {
+			return fmt.Errorf("Duplicate image variant '%s'", variant.Name)
+		}
+		seen[variant.Name] = true
+		switch variant.Binarize {
+		case "", BinarizeOtsu, BinarizeSauvola:
+		default:
+			return fmt.Errorf("Unknown binarization method '%s'", variant.Binarize)
+		}
+	}
+	return nil
+}
+
+func isVariantFile(path string) bool {
+	return variantFilePat.MatchString(path)
+}
+
+func variantPath(basePath string, variant string) string {
+	return fmt.Sprintf("%s.%s.png", basePath, variant)
+}
+
+// ProcessLineImage applies the processing steps of a variant to a line
+// image, skew is the slope of the baseline
+func ProcessLineImage(src image.Image, skew float64, variant ImageVariant) image.Image {
+	var img draw.Image
+	if variant.Grayscale || variant.Binarize != "" || variant.Deskew {
+		img = toGray(src)
+	} else {
+		img = newCanvas(src, src.Bounds().Dx(), src.Bounds().Dy())
+		draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	}
+	if variant.Deskew && skew != 0 {
+		img = deskew(img, skew)
+	}
+	if variant.Height > 0 && img.Bounds().Dy() != variant.Height {
+		height := variant.Height
+		width := int(math.Round(
+			float64(img.Bounds().Dx()) * float64(height) / float64(img.Bounds().Dy())))
+		scaled := newCanvas(img, width, height)
+		draw.BiLinear.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+		img = scaled
+	}
+	switch variant.Binarize {
+	case BinarizeOtsu:
+		binarize(img.(*image.Gray), otsuThresholds(img.(*image.Gray)))
+	case BinarizeSauvola:
+		window, k := variant.SauvolaWindow, variant.SauvolaK
+		if window <= 0 {
+			window = defaultSauvolaWindow
+		}
+		if k <= 0 {
+			k = defaultSauvolaK
+		}
+		binarize(img.(*image.Gray), sauvolaThresholds(img.(*image.Gray), window, k))
+	}
+	if variant.Padding > 0 {
+		pad := variant.Padding
+		padded := newCanvas(img, img.Bounds().Dx()+2*pad, img.Bounds().Dy()+2*pad)
+		draw.Draw(padded, img.Bounds().Sub(img.Bounds().Min).Add(image.Pt(pad, pad)),
+			img, img.Bounds().Min, draw.Src)
+		img = padded
+	}
+	return img
+}
+
+// newCanvas creates a white image with the same color model as the image
+func newCanvas(like image.Image, width int, height int) draw.Image {
+	var canvas draw.Image
+	if _, ok := like.(*image.Gray); ok {
+		canvas = image.NewGray(image.Rect(0, 0, width, height))
+	} else {
+		canvas = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	return canvas
+}
+
+func toGray(src image.Image) *image.Gray {
+	bounds := src.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Bounds(), src, bounds.Min, draw.Src)
+	return gray
+}
+
+// deskew shears the image vertically so that a baseline with the given
+// slope becomes horizontal
+func deskew(img draw.Image, skew float64) draw.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	maxShift := int(math.Ceil(math.Abs(skew) * float64(width) / 2))
+	out := newCanvas(img, width, height+2*maxShift)
+	center := float64(width) / 2
+	for x := 0; x < width; x++ {
+		shift := maxShift - int(math.Round(skew*(float64(x)-center)))
+		for y := 0; y < height; y++ {
+			out.Set(x, y+shift, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// binarize sets all pixels darker than their threshold to black and all
+// others to white
+func binarize(img *image.Gray, thresholds func(x, y int) float64) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if float64(img.GrayAt(x, y).Y) < thresholds(x, y) {
+				img.SetGray(x, y, color.Gray{0})
+			} else {
+				img.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+}
+
+// otsuThresholds returns the global threshold that maximizes the variance
+// between the foreground and background pixels
+func otsuThresholds(img *image.Gray) func(x, y int) float64 {
+	histogram := [256]int{}
+	for _, value := range img.Pix {
+		histogram[value]++
+	}
+	total := len(img.Pix)
+	sum := 0.
+	for value, count := range histogram {
+		sum += float64(value * count)
+	}
+	sumBackground, numBackground := 0., 0
+	bestVariance, threshold := 0., 0.
+	for value, count := range histogram {
+		numBackground += count
+		if numBackground == 0 {
+			continue
+		}
+		numForeground := total - numBackground
+		if numForeground == 0 {
+			break
+		}
+		sumBackground += float64(value * count)
+		meanBackground := sumBackground / float64(numBackground)
+		meanForeground := (sum - sumBackground) / float64(numForeground)
+		variance := float64(numBackground) * float64(numForeground) *
+			(meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if variance > bestVariance {
+			bestVariance = variance
+			threshold = float64(value) + 1
+		}
+	}
+	return func(x, y int) float64 { return threshold }
+}
+
+// sauvolaThresholds returns local thresholds from the mean and standard
+// deviation in a window around every pixel, computed with integral images
+func sauvolaThresholds(img *image.Gray, window int, k float64) func(x, y int) float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	sums := make([]float64, (width+1)*(height+1))
+	squares := make([]float64, (width+1)*(height+1))
+	for y := 0; y < height; y++ {
+		rowSum, rowSquares := 0., 0.
+		for x := 0; x < width; x++ {
+			value := float64(img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y)
+			rowSum += value
+			rowSquares += value * value
+			idx := (y+1)*(width+1) + x + 1
+			sums[idx] = sums[idx-width-1] + rowSum
+			squares[idx] = squares[idx-width-1] + rowSquares
+		}
+	}
+	half := window / 2
+	return func(x, y int) float64 {
+		x, y = x-bounds.Min.X, y-bounds.Min.Y
+		x0, y0 := maxInt(x-half, 0), maxInt(y-half, 0)
+		x1, y1 := minInt(x+half+1, width), minInt(y+half+1, height)
+		area := float64((x1 - x0) * (y1 - y0))
+		at := func(values []float64) float64 {
+			return values[y1*(width+1)+x1] - values[y0*(width+1)+x1] -
+				values[y1*(width+1)+x0] + values[y0*(width+1)+x0]
+		}
+		mean := at(sums) / area
+		stddev := math.Sqrt(math.Max(at(squares)/area-mean*mean, 0))
+		return mean * (1 + k*(stddev/128-1))
+	}
+}
+
+// estimateSkew fits a baseline through the bottoms of the character boxes
+// of a line and returns its slope. Characters whose bottom is far from the
+// median, e.g. with descenders, are ignored.
+func estimateSkew(chars []LineBox, lineHeight int) float64 {
+	if len(chars) < 3 {
+		return 0
+	}
+	bottoms := make([]int, len(chars))
+	for idx, char := range chars {
+		bottoms[idx] = char.Y + char.Height
+	}
+	sorted := append([]int{}, bottoms...)
+	sort.Ints(sorted)
+	median := sorted[len(sorted)/2]
+	tolerance := 0.15 * float64(lineHeight)
+	var n, sumX, sumY, sumXX, sumXY float64
+	for idx, char := range chars {
+		if math.Abs(float64(bottoms[idx]-median)) > tolerance {
+			continue
+		}
+		x := float64(char.X) + float64(char.Width)/2
+		y := float64(bottoms[idx])
+		n++
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	denominator := n*sumXX - sumX*sumX
+	if n < 3 || denominator == 0 {
+		return 0
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	// Larger slopes are most likely errors in the character boxes
+	if math.Abs(slope) > 0.1 {
+		return 0
+	}
+	return math.Round(slope*10000) / 10000
+}
+
+// Range and resolution of the slopes tried by estimateImageSkew
+const (
+	maxImageSkew  = 0.05
+	imageSkewStep = 0.0025
+)
+
+// estimateImageSkew estimates the slope of the baseline of a line image,
+// for lines without character boxes. The dark pixels are projected onto the
+// rows for every candidate slope, the slope with the sharpest profile wins.
+func estimateImageSkew(src image.Image) float64 {
+	img := toGray(src)
+	threshold := otsuThresholds(img)(0, 0)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	var inkX, inkY []float64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if float64(img.GrayAt(x, y).Y) < threshold {
+				inkX = append(inkX, float64(x)-float64(width)/2)
+				inkY = append(inkY, float64(y))
+			}
+		}
+	}
+	if len(inkX) == 0 {
+		return 0
+	}
+	maxShift := int(math.Ceil(maxImageSkew * float64(width) / 2))
+	profile := make([]float64, height+2*maxShift+1)
+	sharpness := func(skew float64) float64 {
+		for idx := range profile {
+			profile[idx] = 0
+		}
+		for idx := range inkX {
+			row := int(math.Round(inkY[idx]-skew*inkX[idx])) + maxShift
+			profile[row]++
+		}
+		score := 0.
+		for _, count := range profile {
+			score += count * count
+		}
+		return score
+	}
+	bestSkew, bestScore := 0., sharpness(0)
+	numSteps := int(math.Round(maxImageSkew / imageSkewStep))
+	for step := -numSteps; step <= numSteps; step++ {
+		skew := float64(step) * imageSkewStep
+		// Only replace the straight profile if the slope is clearly better
+		if score := sharpness(skew); score > bestScore*1.01 {
+			bestSkew, bestScore = skew, score
+		}
+	}
+	return math.Round(bestSkew*10000) / 10000
+}
+
+// HasImageVariant checks if the processed variant of the line images with
+// the given name is configured for the corpus
+func (s *DocumentStore) HasImageVariant(name string) bool {
+	for _, variant := range s.Config.Preprocess.Variants {
+		if variant.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PreprocessCorpus writes the processed variants for all line images in the
+// corpus and commits them in a single commit
+func (s *DocumentStore) PreprocessCorpus(author string, email string) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	numImages := 0
+	for _, doc := range s.ListWithLines() {
+		for _, line := range doc.Lines {
+			if line.Transcription == "" {
+				// Flagged lines without a transcription have no image
+				continue
+			}
+			imgPath := filepath.Join(
+				s.basePath, "transcriptions", strconv.Itoa(doc.Year),
+				fmt.Sprintf("%s_%s.png", doc.Identifier, line.Identifier))
+			if err := s.writeImageVariants(imgPath, line.Skew); err != nil {
+				return numImages, err
+			}
+			numImages++
+		}
+	}
+	changes, err := s.repo.Diff(true)
+	if err != nil || len(changes) == 0 {
+		return numImages, err
+	}
+	names := []string{}
+	for _, variant := range s.Config.Preprocess.Variants {
+		names = append(names, variant.Name)
+	}
+	_, err = s.repo.Commit(fmt.Sprintf(
+		"Processed %d line images\n\nWrote the image variants %s for all lines.",
+		numImages, strings.Join(names, ", ")), author, email)
+	return numImages, err
+}
+
+// removeImageVariants removes the processed variants of a line image
+func (s *DocumentStore) removeImageVariants(basePath string) error {
+	paths, err := filepath.Glob(basePath + ".*.png")
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if isVariantFile(path) {
+			if err := s.repo.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeImageVariants writes the processed variants of a line image next to
+// it and adds them to the repository. Lines without a skew, e.g. from before
+// it was recorded, are deskewed by the skew estimated from their image.
+func (s *DocumentStore) writeImageVariants(imgPath string, skew float64) error {
+	variants := s.Config.Preprocess.Variants
+	if len(variants) == 0 {
+		return nil
+	}
+	in, err := os.Open(imgPath)
+	if err != nil {
+		return err
+	}
+	src, err := png.Decode(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+	if skew == 0 {
+		for _, variant := range variants {
+			if variant.Deskew {
+				skew = estimateImageSkew(src)
+				break
+			}
+		}
+	}
+	basePath := imgPath[:len(imgPath)-len(filepath.Ext(imgPath))]
+	for _, variant := range variants {
+		outPath := variantPath(basePath, variant.Name)
+		out, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		err = png.Encode(out, ProcessLineImage(src, skew, variant))
+		out.Close()
+		if err != nil {
+			return err
+		}
+		if err := s.repo.Add(outPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
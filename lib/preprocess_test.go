@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// syntheticLine draws dark vertical strokes on a light background, both with
+// some noise, and reports for every pixel if it belongs to a stroke
+func syntheticLine(width int, height int) (*image.RGBA, func(x, y int) bool) {
+	isStroke := func(x, y int) bool {
+		return x%10 < 3 && y >= height/4 && y < 3*height/4
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := 200
+			if isStroke(x, y) {
+				value = 60
+			}
+			value += (x*7+y*13)%41 - 20
+			img.Set(x, y, color.RGBA{uint8(value), uint8(value), uint8(value - 10), 255})
+		}
+	}
+	return img, isStroke
+}
+
+func TestOtsuSeparatesStrokesFromBackground(t *testing.T) {
+	src, isStroke := syntheticLine(120, 40)
+	gray := toGray(src)
+	lightestStroke, darkestBackground := 0., 255.
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 120; x++ {
+			value := float64(gray.GrayAt(x, y).Y)
+			if isStroke(x, y) {
+				lightestStroke = math.Max(lightestStroke, value)
+			} else {
+				darkestBackground = math.Min(darkestBackground, value)
+			}
+		}
+	}
+	threshold := otsuThresholds(gray)(0, 0)
+	if threshold <= lightestStroke || threshold > darkestBackground {
+		t.Fatalf("Threshold = %.0f, want above %.0f and at most %.0f",
+			threshold, lightestStroke, darkestBackground)
+	}
+
+	img := ProcessLineImage(src, 0, ImageVariant{Binarize: BinarizeOtsu})
+	bin, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("ProcessLineImage() returned a %T, want *image.Gray", img)
+	}
+	if bin.Bounds() != src.Bounds() {
+		t.Fatalf("Bounds = %v, want %v", bin.Bounds(), src.Bounds())
+	}
+	numWrong := 0
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 120; x++ {
+			want := uint8(255)
+			if isStroke(x, y) {
+				want = 0
+			}
+			if bin.GrayAt(x, y).Y != want {
+				numWrong++
+			}
+		}
+	}
+	if numWrong > 0 {
+		t.Errorf("%d pixels were binarized wrongly", numWrong)
+	}
+}
+
+func TestOtsuKeepsBlankImageWhite(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 30, 10))
+	for idx := range img.Pix {
+		img.Pix[idx] = 230
+	}
+	binarize(img, otsuThresholds(img))
+	for idx, value := range img.Pix {
+		if value != 255 {
+			t.Fatalf("Pixel %d = %d after binarizing a blank image, want 255", idx, value)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Context of the IIIF Presentation API
+const presentationContext = "http://iiif.io/api/presentation/3/context.json"
+
+// PresentationManifest is a IIIF Presentation 3 manifest for a document in
+// the corpus, with a canvas for every page that has transcribed lines
+type PresentationManifest struct {
+	Context  string                  `json:"@context"`
+	ID       string                  `json:"id"`
+	Type     string                  `json:"type"`
+	Label    LanguageMap             `json:"label"`
+	Metadata []PresentationMetadata  `json:"metadata,omitempty"`
+	SeeAlso  []PresentationReference `json:"seeAlso,omitempty"`
+	Items    []PresentationCanvas    `json:"items"`
+}
+
+// LanguageMap maps language codes to values, "none" if the language is
+// not known
+type LanguageMap map[string][]string
+
+// PresentationMetadata is a label/value pair that is shown to users
+type PresentationMetadata struct {
+	Label LanguageMap `json:"label"`
+	Value LanguageMap `json:"value"`
+}
+
+// PresentationReference links to an external resource
+type PresentationReference struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Format  string `json:"format,omitempty"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// PresentationCanvas is a single page, painted with its image and annotated
+// with the transcriptions of its lines
+type PresentationCanvas struct {
+	ID          string           `json:"id"`
+	Type        string           `json:"type"`
+	Label       LanguageMap      `json:"label"`
+	Width       int              `json:"width"`
+	Height      int              `json:"height"`
+	Items       []AnnotationPage `json:"items"`
+	Annotations []AnnotationPage `json:"annotations,omitempty"`
+}
+
+// AnnotationPage is an ordered list of annotations
+type AnnotationPage struct {
+	Context string       `json:"@context,omitempty"`
+	ID      string       `json:"id"`
+	Type    string       `json:"type"`
+	Items   []Annotation `json:"items"`
+}
+
+// Annotation links a body, e.g. an image or a transcription, to a target
+type Annotation struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Motivation string      `json:"motivation"`
+	Body       interface{} `json:"body"`
+	Target     string      `json:"target"`
+}
+
+// TextualBody is the body of an annotation that holds text
+type TextualBody struct {
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Format string `json:"format"`
+}
+
+// ImageBody is the body of an annotation that paints an image on a canvas
+type ImageBody struct {
+	ID      string         `json:"id"`
+	Type    string         `json:"type"`
+	Format  string         `json:"format"`
+	Width   int            `json:"width"`
+	Height  int            `json:"height"`
+	Service []ImageService `json:"service"`
+}
+
+// ImageService references the IIIF Image API service for an image
+type ImageService struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Profile string `json:"profile"`
+}
+
+// linesByPage groups the transcribed lines of a document by their page, in
+// page order
+func linesByPage(doc *Document) ([]int, map[int][]OCRLine) {
+	pages := []int{}
+	lines := map[int][]OCRLine{}
+	for _, line := range doc.Lines {
+		if line.Transcription == "" {
+			continue
+		}
+		pageNo := line.pageNumber()
+		if _, ok := lines[pageNo]; !ok {
+			pages = append(pages, pageNo)
+		}
+		lines[pageNo] = append(lines[pageNo], line)
+	}
+	sort.Ints(pages)
+	return pages, lines
+}
+
+// lineAnnotation creates an annotation that attaches the transcription of a
+// line to its box on a canvas
+func lineAnnotation(id string, canvasID string, line OCRLine) Annotation {
+	return Annotation{
+		ID:         id,
+		Type:       "Annotation",
+		Motivation: "supplementing",
+		Body: TextualBody{
+			Type:   "TextualBody",
+			Value:  StripMarkup(line.Transcription, GapChar),
+			Format: "text/plain",
+		},
+		Target: fmt.Sprintf("%s#xywh=%d,%d,%d,%d",
+			canvasID, line.Box.X, line.Box.Y, line.Box.Width, line.Box.Height),
+	}
+}
+
+// sourceCanvasSizes returns the canvases of the source IIIF manifest of a
+// document, by their ID and by their page number
+func sourceCanvasSizes(doc *Document) (map[string]ManifestCanvas, map[int]ManifestCanvas, error) {
+	manifest, err := FetchManifest(doc.Manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	byID := make(map[string]ManifestCanvas, len(manifest.Canvases))
+	byPage := make(map[int]ManifestCanvas, len(manifest.Canvases))
+	for _, canvas := range manifest.Canvases {
+		byID[canvas.ID] = canvas
+		if canvas.PageNumber >= 0 {
+			byPage[canvas.PageNumber] = canvas
+		}
+	}
+	return byID, byPage, nil
+}
+
+// NewPresentationManifest creates a manifest for a document whose resources
+// are served from the archiscribe instance at baseURL. The size of the pages
+// is taken from the canvases of the source manifest, only pages without a
+// canvas of known size are fetched into the cache to determine it.
+func (s *DocumentStore) NewPresentationManifest(doc *Document, baseURL string) (*PresentationManifest, error) {
+	docURL := fmt.Sprintf("%s/iiif/%s", baseURL, doc.Identifier)
+	manifest := PresentationManifest{
+		Context: presentationContext,
+		ID:      docURL + "/manifest.json",
+		Type:    "Manifest",
+		Label:   LanguageMap{"none": {doc.Title}},
+		Metadata: []PresentationMetadata{
+			{LanguageMap{"en": {"Year"}}, LanguageMap{"none": {strconv.Itoa(doc.Year)}}},
+			{LanguageMap{"en": {"Identifier"}}, LanguageMap{"none": {doc.Identifier}}},
+		},
+		Items: []PresentationCanvas{},
+	}
+	if doc.Manifest != "" {
+		manifest.SeeAlso = []PresentationReference{{
+			ID: doc.Manifest, Type: "Manifest", Format: "application/ld+json"}}
+	}
+	var canvasesByID map[string]ManifestCanvas
+	var canvasesByPage map[int]ManifestCanvas
+	if doc.Manifest != "" {
+		var err error
+		canvasesByID, canvasesByPage, err = sourceCanvasSizes(doc)
+		if err != nil {
+			log.Warn().Err(err).Str("manifest", doc.Manifest).Msg(
+				"Could not fetch source manifest, falling back to page images")
+		}
+	}
+	pages, lines := linesByPage(doc)
+	for _, pageNo := range pages {
+		imageID := pageImageID(doc.Identifier, pageNo)
+		sourceCanvas, ok := canvasesByID[lines[pageNo][0].CanvasID]
+		if !ok {
+			sourceCanvas = canvasesByPage[pageNo]
+		}
+		width, height := sourceCanvas.Width, sourceCanvas.Height
+		if width <= 0 || height <= 0 {
+			imgPath, err := s.IIIFImagePath(imageID)
+			if err != nil {
+				return nil, fmt.Errorf("Could not get image of page %d: %s", pageNo, err)
+			}
+			if width, height, err = ImageSize(imgPath); err != nil {
+				return nil, err
+			}
+		}
+		label := lines[pageNo][0].PageLabel
+		if label == "" {
+			label = strconv.Itoa(pageNo)
+		}
+		canvasID := fmt.Sprintf("%s/canvas/%d", docURL, pageNo)
+		serviceID := fmt.Sprintf("%s/iiif/%s", baseURL, imageID)
+		canvas := PresentationCanvas{
+			ID:     canvasID,
+			Type:   "Canvas",
+			Label:  LanguageMap{"none": {label}},
+			Width:  width,
+			Height: height,
+			Items: []AnnotationPage{{
+				ID:   canvasID + "/paintings",
+				Type: "AnnotationPage",
+				Items: []Annotation{{
+					ID:         canvasID + "/image",
+					Type:       "Annotation",
+					Motivation: "painting",
+					Body: ImageBody{
+						ID:      serviceID + "/full/max/0/default.jpg",
+						Type:    "Image",
+						Format:  "image/jpeg",
+						Width:   width,
+						Height:  height,
+						Service: []ImageService{{serviceID, "ImageService3", "level1"}},
+					},
+					Target: canvasID,
+				}},
+			}},
+		}
+		transcriptions := AnnotationPage{
+			ID:    canvasID + "/transcriptions",
+			Type:  "AnnotationPage",
+			Items: make([]Annotation, 0, len(lines[pageNo])),
+		}
+		for _, line := range lines[pageNo] {
+			transcriptions.Items = append(transcriptions.Items, lineAnnotation(
+				fmt.Sprintf("%s/lines/%s", docURL, line.Identifier), canvasID, line))
+		}
+		canvas.Annotations = []AnnotationPage{transcriptions}
+		manifest.Items = append(manifest.Items, canvas)
+	}
+	return &manifest, nil
+}
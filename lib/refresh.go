@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrRefreshRunning is returned when a refresh is requested while another
+// one is still running
+var ErrRefreshRunning = errors.New("Refresh is already running")
+
+// RefreshResult holds statistics about a refresh of the identifier cache
+type RefreshResult struct {
+	StartedAt   time.Time `json:"startedAt"`
+	Duration    float64   `json:"durationSeconds"`
+	NumScraped  int       `json:"numScraped"`
+	NumAdded    int       `json:"numAdded"`
+	NumRemoved  int       `json:"numRemoved"`
+	NumConsumed int       `json:"numConsumed"`
+	// Sources whose volumes could not be listed, their entries are kept
+	FailedSources []string `json:"failedSources,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// IdentifierRefresher keeps the identifier cache up to date with the
+// volumes of all sources and the documents in the corpus
+type IdentifierRefresher struct {
+	cache     *IdentifierCache
+	store     *DocumentStore
+	mutex     sync.Mutex
+	isRunning bool
+	last      *RefreshResult
+}
+
+// NewIdentifierRefresher creates a new refresher for the given cache
+func NewIdentifierRefresher(cache *IdentifierCache, store *DocumentStore) *IdentifierRefresher {
+	return &IdentifierRefresher{cache: cache, store: store}
+}
+
+// Status returns whether a refresh is currently running and the result of
+// the last finished refresh, if any
+func (r *IdentifierRefresher) Status() (bool, *RefreshResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.isRunning, r.last
+}
+
+// Refresh lists the current volumes of all sources and syncs the cache with
+// them
+func (r *IdentifierRefresher) Refresh(showProgress bool) (*RefreshResult, error) {
+	r.mutex.Lock()
+	if r.isRunning {
+		r.mutex.Unlock()
+		return nil, ErrRefreshRunning
+	}
+	r.isRunning = true
+	r.mutex.Unlock()
+
+	result := RefreshResult{StartedAt: time.Now()}
+	log.Info().Msg("Refreshing identifier cache")
+	err := r.refresh(&result, showProgress)
+	result.Duration = time.Since(result.StartedAt).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		log.Error().
+			Err(err).
+			Float64("durationSeconds", result.Duration).
+			Msg("Failed to refresh identifier cache")
+	} else {
+		log.Info().
+			Int("numScraped", result.NumScraped).
+			Int("numAdded", result.NumAdded).
+			Int("numRemoved", result.NumRemoved).
+			Int("numConsumed", result.NumConsumed).
+			Float64("durationSeconds", result.Duration).
+			Msg("Refreshed identifier cache")
+	}
+
+	r.mutex.Lock()
+	r.isRunning = false
+	r.last = &result
+	r.mutex.Unlock()
+	return &result, err
+}
+
+func (r *IdentifierRefresher) refresh(result *RefreshResult, showProgress bool) error {
+	sources := []Source{&archiveSource{}}
+	if r.store != nil {
+		sources = r.store.Sources()
+	}
+	scraped := []IdentifierCacheEntry{}
+	scrapedSources := []string{}
+	for _, source := range sources {
+		volumes, err := source.Volumes(showProgress)
+		if err != nil {
+			// A single unavailable source does not hold up the others
+			log.Error().Err(err).Str("source", source.Name()).Msg("Could not list volumes")
+			result.FailedSources = append(result.FailedSources, source.Name())
+			continue
+		}
+		scraped = append(scraped, volumes...)
+		scrapedSources = append(scrapedSources, source.Name())
+	}
+	if len(scrapedSources) == 0 && len(sources) > 0 {
+		return fmt.Errorf("Could not list volumes of any source")
+	}
+	result.NumScraped = len(scraped)
+	consumed := make([]string, 0)
+	if r.store != nil {
+		for _, doc := range r.store.List() {
+			consumed = append(consumed, doc.Identifier)
+		}
+	}
+	var err error
+	result.NumAdded, result.NumRemoved, result.NumConsumed, err = r.cache.Sync(
+		scraped, scrapedSources, consumed)
+	return err
+}
+
+// Schedule refreshes the cache in the background at the given interval
+func (r *IdentifierRefresher) Schedule(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			r.Refresh(false)
+		}
+	}()
+}
@@ -19,6 +19,12 @@ import (
 
 var pagePat = regexp.MustCompile(`<page width="(\d+)" height="(\d+)".+?>`)
 var linePat = regexp.MustCompile(`<line .+?l="(\d+)" t="(\d+)" r="(\d+)" b="(\d+)">`)
+var charPat = regexp.MustCompile(`<charParams([^>]*)>([^<]*)</charParams>`)
+var charConfidencePat = regexp.MustCompile(`charConfidence="(-?\d+)"`)
+var charBoxPat = regexp.MustCompile(`l="(\d+)" t="(\d+)" r="(\d+)" b="(\d+)"`)
+var blockPat = regexp.MustCompile(`<block blockType="(\w+)".*?l="(\d+)" t="(\d+)" r="(\d+)" b="(\d+)"`)
+var abbyyTagPat = regexp.MustCompile(
+	`<page [^>]*>|<block [^>]*>|<line [^>]*>|<charParams[^>]*>[^<]*</charParams>|</line>`)
 
 const readmeTemplate = `
 # archiscribe-corpus
@@ -29,7 +35,9 @@ The goal is to have as much diverse OCR ground truth for 19th Century German
 prints as possible.
 
 Currently the corpus contains {{.numLines}} lines from {{.numWorks}} works
-published across {{.numYears}} years. Detailed statistics are available below.
+published across {{.numYears}} years.{{if .numFlagged}} Another {{.numFlagged}} lines
+were flagged without a transcription.{{end}} Detailed statistics are available
+below.
 
 ## Statistics: Decades
 
@@ -42,6 +50,15 @@ published across {{.numYears}} years. Detailed statistics are available below.
 ## Statistics: Works
 
 {{.worksTable}}
+{{- if .charTable}}
+
+## Statistics: Characters
+
+Frequencies of all characters (grapheme clusters) in the transcriptions, with
+example lines for rare characters.
+
+{{.charTable}}
+{{- end}}
 `
 
 // IDCache is the global cache for suitable identifiers
@@ -50,13 +67,45 @@ var IDCache *IdentifierCache
 // LineCache is the global cache for line images
 var LineCache *LineImageCache
 
+// LineBox is the bounding box of a line on its page
+type LineBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"w"`
+	Height int `json:"h"`
+}
+
 // OCRLine contains information about an OCR line
 type OCRLine struct {
 	Identifier       string `json:"id"`
 	ImageURL         string `json:"line"`
 	PreviousImageURL string `json:"previous,omitempty"`
 	NextImageURL     string `json:"next,omitempty"`
+	// Images served by archiscribe, only set in API responses
+	LocalImageURL    string `json:"localLine,omitempty"`
+	PreviousLocalURL string `json:"localPrevious,omitempty"`
+	NextLocalURL     string `json:"localNext,omitempty"`
 	Transcription    string `json:"transcription,omitempty"`
+	PageNumber       int    `json:"pageNumber,omitempty"`
+	// Label and identifier of the page's canvas in the IIIF manifest
+	PageLabel string  `json:"pageLabel,omitempty"`
+	CanvasID  string  `json:"canvas,omitempty"`
+	Box       LineBox `json:"box"`
+	// Derived transcription levels, generated from the (diplomatic)
+	// transcription and stored in side files
+	Levels map[string]string `json:"levels,omitempty"`
+	// Flags set by the transcriber, e.g. "illegible", and a free-text note
+	Flags []string `json:"flags,omitempty"`
+	Note  string   `json:"note,omitempty"`
+	// Slope of the baseline, estimated from the ABBYY character boxes
+	Skew float64 `json:"skew,omitempty"`
+	// Set if the line was split or merged from the ABBYY lines
+	Provenance *LineProvenance `json:"provenance,omitempty"`
+	// OCR text, mean character confidence (0-1, -1 if unknown) and block
+	// type from the ABBYY output, only used for filtering and picking lines
+	OCRText    string  `json:"-"`
+	Confidence float64 `json:"-"`
+	BlockType  string  `json:"-"`
 }
 
 // TaskDefinition encodes a finished transcription along with author information
@@ -193,8 +242,9 @@ func createReadme(repoPath string) string {
 	return out.String()
 }
 
-// InitCache initializes global identifier cache
-func InitCache() {
+// InitCache initializes the global identifier and line image caches, the
+// identifier cache is imported from a legacy JSON file if it is empty
+func InitCache(lineCacheOptions LineCacheOptions) {
 	cacheDir, isSet := os.LookupEnv("ARCHISCRIBE_CACHE")
 	if !isSet {
 		cacheDir = "./cache"
@@ -213,17 +263,28 @@ func InitCache() {
 			Str("cacheDir", cacheDir).
 			Msg("Could not set up cache directory")
 	}
-	LineCache = NewLineImageCache(cacheDir)
-	idCacheFile := filepath.Join(cacheDir, "identifiers.json")
-	if _, err := os.Stat(idCacheFile); err != nil {
-		fmt.Println("Caching identifiers...")
-		cache, err := CacheIdentifiers(idCacheFile)
-		if err != nil {
-			panic(err)
-		}
-		IDCache = cache
-	} else {
-		IDCache = LoadIdentifierCache(idCacheFile)
+	LineCache = NewLineImageCache(cacheDir, lineCacheOptions)
+	idCacheFile := filepath.Join(cacheDir, "identifiers.db")
+	cache, err := OpenIdentifierCache(idCacheFile)
+	if err != nil {
+		log.Panic().
+			Err(err).
+			Str("idCacheFile", idCacheFile).
+			Msg("Could not open identifier cache")
+	}
+	IDCache = cache
+	if IDCache.Count() > 0 {
+		return
+	}
+	// An empty cache is otherwise filled from the sources of the corpus once
+	// the document store is opened
+	legacyCacheFile := filepath.Join(cacheDir, "identifiers.json")
+	if _, err := os.Stat(legacyCacheFile); err != nil {
+		return
+	}
+	fmt.Println("Importing identifiers...")
+	if err := IDCache.ImportJSON(legacyCacheFile); err != nil {
+		panic(err)
 	}
 }
 
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"unicode"
+)
+
+// Names of the available line sampling strategies
+const (
+	SampleUniform       = "uniform"
+	SampleContiguous    = "contiguous"
+	SampleStratified    = "stratified"
+	SampleLowConfidence = "lowconf"
+	SampleRareChars     = "rarechars"
+)
+
+// LineSampler picks the lines for a transcription task from all lines of
+// a volume
+type LineSampler interface {
+	Sample(lines []OCRLine, taskSize int) []OCRLine
+}
+
+// NewLineSampler returns the sampler for the given strategy name
+func NewLineSampler(strategy string) (LineSampler, error) {
+	switch strategy {
+	case "", SampleUniform:
+		return UniformSampler{}, nil
+	case SampleContiguous:
+		return ContiguousSampler{}, nil
+	case SampleStratified:
+		return StratifiedSampler{}, nil
+	case SampleLowConfidence:
+		return LowConfidenceSampler{}, nil
+	case SampleRareChars:
+		return RareCharsSampler{}, nil
+	}
+	return nil, fmt.Errorf("Unknown sampling strategy '%s'", strategy)
+}
+
+// pickLines returns the lines at the given indexes in the order in which
+// they appear in the volume
+func pickLines(lines []OCRLine, idxes []int) []OCRLine {
+	sort.Ints(idxes)
+	picked := make([]OCRLine, 0, len(idxes))
+	for _, idx := range idxes {
+		picked = append(picked, lines[idx])
+	}
+	return picked
+}
+
+// UniformSampler picks lines uniformly at random across the whole volume
+type UniformSampler struct{}
+
+// Sample picks taskSize random lines
+func (UniformSampler) Sample(lines []OCRLine, taskSize int) []OCRLine {
+	idxes := rand.Perm(len(lines))
+	if taskSize < len(idxes) {
+		idxes = idxes[:taskSize]
+	}
+	return pickLines(lines, idxes)
+}
+
+// ContiguousSampler picks a block of consecutive lines starting at a random
+// position, which gives volunteers more context and yields running text
+type ContiguousSampler struct{}
+
+// Sample picks taskSize consecutive lines
+func (ContiguousSampler) Sample(lines []OCRLine, taskSize int) []OCRLine {
+	if taskSize >= len(lines) {
+		return append([]OCRLine(nil), lines...)
+	}
+	start := rand.Intn(len(lines) - taskSize + 1)
+	return append([]OCRLine(nil), lines[start:start+taskSize]...)
+}
+
+// StratifiedSampler spreads the picked lines evenly across the pages of
+// the volume
+type StratifiedSampler struct{}
+
+// Sample picks one random line from each page in random page order, and
+// repeats that until taskSize lines were picked
+func (StratifiedSampler) Sample(lines []OCRLine, taskSize int) []OCRLine {
+	pageLines := map[int][]int{}
+	pages := []int{}
+	for idx, line := range lines {
+		if _, ok := pageLines[line.PageNumber]; !ok {
+			pages = append(pages, line.PageNumber)
+		}
+		pageLines[line.PageNumber] = append(pageLines[line.PageNumber], idx)
+	}
+	for _, idxes := range pageLines {
+		rand.Shuffle(len(idxes), func(i, j int) {
+			idxes[i], idxes[j] = idxes[j], idxes[i]
+		})
+	}
+	rand.Shuffle(len(pages), func(i, j int) {
+		pages[i], pages[j] = pages[j], pages[i]
+	})
+	picked := make([]int, 0, taskSize)
+	for round := 0; len(picked) < taskSize && len(picked) < len(lines); round++ {
+		for _, page := range pages {
+			if len(picked) == taskSize {
+				break
+			}
+			if round < len(pageLines[page]) {
+				picked = append(picked, pageLines[page][round])
+			}
+		}
+	}
+	return pickLines(lines, picked)
+}
+
+// LowConfidenceSampler picks the lines the OCR engine was least confident
+// about, these are the ones where ground truth helps the most
+type LowConfidenceSampler struct{}
+
+// Sample picks the taskSize lines with the lowest mean character confidence,
+// lines without confidence information are picked last
+func (LowConfidenceSampler) Sample(lines []OCRLine, taskSize int) []OCRLine {
+	// Shuffle first, so lines with equal confidence are picked at random
+	idxes := rand.Perm(len(lines))
+	sort.SliceStable(idxes, func(i, j int) bool {
+		a, b := lines[idxes[i]].Confidence, lines[idxes[j]].Confidence
+		if a < 0 || b < 0 {
+			return b < 0 && a >= 0
+		}
+		return a < b
+	})
+	if taskSize < len(idxes) {
+		idxes = idxes[:taskSize]
+	}
+	return pickLines(lines, idxes)
+}
+
+// RareCharsSampler picks the lines whose OCR text contains the characters
+// that are rarest in the volume
+type RareCharsSampler struct{}
+
+// Sample picks the taskSize lines with the highest character rarity score
+func (RareCharsSampler) Sample(lines []OCRLine, taskSize int) []OCRLine {
+	charCounts := map[rune]int{}
+	for _, line := range lines {
+		for _, c := range line.OCRText {
+			if !unicode.IsSpace(c) {
+				charCounts[c]++
+			}
+		}
+	}
+	scores := make([]float64, len(lines))
+	for idx, line := range lines {
+		seen := map[rune]bool{}
+		for _, c := range line.OCRText {
+			if unicode.IsSpace(c) || seen[c] {
+				continue
+			}
+			seen[c] = true
+			scores[idx] += 1.0 / float64(charCounts[c])
+		}
+	}
+	idxes := rand.Perm(len(lines))
+	sort.SliceStable(idxes, func(i, j int) bool {
+		return scores[idxes[i]] > scores[idxes[j]]
+	})
+	if taskSize < len(idxes) {
+		idxes = idxes[:taskSize]
+	}
+	return pickLines(lines, idxes)
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+)
+
+// sampleVolume builds a volume with the given number of lines on every page,
+// the identifiers of the lines are their index in the volume
+func sampleVolume(linesPerPage ...int) []OCRLine {
+	lines := []OCRLine{}
+	for pageIdx, numLines := range linesPerPage {
+		for i := 0; i < numLines; i++ {
+			lines = append(lines, OCRLine{
+				Identifier: fmt.Sprint(len(lines)),
+				PageNumber: pageIdx + 1,
+				Confidence: -1,
+			})
+		}
+	}
+	return lines
+}
+
+// lineIndexes returns the positions of the sampled lines in the volume
+func lineIndexes(t *testing.T, sample []OCRLine) []int {
+	t.Helper()
+	idxes := make([]int, len(sample))
+	for i, line := range sample {
+		if _, err := fmt.Sscan(line.Identifier, &idxes[i]); err != nil {
+			t.Fatalf("Unexpected line %q", line.Identifier)
+		}
+	}
+	return idxes
+}
+
+func TestSamplersPickDistinctLinesInVolumeOrder(t *testing.T) {
+	for _, strategy := range []string{
+		SampleUniform, SampleContiguous, SampleStratified, SampleLowConfidence,
+		SampleRareChars} {
+		sampler, err := NewLineSampler(strategy)
+		if err != nil {
+			t.Fatalf("NewLineSampler(%q) failed: %s", strategy, err)
+		}
+		for _, taskSize := range []int{0, 1, 7, 30, 100} {
+			lines := sampleVolume(10, 3, 0, 12)
+			sample := sampler.Sample(lines, taskSize)
+			wantLen := taskSize
+			if wantLen > len(lines) {
+				wantLen = len(lines)
+			}
+			if len(sample) != wantLen {
+				t.Errorf("%s: Sample(%d) returned %d lines, want %d",
+					strategy, taskSize, len(sample), wantLen)
+			}
+			idxes := lineIndexes(t, sample)
+			for i := 1; i < len(idxes); i++ {
+				if idxes[i] <= idxes[i-1] {
+					t.Errorf("%s: Sample(%d) = %v, not distinct and in order",
+						strategy, taskSize, idxes)
+					break
+				}
+			}
+		}
+	}
+	if _, err := NewLineSampler("best"); err == nil {
+		t.Error("NewLineSampler(best) did not fail")
+	}
+}
+
+func TestContiguousSamplerPicksABlock(t *testing.T) {
+	lines := sampleVolume(40)
+	for i := 0; i < 50; i++ {
+		idxes := lineIndexes(t, ContiguousSampler{}.Sample(lines, 10))
+		if idxes[len(idxes)-1]-idxes[0] != 9 {
+			t.Fatalf("Sample() = %v, want consecutive lines", idxes)
+		}
+	}
+}
+
+func TestStratifiedSamplerSpreadsAcrossPages(t *testing.T) {
+	// The page with most lines must not get a second one before every page
+	// has one, and the page with a single line can not get another
+	lines := sampleVolume(20, 1, 2)
+	for i := 0; i < 50; i++ {
+		perPage := map[int]int{}
+		for _, line := range (StratifiedSampler{}).Sample(lines, 3) {
+			perPage[line.PageNumber]++
+		}
+		if perPage[1] != 1 || perPage[2] != 1 || perPage[3] != 1 {
+			t.Fatalf("Lines per page = %v, want one for every page", perPage)
+		}
+		perPage = map[int]int{}
+		for _, line := range (StratifiedSampler{}).Sample(lines, 5) {
+			perPage[line.PageNumber]++
+		}
+		if perPage[1] != 2 || perPage[2] != 1 || perPage[3] != 2 {
+			t.Fatalf("Lines per page = %v, want 2, 1 and 2", perPage)
+		}
+	}
+}
+
+func TestLowConfidenceSamplerPrefersUncertainLines(t *testing.T) {
+	lines := sampleVolume(6)
+	for i, conf := range []float64{0.9, -1, 0.2, 0.5, -1, 0.1} {
+		lines[i].Confidence = conf
+	}
+	got := lineIndexes(t, LowConfidenceSampler{}.Sample(lines, 3))
+	if fmt.Sprint(got) != "[2 3 5]" {
+		t.Errorf("Sample(3) = %v, want [2 3 5]", got)
+	}
+	// Lines without confidence come after all others
+	got = lineIndexes(t, LowConfidenceSampler{}.Sample(lines, 5))
+	if fmt.Sprint(got) != "[0 1 2 3 5]" && fmt.Sprint(got) != "[0 2 3 4 5]" {
+		t.Errorf("Sample(5) = %v, want one of the lines without confidence", got)
+	}
+}
+
+func TestRareCharsSamplerPrefersRareCharacters(t *testing.T) {
+	lines := sampleVolume(4)
+	lines[0].OCRText = "und die"
+	lines[1].OCRText = "die und"
+	lines[2].OCRText = "und ꝛc"
+	lines[3].OCRText = "die"
+	got := lineIndexes(t, RareCharsSampler{}.Sample(lines, 1))
+	if len(got) != 1 || got[0] != 2 {
+		t.Errorf("Sample(1) = %v, want [2]", got)
+	}
+}
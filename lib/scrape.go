@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"compress/gzip"
 	"fmt"
+	"html"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"unicode"
 
 	simplejson "github.com/bitly/go-simplejson"
 	"github.com/rs/zerolog/log"
@@ -30,7 +32,52 @@ type ProgressMessage struct {
 	BytesRead  int64   `json:"bytesRead,omitempty"`
 	PageNumber int     `json:"pageNumber,omitempty"`
 	LineNumber int     `json:"lineNumber,omitempty"`
-	Error      error   `json:"error,omitempty"`
+	// Number of rejected lines by the reason for the rejection
+	Rejected map[string]int `json:"rejected,omitempty"`
+	Error    error          `json:"error,omitempty"`
+}
+
+// lineChannels carries the progress and the lines of a volume from a worker
+// to the consumer of FetchLines, until the consumer closes done
+type lineChannels struct {
+	progress chan ProgressMessage
+	lines    chan []OCRLine
+	done     <-chan struct{}
+}
+
+func newLineChannels(done <-chan struct{}) lineChannels {
+	return lineChannels{
+		progress: make(chan ProgressMessage),
+		lines:    make(chan []OCRLine),
+		done:     done,
+	}
+}
+
+// sendProgress reports whether the message was received, workers stop once
+// the consumer is gone
+func (c lineChannels) sendProgress(msg ProgressMessage) bool {
+	select {
+	case c.progress <- msg:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c lineChannels) sendLines(lines []OCRLine) bool {
+	select {
+	case c.lines <- lines:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// close both channels, consumers wait for them to be closed, also after
+// errors
+func (c lineChannels) close() {
+	close(c.progress)
+	close(c.lines)
 }
 
 func grabNext(totalOnly bool, count int, cursor string) (*Result, error) {
@@ -43,6 +90,9 @@ func grabNext(totalOnly bool, count int, cursor string) (*Result, error) {
 	} else if cursor != "" {
 		params.Set("cursor", cursor)
 	}
+	if count > 0 {
+		params.Set("count", strconv.Itoa(count))
+	}
 	searchURL := "https://archive.org/services/search/v1/scrape?" + params.Encode()
 	resp, err := http.Get(searchURL)
 	if err != nil {
@@ -79,21 +129,24 @@ func getYear(doc *simplejson.Json) int {
 	return -1
 }
 
-// CacheIdentifiers scrapes the Archive.org API and caches information about
-// relevant identifiers and their number of pages
-func CacheIdentifiers(path string) (*IdentifierCache, error) {
-	cache := NewIdentifierCache(path)
+// ScrapeIdentifiers pages through the Archive.org Scraping API with its
+// cursor and returns all relevant identifiers and their number of pages
+func ScrapeIdentifiers(showProgress bool) ([]IdentifierCacheEntry, error) {
 	res, err := grabNext(true, -1, "")
 	if err != nil {
 		return nil, err
 	}
 	numTotal := res.total
 
-	progressBar := pb.New(numTotal)
-	progressBar.SetWidth(80)
-	progressBar.Start()
+	var progressBar *pb.ProgressBar
+	if showProgress {
+		progressBar = pb.New(numTotal)
+		progressBar.SetWidth(80)
+		progressBar.Start()
+	}
 	processedCount := 0
 	var cursor string
+	entries := make([]IdentifierCacheEntry, 0)
 	for processedCount < numTotal {
 		res, err := grabNext(false, 10000, cursor)
 		if err != nil {
@@ -106,15 +159,25 @@ func CacheIdentifiers(path string) (*IdentifierCache, error) {
 			if err != nil || numPages < 50 {
 				continue
 			}
-			cache.Add(itm.Get("identifier").MustString(), numPages, year)
+			entries = append(entries, IdentifierCacheEntry{
+				Identifier: itm.Get("identifier").MustString(),
+				NumPages:   numPages,
+				Year:       year})
 		}
 		cursor = res.cursor
 		processedCount += res.count
-		progressBar.Add(res.count)
+		if progressBar != nil {
+			progressBar.Add(res.count)
+		}
+		if cursor == "" {
+			// Last page
+			break
+		}
+	}
+	if progressBar != nil {
+		progressBar.Finish()
 	}
-	cache.Write()
-	progressBar.Finish()
-	return cache, nil
+	return entries, nil
 }
 
 // GetMetadata fetches metadata for identifier from Archive.org
@@ -141,10 +204,14 @@ func IsFraktur(ident string) (bool, error) {
 	resp, err := http.Get(ocrURL)
 	if err != nil {
 		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Volumes without OCR text can not be used
+		return false, nil
 	} else if resp.StatusCode > 200 {
 		return false, fmt.Errorf("Status %d while getting %s", resp.StatusCode, ocrURL)
 	}
-	defer resp.Body.Close()
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Split(bufio.ScanWords)
 	numIft := 0
@@ -158,21 +225,27 @@ func IsFraktur(ident string) (bool, error) {
 	return numIft > 5, nil
 }
 
-// GetStartPageNumber determines whether an identifier's first page has
-// index 0 or 1
-func GetStartPageNumber(ident string) int {
-	infoURL := fmt.Sprintf("https://iiif.archivelab.org/iiif/%s$0/info.json",
-		ident)
-	resp, err := http.Get(infoURL)
-	if err != nil {
-		return 0
-	} else if resp.StatusCode > 200 {
-		return 1
-	}
-	return 0
+// pageCountMismatch logs and reports a volume whose OCR does not have the
+// same number of pages as its manifest has canvases
+func pageCountMismatch(ident string, numPages int, numCanvases int, out lineChannels) {
+	log.Error().
+		Str("archiveId", ident).
+		Int("numPages", numPages).
+		Int("numCanvases", numCanvases).
+		Msg("Number of OCR pages does not match the manifest")
+	out.sendProgress(ProgressMessage{Error: ErrPageCountMismatch, Step: "fetch"})
 }
 
-func fetchLinesWorker(ident string, minLineWidth int, progressChan chan ProgressMessage, linesChan chan []OCRLine) {
+func fetchLinesWorker(ident string, config *CorpusConfig, out lineChannels) {
+	defer out.close()
+	// The canvases of the manifest are in the same order as the OCR pages
+	// and tell us the page numbers in the IIIF URLs
+	manifest, err := FetchManifest(ManifestURL(ident))
+	if err != nil {
+		out.sendProgress(ProgressMessage{Error: err, Step: "fetch"})
+		return
+	}
+	pageLabels, pageRanges := manifest.PageLabels()
 	log.Info().
 		Str("archiveId", ident).
 		Msg("Getting ABBY OCR")
@@ -180,12 +253,12 @@ func fetchLinesWorker(ident string, minLineWidth int, progressChan chan Progress
 		ident, ident)
 	resp, err := http.Get(boxURL)
 	if err != nil {
-		progressChan <- ProgressMessage{Error: err, Step: "fetch"}
+		out.sendProgress(ProgressMessage{Error: err, Step: "fetch"})
 		return
 	} else if resp.StatusCode > 200 {
-		progressChan <- ProgressMessage{
+		out.sendProgress(ProgressMessage{
 			Error: fmt.Errorf("Status %d while getting %s", resp.StatusCode, boxURL),
-			Step:  "fetch"}
+			Step:  "fetch"})
 		return
 	}
 	numBytesTotal := resp.ContentLength
@@ -201,78 +274,213 @@ func fetchLinesWorker(ident string, minLineWidth int, progressChan chan Progress
 	lineScanner.Split(bufio.ScanLines)
 	buf := make([]byte, 64*1024)
 	lineScanner.Buffer(buf, 16*1024*1024)
-	lines := make([]OCRLine, 0)
+	// Lines are collected per page, since we can only decide which pages
+	// to use once we know the layout of the whole volume
+	pages := make([]PageInfo, 0)
+	pageLines := make([][]OCRLine, 0)
 	numLines := 0
-	currentPageNo := GetStartPageNumber(ident) - 1
-	pageWidth := -1
-	pageHeight := -1
 	progPercent := 0
+	// Line that is currently being parsed, nil if it is skipped
+	var current *OCRLine
+	var currentBlockType string
+	var ocrText []rune
+	confidenceSum := 0
+	numConfident := 0
+	var charBoxes []LineBox
 	for lineScanner.Scan() {
 		numLines++
-		line := lineScanner.Text()
-		if strings.Contains(line, "<page") {
-			match := pagePat.FindStringSubmatch(line)
-			pageWidth, _ = strconv.Atoi(match[1])
-			pageHeight, _ = strconv.Atoi(match[2])
-			currentPageNo++
-		}
-		if !strings.Contains(line, "<line") {
-			continue
-		}
-		prct := int(100. * float64(progReader.BytesRead) / float64(numBytesTotal))
-		if prct > progPercent {
-			progPercent = prct
-			progressChan <- ProgressMessage{
-				Step:       "fetch",
-				Progress:   float64(progReader.BytesRead) / float64(numBytesTotal),
-				BytesTotal: numBytesTotal,
-				BytesRead:  progReader.BytesRead,
-				PageNumber: currentPageNo,
-				LineNumber: numLines,
-				Error:      nil,
+		for _, tag := range abbyyTagPat.FindAllString(lineScanner.Text(), -1) {
+			var page *PageInfo
+			if len(pages) > 0 {
+				page = &pages[len(pages)-1]
+			}
+			switch {
+			case strings.HasPrefix(tag, "<page"):
+				match := pagePat.FindStringSubmatch(tag)
+				width, _ := strconv.Atoi(match[1])
+				height, _ := strconv.Atoi(match[2])
+				newPage := PageInfo{Index: len(pages), Width: width, Height: height}
+				if newPage.Index >= len(manifest.Canvases) {
+					pageCountMismatch(ident, newPage.Index+1, len(manifest.Canvases), out)
+					return
+				}
+				if manifest.Canvases[newPage.Index].PageNumber < 0 {
+					out.sendProgress(ProgressMessage{
+						Error: fmt.Errorf("No page number for canvas %s",
+							manifest.Canvases[newPage.Index].ID),
+						Step: "fetch"})
+					return
+				}
+				newPage.Label = pageLabels[newPage.Index]
+				newPage.Ranges = pageRanges[newPage.Index]
+				pages = append(pages, newPage)
+				pageLines = append(pageLines, nil)
+			case strings.HasPrefix(tag, "<block"):
+				match := blockPat.FindStringSubmatch(tag)
+				if match == nil || page == nil {
+					continue
+				}
+				currentBlockType = match[1]
+				x, _ := strconv.Atoi(match[2])
+				y, _ := strconv.Atoi(match[3])
+				lrx, _ := strconv.Atoi(match[4])
+				lry, _ := strconv.Atoi(match[5])
+				area := (lrx - x) * (lry - y)
+				switch match[1] {
+				case "Text":
+					page.TextArea += area
+				case "Picture":
+					page.PictureArea += area
+				case "Table":
+					page.TableArea += area
+				}
+			case strings.HasPrefix(tag, "<line"):
+				current = nil
+				if page == nil {
+					continue
+				}
+				page.NumLines++
+				canvas := manifest.Canvases[page.Index]
+				currentPageNo := canvas.PageNumber
+				prct := int(100. * float64(progReader.BytesRead) / float64(numBytesTotal))
+				if prct > progPercent {
+					progPercent = prct
+					isReceived := out.sendProgress(ProgressMessage{
+						Step:       "fetch",
+						Progress:   float64(progReader.BytesRead) / float64(numBytesTotal),
+						BytesTotal: numBytesTotal,
+						BytesRead:  progReader.BytesRead,
+						PageNumber: currentPageNo,
+						LineNumber: numLines,
+						Error:      nil,
+					})
+					if !isReceived {
+						return
+					}
+				}
+				match := linePat.FindStringSubmatch(tag)
+				if match == nil {
+					continue
+				}
+				x, _ := strconv.Atoi(match[1])
+				y, _ := strconv.Atoi(match[2])
+				lrx, _ := strconv.Atoi(match[3])
+				lry, _ := strconv.Atoi(match[4])
+				box := LineBox{X: x, Y: y, Width: lrx - x, Height: lry - y}.Pad(
+					config.Crop.Padding, page.Width, page.Height)
+				iiifURL := lineImageURL(ident, currentPageNo, box)
+				current = &OCRLine{
+					Identifier: Sha1Digest([]byte(iiifURL)),
+					ImageURL:   iiifURL,
+					PageNumber: currentPageNo,
+					PageLabel:  canvas.Label,
+					CanvasID:   canvas.ID,
+					Box:        box,
+					BlockType:  currentBlockType,
+				}
+				ocrText = ocrText[:0]
+				confidenceSum = 0
+				numConfident = 0
+				charBoxes = charBoxes[:0]
+			case strings.HasPrefix(tag, "<charParams"):
+				if current == nil {
+					continue
+				}
+				match := charPat.FindStringSubmatch(tag)
+				ocrText = append(ocrText, []rune(html.UnescapeString(match[2]))...)
+				if boxMatch := charBoxPat.FindStringSubmatch(match[1]); boxMatch != nil {
+					l, _ := strconv.Atoi(boxMatch[1])
+					t, _ := strconv.Atoi(boxMatch[2])
+					r, _ := strconv.Atoi(boxMatch[3])
+					b, _ := strconv.Atoi(boxMatch[4])
+					charBoxes = append(charBoxes, LineBox{X: l, Y: t, Width: r - l, Height: b - t})
+				}
+				if confMatch := charConfidencePat.FindStringSubmatch(match[1]); confMatch != nil {
+					if conf, _ := strconv.Atoi(confMatch[1]); conf >= 0 {
+						confidenceSum += conf
+						numConfident++
+					}
+				}
+			case tag == "</line>":
+				if current == nil {
+					continue
+				}
+				current.OCRText = strings.TrimSpace(string(ocrText))
+				for _, c := range current.OCRText {
+					if unicode.IsSpace(c) {
+						continue
+					}
+					page.NumChars++
+					if unicode.IsDigit(c) {
+						page.NumDigits++
+					}
+				}
+				current.Skew = estimateSkew(charBoxes, current.Box.Height)
+				current.Confidence = -1
+				if numConfident > 0 {
+					current.Confidence = float64(confidenceSum) / float64(numConfident) / 100.
+				}
+				pageLines[page.Index] = append(pageLines[page.Index], *current)
+				current = nil
 			}
 		}
-		if currentPageNo <= 10 { // TODO: Should be dynamic or from constant
+	}
+
+	if len(pages) != len(manifest.Canvases) {
+		pageCountMismatch(ident, len(pages), len(manifest.Canvases), out)
+		return
+	}
+	selectLines(ident, config, pages, pageLines, out)
+}
+
+// selectLines classifies the pages of a volume, filters the lines on the
+// pages that are not skipped and sends them to the consumer
+func selectLines(ident string, config *CorpusConfig, pages []PageInfo, pageLines [][]OCRLine, out lineChannels) {
+	lines := make([]OCRLine, 0)
+	skippedPages := map[PageClass]int{}
+	filters := NewLineFilters(config)
+	rejected := map[string]int{}
+	for _, page := range pages {
+		class := ClassifyPage(page, len(pages), config.Pages)
+		if page.Index < config.Pages.SkipFirst ||
+			page.Index >= len(pages)-config.Pages.SkipLast ||
+			config.Pages.Skips(class) {
+			skippedPages[class]++
 			continue
 		}
-		matches := linePat.FindAllStringSubmatch(line, -1)
-		for _, match := range matches {
-			x, _ := strconv.Atoi(match[1])
-			y, _ := strconv.Atoi(match[2])
-			lrx, _ := strconv.Atoi(match[3])
-			lry, _ := strconv.Atoi(match[4])
-			width := lrx - x
-			height := lry - y
-			relX := float64(x) / float64(pageWidth)
-			relY := float64(y) / float64(pageHeight)
-			if width < minLineWidth || (relX > 0.65 && relY > 0.90) {
-				continue
-			}
-			iiifURL := fmt.Sprintf(
-				"https://iiif.archivelab.org/iiif/%s$%d/%d,%d,%d,%d/full/0/default.png",
-				ident, currentPageNo, x, y, width, height)
+		for _, line := range FilterLines(pageLines[page.Index], page, filters, rejected) {
 			if len(lines) > 0 {
-				lines[len(lines)-1].NextImageURL = iiifURL
+				lines[len(lines)-1].NextImageURL = line.ImageURL
+				line.PreviousImageURL = lines[len(lines)-1].ImageURL
 			}
-			l := OCRLine{
-				Identifier: Sha1Digest([]byte(iiifURL)),
-				ImageURL:   iiifURL,
-			}
-			if len(lines) > 0 {
-				l.PreviousImageURL = lines[len(lines)-1].ImageURL
-			}
-			lines = append(lines, l)
+			lines = append(lines, line)
 		}
 	}
-	linesChan <- lines
-	close(linesChan)
-	close(progressChan)
+	logger := log.Info().
+		Str("identifier", ident).
+		Int("numPages", len(pages)).
+		Int("numLines", len(lines))
+	for class, count := range skippedPages {
+		logger = logger.Int("skipped_"+string(class), count)
+	}
+	for reason, count := range rejected {
+		logger = logger.Int("rejected_"+reason, count)
+	}
+	logger.Msg("Classified pages and filtered lines")
+	isReceived := out.sendProgress(ProgressMessage{
+		Step:     "filter",
+		Progress: 1,
+		Rejected: rejected,
+	})
+	if isReceived {
+		out.sendLines(lines)
+	}
 }
 
-// FetchLines fetches OCR lines for a given Archive.org identifier
-func FetchLines(ident string) (chan ProgressMessage, chan []OCRLine) {
-	progressChan := make(chan ProgressMessage)
-	lineChan := make(chan []OCRLine)
-	go fetchLinesWorker(ident, 200, progressChan, lineChan)
-	return progressChan, lineChan
+// FetchLines fetches OCR lines for a given Archive.org identifier, it stops
+// once done is closed
+func FetchLines(ident string, config *CorpusConfig, done <-chan struct{}) (chan ProgressMessage, chan []OCRLine) {
+	out := newLineChannels(done)
+	go fetchLinesWorker(ident, config, out)
+	return out.progress, out.lines
 }
@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+// SourceArchive is the name of the Archive.org source, documents without a
+// source are from Archive.org
+const SourceArchive = "archive.org"
+
+// Names of sources are used as the prefix of their identifiers, which can
+// not contain underscores
+var sourceNamePat = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// ErrUnknownSource is returned for sources that are not configured
+var ErrUnknownSource = errors.New("Unknown source")
+
+// Source is a repository that volumes and their OCR are ingested from
+type Source interface {
+	// Name of the source, recorded on documents and identifier cache entries
+	Name() string
+	// Volumes lists the candidate volumes for the identifier cache
+	Volumes(showProgress bool) ([]IdentifierCacheEntry, error)
+	// Metadata returns a document without lines for a volume
+	Metadata(volume IdentifierCacheEntry) (*Document, error)
+	// IsSuitable checks if lines should be taken from a volume, e.g. if it
+	// is set in Fraktur
+	IsSuitable(volume IdentifierCacheEntry) (bool, error)
+	// FetchLines parses the layout of a volume into lines and picks the
+	// lines that can be used for tasks, it stops without sending anything
+	// else once done is closed
+	FetchLines(volume IdentifierCacheEntry, config *CorpusConfig, done <-chan struct{}) (chan ProgressMessage, chan []OCRLine)
+	// CropURL returns the URL of the image for a box on the page of a line
+	CropURL(ident string, line OCRLine, box LineBox) string
+	// PageURL returns the URL of the full image for the page of a line
+	PageURL(ident string, line OCRLine) string
+	// DetailsURL and ViewerURL link to the page of a document at the source
+	// and to a viewer for it, they are empty if there is none
+	DetailsURL(doc *Document) string
+	ViewerURL(doc *Document) string
+}
+
+// SourcesConfig controls which sources volumes are ingested from
+type SourcesConfig struct {
+	// Pick volumes from Archive.org
+	Archive bool `json:"archive"`
+	// Repositories that publish IIIF manifests with ALTO or hOCR
+	IIIF []IIIFSourceConfig `json:"iiif"`
+	// Directories with page images and their hOCR, ALTO or PAGE
+	Local []LocalSourceConfig `json:"local"`
+}
+
+// newSources creates all configured sources by their name, the directories
+// of local sources are relative to the corpus at basePath
+func newSources(config SourcesConfig, basePath string) (map[string]Source, error) {
+	sources := map[string]Source{}
+	if config.Archive {
+		sources[SourceArchive] = &archiveSource{}
+	}
+	for _, iiifConfig := range config.IIIF {
+		if err := checkSourceName(sources, iiifConfig.Name); err != nil {
+			return nil, err
+		}
+		sources[iiifConfig.Name] = &iiifSource{iiifConfig}
+	}
+	for _, localConfig := range config.Local {
+		if err := checkSourceName(sources, localConfig.Name); err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(localConfig.Path) {
+			localConfig.Path = filepath.Join(basePath, localConfig.Path)
+		}
+		source, err := newLocalSource(localConfig)
+		if err != nil {
+			return nil, err
+		}
+		sources[localConfig.Name] = source
+	}
+	return sources, nil
+}
+
+// checkSourceName makes sure that a source name can be used in identifiers
+// and is not taken yet
+func checkSourceName(sources map[string]Source, name string) error {
+	if !sourceNamePat.MatchString(name) {
+		return fmt.Errorf(
+			"Invalid source name '%s', must only consist of letters, digits, '.' and '-'",
+			name)
+	}
+	if _, ok := sources[name]; ok {
+		return fmt.Errorf("Duplicate source '%s'", name)
+	}
+	return nil
+}
+
+// Source returns the source with the given name, an empty name stands for
+// Archive.org
+func (s *DocumentStore) Source(name string) (Source, error) {
+	if name == "" {
+		name = SourceArchive
+	}
+	source, ok := s.sources[name]
+	if !ok {
+		// Documents from Archive.org can still be edited when it is no
+		// longer used for new volumes
+		if name == SourceArchive {
+			return &archiveSource{}, nil
+		}
+		return nil, ErrUnknownSource
+	}
+	return source, nil
+}
+
+// Sources returns all configured sources
+func (s *DocumentStore) Sources() []Source {
+	sources := make([]Source, 0, len(s.sources))
+	for _, source := range s.sources {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// archiveSource ingests volumes with ABBYY OCR from Archive.org and crops
+// their lines via iiif.archivelab.org
+type archiveSource struct{}
+
+func (a *archiveSource) Name() string {
+	return SourceArchive
+}
+
+func (a *archiveSource) Volumes(showProgress bool) ([]IdentifierCacheEntry, error) {
+	return ScrapeIdentifiers(showProgress)
+}
+
+func (a *archiveSource) Metadata(volume IdentifierCacheEntry) (*Document, error) {
+	metadata, err := GetMetadata(volume.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	return &Document{
+		Identifier: volume.Identifier,
+		Title:      metadata.Get("title").MustString(),
+		Year:       volume.Year,
+		Manifest:   ManifestURL(volume.Identifier),
+		Source:     SourceArchive,
+	}, nil
+}
+
+func (a *archiveSource) IsSuitable(volume IdentifierCacheEntry) (bool, error) {
+	return IsFraktur(volume.Identifier)
+}
+
+func (a *archiveSource) FetchLines(volume IdentifierCacheEntry, config *CorpusConfig, done <-chan struct{}) (chan ProgressMessage, chan []OCRLine) {
+	return FetchLines(volume.Identifier, config, done)
+}
+
+func (a *archiveSource) CropURL(ident string, line OCRLine, box LineBox) string {
+	return lineImageURL(ident, line.pageNumber(), box)
+}
+
+func (a *archiveSource) PageURL(ident string, line OCRLine) string {
+	return pageImageURL(ident, line.pageNumber())
+}
+
+func (a *archiveSource) DetailsURL(doc *Document) string {
+	return "http://archive.org/details/" + doc.Identifier
+}
+
+func (a *archiveSource) ViewerURL(doc *Document) string {
+	return "https://iiif.archivelab.org/iiif/" + doc.Identifier
+}
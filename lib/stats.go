@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var transcribedPat = regexp.MustCompile(`^Transcribed (\d+) lines`)
+
+// CountStats holds the number of lines and works for a year or a decade
+type CountStats struct {
+	Key      int `json:"key"`
+	NumLines int `json:"numLines"`
+	NumWorks int `json:"numWorks"`
+}
+
+// WorkStats holds statistics about a single document
+type WorkStats struct {
+	Identifier   string   `json:"id"`
+	Title        string   `json:"title"`
+	Year         int      `json:"year"`
+	Manifest     string   `json:"manifest"`
+	NumLines     int      `json:"numLines"`
+	NumFlagged   int      `json:"numFlagged"`
+	NumChars     int      `json:"numChars"`
+	NumUncertain int      `json:"numUncertain"`
+	NumGaps      int      `json:"numGaps"`
+	Reviewed     bool     `json:"reviewed"`
+	Contributors []string `json:"contributors"`
+}
+
+// ContributorStats holds statistics about a single contributor
+type ContributorStats struct {
+	Name           string `json:"name"`
+	NumSubmissions int    `json:"numSubmissions"`
+	NumTranscribed int    `json:"numTranscribed"`
+	NumReviews     int    `json:"numReviews"`
+}
+
+// SubmissionStats holds the submissions for a single month
+type SubmissionStats struct {
+	Month          string `json:"month"`
+	NumSubmissions int    `json:"numSubmissions"`
+	NumTranscribed int    `json:"numTranscribed"`
+	NumReviews     int    `json:"numReviews"`
+}
+
+// CorpusStats holds aggregate statistics about the corpus, computed at a
+// given commit
+type CorpusStats struct {
+	Commit        string             `json:"commit"`
+	NumLines      int                `json:"numLines"`
+	NumFlagged    int                `json:"numFlagged"`
+	NumWorks      int                `json:"numWorks"`
+	NumYears      int                `json:"numYears"`
+	NumChars      int                `json:"numChars"`
+	NumUncertain  int                `json:"numUncertain"`
+	NumGaps       int                `json:"numGaps"`
+	NumReviewed   int                `json:"numReviewed"`
+	NumUnreviewed int                `json:"numUnreviewed"`
+	Decades       []CountStats       `json:"decades"`
+	Years         []CountStats       `json:"years"`
+	Works         []WorkStats        `json:"works"`
+	Contributors  []ContributorStats `json:"contributors"`
+	Submissions   []SubmissionStats  `json:"submissions"`
+}
+
+// Stats returns the statistics for the current state of the corpus, they
+// are only computed again when the HEAD commit changed
+func (s *DocumentStore) Stats() (*CorpusStats, error) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	head, err := s.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	if s.stats != nil && s.stats.Commit == head {
+		return s.stats, nil
+	}
+	s.stats = ComputeStats(s.ListWithLines())
+	s.stats.Commit = head
+	return s.stats, nil
+}
+
+// ComputeStats aggregates statistics over the given documents, which need
+// to include their lines and history
+func ComputeStats(documents []*Document) *CorpusStats {
+	stats := CorpusStats{
+		Works:        []WorkStats{},
+		Contributors: []ContributorStats{},
+		Submissions:  []SubmissionStats{},
+	}
+	years := map[int]*CountStats{}
+	decades := map[int]*CountStats{}
+	contributors := map[string]*ContributorStats{}
+	months := map[string]*SubmissionStats{}
+	sort.Slice(documents, func(i, j int) bool {
+		if documents[i].Year != documents[j].Year {
+			return documents[i].Year < documents[j].Year
+		}
+		return documents[i].Identifier < documents[j].Identifier
+	})
+	for _, doc := range documents {
+		work := WorkStats{
+			Identifier:   doc.Identifier,
+			Title:        doc.Title,
+			Year:         doc.Year,
+			Manifest:     doc.Manifest,
+			Reviewed:     doc.Reviewed,
+			Contributors: []string{},
+		}
+		work.NumLines, work.NumFlagged = countTranscribed(doc.Lines)
+		for _, line := range doc.Lines {
+			work.NumChars += utf8.RuneCountInString(StripMarkup(line.Transcription, ""))
+			numUncertain, numGaps := CountMarkup(line.Transcription)
+			work.NumUncertain += numUncertain
+			work.NumGaps += numGaps
+		}
+		seenContributors := map[string]bool{}
+		for _, entry := range doc.History {
+			name := entry.Author.Name
+			if _, ok := contributors[name]; !ok {
+				contributors[name] = &ContributorStats{Name: name}
+			}
+			month := entry.Date.Format("2006-01")
+			if _, ok := months[month]; !ok {
+				months[month] = &SubmissionStats{Month: month}
+			}
+			contributors[name].NumSubmissions++
+			months[month].NumSubmissions++
+			if match := transcribedPat.FindStringSubmatch(entry.Subject); match != nil {
+				numTranscribed, _ := strconv.Atoi(match[1])
+				contributors[name].NumTranscribed += numTranscribed
+				months[month].NumTranscribed += numTranscribed
+			} else if strings.HasPrefix(entry.Subject, "Reviewed") {
+				contributors[name].NumReviews++
+				months[month].NumReviews++
+				work.Reviewed = true
+			}
+			if !seenContributors[name] {
+				seenContributors[name] = true
+				work.Contributors = append(work.Contributors, name)
+			}
+		}
+		stats.Works = append(stats.Works, work)
+		stats.NumLines += work.NumLines
+		stats.NumFlagged += work.NumFlagged
+		stats.NumChars += work.NumChars
+		stats.NumUncertain += work.NumUncertain
+		stats.NumGaps += work.NumGaps
+		if work.Reviewed {
+			stats.NumReviewed++
+		} else {
+			stats.NumUnreviewed++
+		}
+		addCount(years, doc.Year, work.NumLines)
+		addCount(decades, (doc.Year/10)*10, work.NumLines)
+	}
+	stats.NumWorks = len(stats.Works)
+	stats.NumYears = len(years)
+	stats.Years = sortedCounts(years)
+	stats.Decades = sortedCounts(decades)
+	for _, contributor := range contributors {
+		stats.Contributors = append(stats.Contributors, *contributor)
+	}
+	sort.Slice(stats.Contributors, func(i, j int) bool {
+		return stats.Contributors[i].NumSubmissions > stats.Contributors[j].NumSubmissions
+	})
+	for _, month := range months {
+		stats.Submissions = append(stats.Submissions, *month)
+	}
+	sort.Slice(stats.Submissions, func(i, j int) bool {
+		return stats.Submissions[i].Month < stats.Submissions[j].Month
+	})
+	return &stats
+}
+
+func addCount(counts map[int]*CountStats, key int, numLines int) {
+	if _, ok := counts[key]; !ok {
+		counts[key] = &CountStats{Key: key}
+	}
+	counts[key].NumLines += numLines
+	counts[key].NumWorks++
+}
+
+func sortedCounts(counts map[int]*CountStats) []CountStats {
+	out := make([]CountStats, 0, len(counts))
+	for _, count := range counts {
+		out = append(out, *count)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,6 +11,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/olekukonko/tablewriter"
@@ -20,20 +20,39 @@ import (
 
 // DocumentStore offers an interface to the transcriptions
 type DocumentStore struct {
-	basePath string
-	repo     *GitRepo
+	basePath   string
+	repo       *GitRepo
+	Config     *CorpusConfig
+	normalizer *Normalizer
+	levels     []transcriptionLevel
+	sources    map[string]Source
+	// Serializes the changes to the repository, every change cleans up the
+	// working tree, writes and stages its files and commits them
+	writeMutex sync.Mutex
+	// Guards the statistics and coverage, which are cached until the next
+	// commit
+	statsMutex sync.Mutex
+	stats      *CorpusStats
+	coverage   *CoverageReport
 }
 
 // Document holds all information about a transcription document
 type Document struct {
-	Identifier string     `json:"id"`
-	Title      string     `json:"title"`
-	Year       int        `json:"year"`
-	Manifest   string     `json:"manifest"`
-	Lines      []OCRLine  `json:"lines,omitempty"`
-	History    []LogEntry `json:"history,omitempty"`
-	NumLines   int        `json:"numLines,omitempty"`
-	Reviewed   bool       `json:"reviewed"`
+	Identifier string `json:"id"`
+	Title      string `json:"title"`
+	Year       int    `json:"year"`
+	Manifest   string `json:"manifest"`
+	// Name of the source the document was ingested from, empty for
+	// Archive.org
+	Source   string     `json:"source,omitempty"`
+	Lines    []OCRLine  `json:"lines,omitempty"`
+	History  []LogEntry `json:"history,omitempty"`
+	NumLines int        `json:"numLines,omitempty"`
+	// Lines that were only flagged, without a transcription
+	NumFlagged int  `json:"numFlagged,omitempty"`
+	Reviewed   bool `json:"reviewed"`
+	// Transcription guideline violations found on submission, not persisted
+	Violations []Violation `json:"violations,omitempty"`
 }
 
 var lineNamePat = regexp.MustCompile(`(.+?)_([a-z0-9]{8})`)
@@ -44,9 +63,32 @@ func NewDocumentStore(path string) (*DocumentStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	config, err := LoadCorpusConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	normalizer, err := NewNormalizer(config.Normalization)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := newTranscriptionLevels(config.Levels)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImageVariants(config.Preprocess.Variants); err != nil {
+		return nil, err
+	}
+	sources, err := newSources(config.Sources, path)
+	if err != nil {
+		return nil, err
+	}
 	return &DocumentStore{
-		basePath: path,
-		repo:     repo,
+		basePath:   path,
+		repo:       repo,
+		Config:     config,
+		normalizer: normalizer,
+		levels:     levels,
+		sources:    sources,
 	}, nil
 }
 
@@ -73,10 +115,15 @@ func (s *DocumentStore) Details(ident string) *Document {
 	for idx, line := range doc.Lines {
 		textPath := strings.Replace(metaPath, ".json", "_"+line.Identifier+".txt", -1)
 		text, err := ioutil.ReadFile(textPath)
-		if err != nil {
+		if os.IsNotExist(err) {
+			// Flagged line without a transcription
+			continue
+		} else if err != nil {
 			panic(err)
 		}
 		doc.Lines[idx].Transcription = strings.TrimSpace(string(text))
+		doc.Lines[idx].Levels = s.readLevels(
+			strings.TrimSuffix(textPath, ".txt"), doc.Lines[idx].Transcription)
 	}
 	transFiles, err := filepath.Glob(strings.Replace(metaPath, ".json", ".*", -1))
 	if err != nil {
@@ -97,6 +144,15 @@ func (s *DocumentStore) Details(ident string) *Document {
 
 // List all documents
 func (s *DocumentStore) List() []*Document {
+	documents := s.ListWithLines()
+	for _, doc := range documents {
+		doc.Lines = doc.Lines[:0]
+	}
+	return documents
+}
+
+// ListWithLines lists all documents along with their transcribed lines
+func (s *DocumentStore) ListWithLines() []*Document {
 	transPath := filepath.Join(s.basePath, "transcriptions")
 	metaPaths, err := filepath.Glob(filepath.Join(transPath, "*", "*.json"))
 	documents := make([]*Document, 0, len(metaPaths))
@@ -105,8 +161,7 @@ func (s *DocumentStore) List() []*Document {
 	}
 	for _, metaPath := range metaPaths {
 		doc := s.Details(strings.Replace(filepath.Base(metaPath), ".json", "", -1))
-		doc.NumLines = len(doc.Lines)
-		doc.Lines = doc.Lines[:0]
+		doc.NumLines, doc.NumFlagged = countTranscribed(doc.Lines)
 		if doc.Identifier != "" {
 			documents = append(documents, doc)
 		}
@@ -114,11 +169,27 @@ func (s *DocumentStore) List() []*Document {
 	return documents
 }
 
+// countTranscribed counts the lines with a transcription and the flagged
+// lines without one
+func countTranscribed(lines []OCRLine) (numTranscribed int, numFlagged int) {
+	for _, line := range lines {
+		if line.Transcription != "" {
+			numTranscribed++
+		} else if len(line.Flags) > 0 {
+			numFlagged++
+		}
+	}
+	return numTranscribed, numFlagged
+}
+
 func (s *DocumentStore) removeDeletedLines(doc Document) {
 	basePath := filepath.Join(s.basePath, "transcriptions", strconv.Itoa(doc.Year))
 	globPat := basePath + "/" + doc.Identifier + "*.png"
 	lpaths, _ := filepath.Glob(globPat)
 	for _, lpath := range lpaths {
+		if isVariantFile(lpath) {
+			continue
+		}
 		baseName := strings.TrimSuffix(filepath.Base(lpath), filepath.Ext(lpath))
 		match := lineNamePat.FindStringSubmatch(baseName)
 		if len(match) == 0 {
@@ -133,18 +204,34 @@ func (s *DocumentStore) removeDeletedLines(doc Document) {
 			}
 		}
 		if !found {
-			if err := s.repo.Remove(lpath); err != nil {
-				panic(err)
-			}
-			if err := s.repo.Remove(strings.Replace(lpath, ".png", ".txt", -1)); err != nil {
+			if err := s.removeLineData(strings.TrimSuffix(lpath, ".png")); err != nil {
 				panic(err)
 			}
 		}
 	}
 }
 
+// removeLineData removes the image and transcription of a line and all files
+// derived from them from the corpus, if they exist
+func (s *DocumentStore) removeLineData(basePath string) error {
+	for _, path := range []string{basePath + ".png", basePath + ".txt"} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := s.repo.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := s.removeLevels(basePath); err != nil {
+		return err
+	}
+	return s.removeImageVariants(basePath)
+}
+
 // Save a document
 func (s *DocumentStore) Save(doc Document, author string, email string, comment string) (*Document, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
 	logger := log.With().Str("identifier", doc.Identifier).Logger()
 	logger.Info().Msg("Cleaning up repository")
 	if err := s.repo.CleanUp(); err != nil {
@@ -159,8 +246,9 @@ func (s *DocumentStore) Save(doc Document, author string, email string, comment
 		s.basePath, "transcriptions", strconv.Itoa(doc.Year))
 	os.MkdirAll(yearPath, 0755)
 
-	// Clear history, we don't persist it to disk
+	// Clear history and violations, we don't persist them to disk
 	doc.History = doc.History[:0]
+	doc.Violations = nil
 	metaPath := filepath.Join(yearPath, doc.Identifier+".json")
 	isUpdate := false
 	if _, err := os.Stat(metaPath); !os.IsNotExist(err) {
@@ -168,19 +256,32 @@ func (s *DocumentStore) Save(doc Document, author string, email string, comment
 	}
 
 	ident := doc.Identifier
+	// Counted before the transcriptions are dropped from the metadata
+	numTranscribed, numFlagged := countTranscribed(doc.Lines)
 	toRemove := make(map[string]bool)
 	for idx, line := range doc.Lines {
-		if line.Transcription == "" {
+		if line.Transcription == "" && len(line.Flags) == 0 {
 			// Not a transcribed line, removing from document
 			toRemove[line.Identifier] = true
 			continue
 		}
+		if line.Transcription == "" {
+			// Flagged lines without a transcription are only kept in the
+			// metadata, every image in the corpus has its ground truth
+			err := s.removeLineData(filepath.Join(
+				yearPath, fmt.Sprintf("%s_%s", doc.Identifier, line.Identifier)))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 		err := s.writeLineData(doc, line)
 		if err != nil {
 			return nil, err
 		}
 		// We don't store the transcriptions in the JSON
 		doc.Lines[idx].Transcription = ""
+		doc.Lines[idx].Levels = nil
 	}
 	logger.Info().Int("numRemoved", len(toRemove)).Msg("Removed empty lines")
 	filtered := make([]OCRLine, 0, len(doc.Lines)-len(toRemove))
@@ -200,22 +301,12 @@ func (s *DocumentStore) Save(doc Document, author string, email string, comment
 
 	// Write metadata
 	logger.Info().Msg("Writing metadata")
-	metaOut, _ := os.Create(metaPath)
-	enc := json.NewEncoder(metaOut)
-	enc.SetIndent("", "  ")
-	enc.Encode(doc)
-	metaOut.Close()
-	if err := s.repo.Add(metaPath); err != nil {
+	if err := s.writeMetadata(doc); err != nil {
 		return nil, err
 	}
 
 	logger.Info().Msg("Creating README")
-	readme := s.createReadme()
-	readmePath := filepath.Join(s.basePath, "README.md")
-	readmeOut, _ := os.Create(readmePath)
-	readmeOut.WriteString(readme)
-	readmeOut.Close()
-	if err := s.repo.Add(readmePath); err != nil {
+	if err := s.writeReadme(); err != nil {
 		return nil, err
 	}
 	var commitMessage string
@@ -231,7 +322,8 @@ func (s *DocumentStore) Save(doc Document, author string, email string, comment
 		numModified := 0
 		numDeleted := 0
 		for fname, change := range changes {
-			if !strings.HasSuffix(fname, ".txt") {
+			// Side files of levels change with the diplomatic transcription
+			if !strings.HasSuffix(fname, ".txt") || isLevelFile(fname) {
 				continue
 			}
 			if change == StatusModified {
@@ -251,8 +343,11 @@ func (s *DocumentStore) Save(doc Document, author string, email string, comment
 		}
 	} else {
 		commitMessage = fmt.Sprintf(
-			"Transcribed %d lines from %s (%d)", len(doc.Lines), doc.Identifier,
+			"Transcribed %d lines from %s (%d)", numTranscribed, doc.Identifier,
 			doc.Year)
+		if numFlagged > 0 {
+			commitMessage += fmt.Sprintf(", flagged %d", numFlagged)
+		}
 	}
 	if comment != "" {
 		commitMessage += ("\n" + comment)
@@ -274,34 +369,23 @@ func (s *DocumentStore) writeLineData(doc Document, line OCRLine) error {
 	if _, err := os.Stat(imgPath); os.IsNotExist(err) {
 		// Obtain image file
 		cacheID := MakeLineIdentifier(doc.Identifier, line)
-		cachedPath := LineCache.GetLinePath(cacheID)
-		if cachedPath == "" {
+		if LineCache.GetLinePath(cacheID) == "" {
 			log.Warn().
 				Str("lineId", line.Identifier).
 				Msg("Line image was not cached, fetching it.")
-			path, err := LineCache.CacheLine(line.ImageURL, line.Identifier)
-			if err != nil {
+			if _, err := LineCache.CacheLine(line.ImageURL, cacheID); err != nil {
 				return err
 			}
-			cachedPath = path
 		}
 
 		// Move line image from cache into repository
-		in, err := os.Open(cachedPath)
-		if err != nil {
+		if err := LineCache.MoveLine(cacheID, imgPath); err != nil {
 			return err
 		}
-		out, err := os.Create(imgPath)
-		if err != nil {
+		if err := s.repo.Add(imgPath); err != nil {
 			return err
 		}
-		io.Copy(out, in)
-		in.Close()
-		out.Close()
-		if err := os.Remove(cachedPath); err != nil {
-			return err
-		}
-		if err := s.repo.Add(imgPath); err != nil {
+		if err := s.writeImageVariants(imgPath, line.Skew); err != nil {
 			return err
 		}
 	}
@@ -312,38 +396,132 @@ func (s *DocumentStore) writeLineData(doc Document, line OCRLine) error {
 	if err != nil {
 		return err
 	}
-	if _, err = transOut.WriteString(line.Transcription + "\n"); err != nil {
+	transcription := s.normalizer.Normalize(line.Transcription)
+	if _, err = transOut.WriteString(transcription + "\n"); err != nil {
 		return err
 	}
 	transOut.Close()
-	return s.repo.Add(transPath)
+	if err := s.repo.Add(transPath); err != nil {
+		return err
+	}
+	_, err = s.writeLevels(basePath, transcription)
+	return err
+}
+
+// writeMetadata writes the metadata of a document without the
+// transcriptions, which are stored in separate files
+func (s *DocumentStore) writeMetadata(doc Document) error {
+	metaPath := filepath.Join(
+		s.basePath, "transcriptions", strconv.Itoa(doc.Year), doc.Identifier+".json")
+	lines := make([]OCRLine, len(doc.Lines))
+	for idx, line := range doc.Lines {
+		line.Transcription = ""
+		line.Levels = nil
+		line.LocalImageURL = ""
+		line.PreviousLocalURL = ""
+		line.NextLocalURL = ""
+		lines[idx] = line
+	}
+	doc.Lines = lines
+	doc.History = nil
+	doc.Violations = nil
+	doc.NumLines = 0
+	doc.NumFlagged = 0
+	metaOut, err := os.Create(metaPath)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(metaOut)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(doc)
+	metaOut.Close()
+	if err != nil {
+		return err
+	}
+	return s.repo.Add(metaPath)
+}
+
+func (s *DocumentStore) writeReadme() error {
+	readmePath := filepath.Join(s.basePath, "README.md")
+	readmeOut, err := os.Create(readmePath)
+	if err != nil {
+		return err
+	}
+	readmeOut.WriteString(s.createReadme())
+	readmeOut.Close()
+	return s.repo.Add(readmePath)
+}
+
+// Coverage reports the progress of the corpus against its targets, the
+// report is only computed again after a new commit
+func (s *DocumentStore) Coverage() CoverageReport {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	head, err := s.repo.Head()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get the current commit, not caching coverage")
+		return ComputeCoverage(s.List(), s.Config.Targets)
+	}
+	if s.coverage != nil && s.coverage.Commit == head {
+		return *s.coverage
+	}
+	report := ComputeCoverage(s.List(), s.Config.Targets)
+	report.Commit = head
+	s.coverage = &report
+	return report
+}
+
+func countLines(documents []*Document) (yearCount map[int]int, decadeCount map[int]int) {
+	yearCount = map[int]int{}
+	decadeCount = map[int]int{}
+	for _, doc := range documents {
+		yearCount[doc.Year] += doc.NumLines
+		decadeCount[(doc.Year/10)*10] += doc.NumLines
+	}
+	return yearCount, decadeCount
+}
+
+// CharInventory counts the characters in all transcriptions of the corpus
+func (s *DocumentStore) CharInventory() CharInventory {
+	return ComputeCharInventory(s.ListWithLines())
+}
+
+// Head returns the hash of the current commit in the corpus repository
+func (s *DocumentStore) Head() (string, error) {
+	return s.repo.Head()
 }
 
 func (s *DocumentStore) createReadme() string {
 	documents := s.List()
+	charTable := ""
+	if s.Config.Readme.CharacterStats {
+		charTable = s.CharInventory().CharTable()
+	}
 	sort.Slice(documents, func(i, j int) bool {
 		return documents[i].Year < documents[j].Year
 	})
 
-	numLinesTotal := 0
-	yearCount := map[int]int{}
-	decadeCount := map[int]int{}
+	numLinesTotal, numFlaggedTotal := 0, 0
+	yearCount, decadeCount := countLines(documents)
 	metaRows := [][]string{}
 	for _, doc := range documents {
 		numLinesTotal += doc.NumLines
-		decade := (doc.Year / 10) * 10
-		yearCount[doc.Year] += doc.NumLines
-		decadeCount[decade] += doc.NumLines
-		archiveLink := fmt.Sprintf(
-			"[%s](http://archive.org/details/%s)", doc.Identifier, doc.Identifier)
-		manifestLink := fmt.Sprintf(
-			"[Manifest](https://iiif.archivelab.org/iiif/%s/manifest.json)",
-			doc.Identifier)
-		miradorLink := fmt.Sprintf(
-			"[Mirador](https://iiif.archivelab.org/iiif/%s)", doc.Identifier)
+		numFlaggedTotal += doc.NumFlagged
+		sourceLink := doc.Identifier
+		iiifLinks := []string{}
+		if doc.Manifest != "" {
+			iiifLinks = append(iiifLinks, fmt.Sprintf("[Manifest](%s)", doc.Manifest))
+		}
+		if source, err := s.Source(doc.Source); err == nil {
+			if detailsURL := source.DetailsURL(doc); detailsURL != "" {
+				sourceLink = fmt.Sprintf("[%s](%s)", doc.Identifier, detailsURL)
+			}
+			if viewerURL := source.ViewerURL(doc); viewerURL != "" {
+				iiifLinks = append(iiifLinks, fmt.Sprintf("[Mirador](%s)", viewerURL))
+			}
+		}
 		metaRows = append(metaRows, []string{
-			doc.Title, strconv.Itoa(doc.Year),
-			archiveLink, fmt.Sprintf("%s/%s", manifestLink, miradorLink)})
+			doc.Title, strconv.Itoa(doc.Year), sourceLink, strings.Join(iiifLinks, "/")})
 	}
 
 	var yearsTable bytes.Buffer
@@ -382,21 +560,27 @@ func (s *DocumentStore) createReadme() string {
 	t = tablewriter.NewWriter(&metaTable)
 	t.SetAutoFormatHeaders(false)
 	t.SetAutoWrapText(false)
-	t.SetHeader([]string{"Title", "Date", "Archive.org", "IIIF"})
+	t.SetHeader([]string{"Title", "Date", "Source", "IIIF"})
 	t.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 	t.SetCenterSeparator("|")
 	t.AppendBulk(metaRows)
 	t.Render()
 
+	numFlagged := ""
+	if numFlaggedTotal > 0 {
+		numFlagged = strconv.Itoa(numFlaggedTotal)
+	}
 	var out bytes.Buffer
 	tmpl := template.Must(template.New("README.md").Parse(readmeTemplate))
 	tmpl.Execute(&out, map[string]string{
 		"numLines":    strconv.Itoa(numLinesTotal),
+		"numFlagged":  numFlagged,
 		"numWorks":    strconv.Itoa(len(documents)),
 		"numYears":    strconv.Itoa(len(years)),
 		"decadeTable": decadesTable.String(),
 		"yearTable":   yearsTable.String(),
 		"worksTable":  metaTable.String(),
+		"charTable":   charTable,
 	})
 	return out.String()
 }
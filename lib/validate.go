@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Severities of guideline violations, rules with SeverityOff are not checked
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityOff     = "off"
+)
+
+// Names of the transcription guideline rules
+const (
+	RuleAllowedChars  = "allowedChars"
+	RuleLookAlikes    = "lookAlikes"
+	RuleNormalization = "normalization"
+	RuleWhitespace    = "whitespace"
+	RuleDoubleSpaces  = "doubleSpaces"
+	RuleHyphenation   = "hyphenation"
+)
+
+// Characters that are used to mark hyphenation at the end of a line
+const hyphenChars = "-‐‑¬=⸗⹀"
+
+// ValidationConfig controls how transcriptions are checked against the
+// transcription guidelines when they are submitted
+type ValidationConfig struct {
+	// Severity for every rule, one of "error", "warning" or "off"
+	Rules map[string]string `json:"rules"`
+	// All characters that may appear in a transcription, no restrictions if
+	// it is empty
+	AllowedChars string `json:"allowedChars"`
+	// Characters that look like the correct character, but are a different
+	// code point, mapped to the correct character
+	LookAlikes map[string]string `json:"lookAlikes"`
+	// Unicode normalization form transcriptions have to be in, NFC or NFD
+	NormalizationForm string `json:"normalizationForm"`
+	// Character that marks hyphenation at the end of a line
+	Hyphen string `json:"hyphen"`
+	// Reject submissions that have violations with error severity
+	BlockOnError bool `json:"blockOnError"`
+}
+
+// Violation is a single transcription guideline violation in a line
+type Violation struct {
+	Line     string `json:"line"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// HasErrors checks if any of the violations has error severity
+func HasErrors(violations []Violation) bool {
+	for _, v := range violations {
+		if v.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// guidelineRule checks a single transcription and returns a message for
+// every violation
+type guidelineRule interface {
+	Name() string
+	Check(text string) []string
+}
+
+// TranscriptionValidator checks transcriptions against the transcription
+// guidelines of the corpus
+type TranscriptionValidator struct {
+	config ValidationConfig
+	rules  []guidelineRule
+}
+
+// NewTranscriptionValidator builds the validator for the given configuration
+func NewTranscriptionValidator(config ValidationConfig) *TranscriptionValidator {
+	v := TranscriptionValidator{config: config}
+	candidates := []guidelineRule{
+		whitespaceRule{},
+		doubleSpacesRule{},
+		lookAlikesRule(config.LookAlikes),
+	}
+	if config.AllowedChars != "" {
+		allowed := map[string]bool{}
+		graphemes := uniseg.NewGraphemes(config.AllowedChars)
+		for graphemes.Next() {
+			allowed[graphemes.Str()] = true
+		}
+		candidates = append(candidates, allowedCharsRule(allowed))
+	}
+	if config.NormalizationForm != "" {
+		candidates = append(candidates, normalizationRule(config.NormalizationForm))
+	}
+	if config.Hyphen != "" {
+		candidates = append(candidates, hyphenationRule(config.Hyphen))
+	}
+	for _, rule := range candidates {
+		if v.severity(rule.Name()) != SeverityOff {
+			v.rules = append(v.rules, rule)
+		}
+	}
+	return &v
+}
+
+func (v *TranscriptionValidator) severity(rule string) string {
+	if severity, ok := v.config.Rules[rule]; ok {
+		return severity
+	}
+	return SeverityWarning
+}
+
+// BlocksOn checks if a submission with the given violations should be
+// rejected
+func (v *TranscriptionValidator) BlocksOn(violations []Violation) bool {
+	return v.config.BlockOnError && HasErrors(violations)
+}
+
+// ValidateLine checks the transcription of a single line
+func (v *TranscriptionValidator) ValidateLine(line OCRLine) []Violation {
+	violations := []Violation{}
+	if line.Transcription == "" {
+		return violations
+	}
+	// Gaps are kept as a placeholder, so they do not look like whitespace
+	// errors
+	text := StripMarkup(line.Transcription, GapChar)
+	for _, rule := range v.rules {
+		for _, msg := range rule.Check(text) {
+			violations = append(violations, Violation{
+				Line:     line.Identifier,
+				Rule:     rule.Name(),
+				Severity: v.severity(rule.Name()),
+				Message:  msg,
+			})
+		}
+	}
+	return violations
+}
+
+// Validate checks the transcriptions of all lines in a document
+func (v *TranscriptionValidator) Validate(doc Document) []Violation {
+	violations := []Violation{}
+	for _, line := range doc.Lines {
+		violations = append(violations, v.ValidateLine(line)...)
+	}
+	return violations
+}
+
+type whitespaceRule struct{}
+
+func (r whitespaceRule) Name() string { return RuleWhitespace }
+
+func (r whitespaceRule) Check(text string) []string {
+	if strings.TrimSpace(text) != text {
+		return []string{"Leading or trailing whitespace"}
+	}
+	return nil
+}
+
+type doubleSpacesRule struct{}
+
+func (r doubleSpacesRule) Name() string { return RuleDoubleSpaces }
+
+func (r doubleSpacesRule) Check(text string) []string {
+	isSpace := false
+	for _, c := range text {
+		if unicode.IsSpace(c) && isSpace {
+			return []string{"Multiple consecutive spaces"}
+		}
+		isSpace = unicode.IsSpace(c)
+	}
+	return nil
+}
+
+type lookAlikesRule map[string]string
+
+func (r lookAlikesRule) Name() string { return RuleLookAlikes }
+
+func (r lookAlikesRule) Check(text string) []string {
+	msgs := []string{}
+	wrongChars := make([]string, 0, len(r))
+	for wrong := range r {
+		wrongChars = append(wrongChars, wrong)
+	}
+	sort.Strings(wrongChars)
+	for _, wrong := range wrongChars {
+		correct := r[wrong]
+		if strings.Contains(text, wrong) {
+			msgs = append(msgs, fmt.Sprintf(
+				"'%s' (%s) should be '%s' (%s)", wrong,
+				strings.Join(codePointNames(wrong), " "), correct,
+				strings.Join(codePointNames(correct), " ")))
+		}
+	}
+	for _, c := range text {
+		// Mathematical Fraktur letters are used instead of regular letters
+		if c >= 0x1D504 && c <= 0x1D59F {
+			msgs = append(msgs, fmt.Sprintf(
+				"Mathematical Fraktur letter '%c' (U+%04X) should be a regular letter", c, c))
+		}
+	}
+	return msgs
+}
+
+type allowedCharsRule map[string]bool
+
+func (r allowedCharsRule) Name() string { return RuleAllowedChars }
+
+func (r allowedCharsRule) Check(text string) []string {
+	msgs := []string{}
+	seen := map[string]bool{}
+	graphemes := uniseg.NewGraphemes(text)
+	for graphemes.Next() {
+		char := graphemes.Str()
+		if r[char] || seen[char] || char == GapChar || strings.TrimSpace(char) == "" {
+			continue
+		}
+		seen[char] = true
+		msgs = append(msgs, fmt.Sprintf(
+			"Character '%s' (%s) is not allowed", char,
+			strings.Join(codePointNames(char), " ")))
+	}
+	return msgs
+}
+
+type normalizationRule string
+
+func (r normalizationRule) Name() string { return RuleNormalization }
+
+func (r normalizationRule) Check(text string) []string {
+	var form norm.Form
+	switch strings.ToUpper(string(r)) {
+	case "NFC":
+		form = norm.NFC
+	case "NFD":
+		form = norm.NFD
+	default:
+		return nil
+	}
+	if !form.IsNormalString(text) {
+		return []string{fmt.Sprintf("Not in normalization form %s", strings.ToUpper(string(r)))}
+	}
+	return nil
+}
+
+type hyphenationRule string
+
+func (r hyphenationRule) Name() string { return RuleHyphenation }
+
+func (r hyphenationRule) Check(text string) []string {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	if trimmed == "" || strings.HasSuffix(trimmed, string(r)) {
+		return nil
+	}
+	last := []rune(trimmed)[len([]rune(trimmed))-1]
+	if strings.ContainsRune(hyphenChars, last) {
+		return []string{fmt.Sprintf(
+			"Hyphenation should be marked with '%s' instead of '%c'", string(r), last)}
+	}
+	return nil
+}
@@ -38,9 +38,12 @@ const (
 	StatusDeleted  FileStatus = 'D'
 )
 
-// GitRepo represents a Git repository
+// GitRepo represents a Git repository. Every method runs its own git
+// command, so reading methods can be called concurrently. Changes that span
+// several commands need to be serialized by the caller.
 type GitRepo struct {
-	cmd *exec.Cmd
+	path    string
+	gitPath string
 }
 
 // GitOpen a repository
@@ -51,36 +54,31 @@ func GitOpen(path string) (*GitRepo, error) {
 	if err != nil {
 		return nil, err
 	}
-	cmd := exec.Command(gitPath)
-	cmd.Dir = path
 	return &GitRepo{
-		cmd: cmd,
+		path:    path,
+		gitPath: gitPath,
 	}, nil
 }
 
-func (r *GitRepo) run() (stdout string, stderr string, err error) {
+// run executes git with the given arguments in the repository
+func (r *GitRepo) run(args ...string) (stdout string, stderr string, err error) {
 	var stdoutBuf bytes.Buffer
 	var stderrBuf bytes.Buffer
-	r.cmd.Stdout = &stdoutBuf
-	r.cmd.Stderr = &stderrBuf
-	err = r.cmd.Run()
+	cmd := exec.Command(r.gitPath, args...)
+	cmd.Dir = r.path
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+	err = cmd.Run()
 	return stdoutBuf.String(), stderrBuf.String(), err
 }
 
-func (r *GitRepo) resetCmd() {
-	dir := r.cmd.Dir
-	r.cmd = exec.Command(r.cmd.Path)
-	r.cmd.Dir = dir
-}
-
 // Pull from remote and optionally rebase
 func (r *GitRepo) Pull(remote string, branch string, rebase bool) error {
-	defer r.resetCmd()
-	r.cmd.Args = append(r.cmd.Args, "pull", remote, branch)
+	args := []string{"pull", remote, branch}
 	if rebase {
-		r.cmd.Args = append(r.cmd.Args, "--rebase")
+		args = append(args, "--rebase")
 	}
-	stdout, stderr, err := r.run()
+	stdout, stderr, err := r.run(args...)
 	if err != nil {
 		return fmt.Errorf("%q\n%q", stdout, stderr)
 	}
@@ -89,12 +87,12 @@ func (r *GitRepo) Pull(remote string, branch string, rebase bool) error {
 
 func (r *GitRepo) adjustPath(path string) (string, error) {
 	if strings.HasPrefix(path, "/") {
-		newPath, errr := filepath.Rel(r.cmd.Dir, path)
+		newPath, errr := filepath.Rel(r.path, path)
 		if errr != nil {
 			return "", errr
 		} else if strings.HasPrefix(newPath, "../") {
 			return "", fmt.Errorf(
-				"Path must be relative to repository root (%s)", r.cmd.Dir)
+				"Path must be relative to repository root (%s)", r.path)
 		}
 		return newPath, nil
 	}
@@ -103,13 +101,11 @@ func (r *GitRepo) adjustPath(path string) (string, error) {
 
 // Add stages a new file
 func (r *GitRepo) Add(path string) error {
-	defer r.resetCmd()
 	p, err := r.adjustPath(path)
 	if err != nil {
 		return err
 	}
-	r.cmd.Args = append(r.cmd.Args, "add", p)
-	stdout, stderr, err := r.run()
+	stdout, stderr, err := r.run("add", p)
 	if err != nil {
 		return fmt.Errorf("%+v\n%q\n%q", err, stdout, stderr)
 	}
@@ -118,13 +114,11 @@ func (r *GitRepo) Add(path string) error {
 
 // Remove removes a file
 func (r *GitRepo) Remove(path string) error {
-	defer r.resetCmd()
 	p, err := r.adjustPath(path)
 	if err != nil {
 		return err
 	}
-	r.cmd.Args = append(r.cmd.Args, "rm", "-rf", p)
-	stdout, stderr, err := r.run()
+	stdout, stderr, err := r.run("rm", "-rf", p)
 	if err != nil {
 		return fmt.Errorf("%+v\n%q\n%q", err, stdout, stderr)
 	}
@@ -133,14 +127,11 @@ func (r *GitRepo) Remove(path string) error {
 
 // Commit the staged changes
 func (r *GitRepo) Commit(message string, author string, email string) (string, error) {
-	defer r.resetCmd()
-	r.cmd.Args = append(
-		r.cmd.Args, "commit", "-m", message)
+	args := []string{"commit", "-m", message}
 	if author != "" {
-		r.cmd.Args = append(
-			r.cmd.Args, "--author", fmt.Sprintf("%s <%s>", author, email))
+		args = append(args, "--author", fmt.Sprintf("%s <%s>", author, email))
 	}
-	stdout, stderr, err := r.run()
+	stdout, stderr, err := r.run(args...)
 	if err != nil {
 		return "", fmt.Errorf("%+v, %q\n%q", err, stdout, stderr)
 	}
@@ -150,44 +141,39 @@ func (r *GitRepo) Commit(message string, author string, email string) (string, e
 
 // Push changes to remote
 func (r *GitRepo) Push(remote string, branch string) error {
-	defer r.resetCmd()
-	r.cmd.Args = append(r.cmd.Args, "push", remote, branch)
-	stdout, stderr, err := r.run()
+	stdout, stderr, err := r.run("push", remote, branch)
 	if err != nil {
 		return fmt.Errorf("%q\n%q", stdout, stderr)
 	}
 	return nil
 }
 
+// Head returns the hash of the currently checked out commit
+func (r *GitRepo) Head() (string, error) {
+	stdout, stderr, err := r.run("rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("%q\n%q", stdout, stderr)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
 // CleanUp residual modifications
 func (r *GitRepo) CleanUp() error {
-	r.cmd.Args = append(r.cmd.Args, "reset")
-	if stdout, stderr, err := r.run(); err != nil {
-		return fmt.Errorf("%q\n%q", stdout, stderr)
-	}
-	r.resetCmd()
-	r.cmd.Args = append(r.cmd.Args, "checkout", "--", ".")
-	if stdout, stderr, err := r.run(); err != nil {
-		return fmt.Errorf("%q\n%q", stdout, stderr)
-	}
-	r.resetCmd()
-	r.cmd.Args = append(r.cmd.Args, "clean", "-fd")
-	if stdout, stderr, err := r.run(); err != nil {
-		return fmt.Errorf("%q\n%q", stdout, stderr)
+	for _, args := range [][]string{{"reset"}, {"checkout", "--", "."}, {"clean", "-fd"}} {
+		if stdout, stderr, err := r.run(args...); err != nil {
+			return fmt.Errorf("%q\n%q", stdout, stderr)
+		}
 	}
-	r.resetCmd()
 	return nil
 }
 
 // Diff lists modified files
 func (r *GitRepo) Diff(cached bool) (map[string]FileStatus, error) {
-	defer r.resetCmd()
-	r.cmd.Args = append(
-		r.cmd.Args, "diff", "--name-status")
+	args := []string{"diff", "--name-status"}
 	if cached {
-		r.cmd.Args = append(r.cmd.Args, "--cached")
+		args = append(args, "--cached")
 	}
-	stdout, stderr, err := r.run()
+	stdout, stderr, err := r.run(args...)
 	if err != nil {
 		return nil, fmt.Errorf("%q\n%q", stdout, stderr)
 	}
@@ -208,13 +194,12 @@ func (r *GitRepo) Diff(cached bool) (map[string]FileStatus, error) {
 
 // Log returns the git log of a given file
 func (r *GitRepo) Log(fpaths ...string) ([]LogEntry, error) {
-	defer r.resetCmd()
-	r.cmd.Args = append(
-		r.cmd.Args, "log", `--pretty=format:{"commit":"%H","subject":"%s","body":"%b","author": {"name":"%aN","email":"%aE"},"date":"%aI"}`)
+	args := []string{
+		"log", `--pretty=format:{"commit":"%H","subject":"%s","body":"%b","author": {"name":"%aN","email":"%aE"},"date":"%aI"}`}
 	if len(fpaths) > 0 {
-		r.cmd.Args = append(r.cmd.Args, fpaths...)
+		args = append(args, fpaths...)
 	}
-	stdout, stderr, err := r.run()
+	stdout, stderr, err := r.run(args...)
 	if err != nil {
 		return nil, fmt.Errorf("%q\n%q", stdout, stderr)
 	}
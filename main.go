@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/rs/zerolog"
@@ -15,11 +16,37 @@ func main() {
 	var logPath = flag.String("log", "", "Set path to logging file")
 	var isDebug = flag.Bool("debug", false, "Enable debug mode")
 	var repoPath = flag.String("repoPath", "", "Set repository path")
+	var refreshInterval = flag.Duration(
+		"refreshInterval", 0, "Refresh the identifier cache at this interval, e.g. 24h")
+	var dryRun = flag.Bool("dryRun", false, "Only report the changes of the normalize command")
+	var imageCacheSize = flag.Int64(
+		"imageCacheSize", lib.DefaultLineCacheOptions.MaxBytes>>20,
+		"Maximum size of the line image cache in MiB, 0 for no limit")
+	var imageCacheTTL = flag.Duration(
+		"imageCacheTTL", lib.DefaultLineCacheOptions.TTL,
+		"Evict line images that were not used for this long, 0 to keep them")
 	flag.Parse()
 	if *repoPath == "" {
 		panic("repoPath must be set!")
 	}
-	lib.InitCache()
+	if flag.Arg(0) == "charstats" {
+		// Does not need the caches
+		printCharStats(*repoPath)
+		return
+	}
+	if flag.Arg(0) == "normalize" {
+		normalizeCorpus(*repoPath, *dryRun)
+		return
+	}
+	if flag.Arg(0) == "preprocess" {
+		preprocessCorpus(*repoPath)
+		return
+	}
+	lib.InitCache(lib.LineCacheOptions{
+		MaxBytes:      *imageCacheSize << 20,
+		TTL:           *imageCacheTTL,
+		PurgeInterval: lib.DefaultLineCacheOptions.PurgeInterval,
+	})
 	if *isDebug {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	} else if *logPath == "" {
@@ -32,11 +59,81 @@ func main() {
 		defer f.Close()
 		log.Logger = log.Output(f)
 	}
+	if flag.Arg(0) == "refresh" {
+		refreshIdentifiers(*repoPath)
+		return
+	}
 	var port int
 	if *isDebug {
 		port = 8083
 	} else {
 		port = 8080
 	}
-	web.Serve(port, *repoPath)
+	web.Serve(port, *repoPath, *refreshInterval)
+}
+
+// refreshIdentifiers refreshes the identifier cache while the server is not
+// running, since a running server keeps it locked. The server refreshes it
+// itself with -refreshInterval.
+func refreshIdentifiers(repoPath string) {
+	store, err := lib.NewDocumentStore(repoPath)
+	if err != nil {
+		panic(err)
+	}
+	result, err := lib.NewIdentifierRefresher(lib.IDCache, store).Refresh(true)
+	lib.IDCache.Close()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Refresh failed")
+	}
+	fmt.Printf("Added %d, removed %d and consumed %d identifiers in %.1fs\n",
+		result.NumAdded, result.NumRemoved, result.NumConsumed, result.Duration)
+}
+
+func normalizeCorpus(repoPath string, dryRun bool) {
+	store, err := lib.NewDocumentStore(repoPath)
+	if err != nil {
+		panic(err)
+	}
+	report, err := store.NormalizeCorpus(dryRun, "", "")
+	if err != nil {
+		panic(err)
+	}
+	for _, path := range report.ChangedFiles {
+		fmt.Println(path)
+	}
+	for _, r := range report.Replacements {
+		if r.Count > 0 {
+			fmt.Printf("%s → %s: %d\n", r.From, r.To, r.Count)
+		}
+	}
+	fmt.Printf("Normalized %d of %d lines\n", report.NumChanged, report.NumLines)
+	if report.Commit != "" {
+		fmt.Printf("Committed as %s, push it to publish the changes\n", report.Commit)
+	}
+}
+
+func preprocessCorpus(repoPath string) {
+	store, err := lib.NewDocumentStore(repoPath)
+	if err != nil {
+		panic(err)
+	}
+	numImages, err := store.PreprocessCorpus("", "")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Processed %d line images\n", numImages)
+}
+
+func printCharStats(repoPath string) {
+	store, err := lib.NewDocumentStore(repoPath)
+	if err != nil {
+		panic(err)
+	}
+	inventory := store.CharInventory()
+	fmt.Printf("# All decades (%d characters)\n\n", inventory.NumChars)
+	fmt.Println(inventory.CharTable())
+	for _, decade := range inventory.Decades {
+		fmt.Printf("# %ds (%d characters)\n\n", decade.Decade, decade.NumChars)
+		fmt.Println(decade.CharTable())
+	}
 }
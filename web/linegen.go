@@ -4,24 +4,46 @@ import (
 	"archiscribe/lib"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"sort"
 
 	"github.com/rs/zerolog/log"
 )
 
-func pickVolume(year int) string {
+func pickVolume(fromYear int, toYear int) (lib.IdentifierCacheEntry, lib.Source, error) {
 	for {
-		entry := lib.IDCache.Random(year)
+		entry, err := lib.IDCache.Lease(fromYear, toYear)
+		if err != nil {
+			return entry, nil, err
+		}
 		candidate := entry.Identifier
-		isFrak, _ := lib.IsFraktur(candidate)
-		if !isFrak {
+		source, err := store.Source(entry.Source)
+		if err != nil {
+			log.Info().Str("identifier", candidate).Str("source", entry.Source).
+				Msg("Source of the document is no longer configured")
+			if err := lib.IDCache.Consume(candidate); err != nil {
+				return entry, nil, err
+			}
+			continue
+		}
+		isSuitable, err := source.IsSuitable(entry)
+		if err != nil {
+			// The volume is checked again once it is picked the next time,
+			// so it is not lost during an outage of the source
+			if err := lib.IDCache.Release(candidate); err != nil {
+				log.Error().Err(err).Str("identifier", candidate).
+					Msg("Could not release identifier")
+			}
+			return entry, nil, err
+		}
+		if !isSuitable {
 			log.Info().Str("identifier", candidate).
 				Msg("Document did not seem to have Fraktur letters")
+			if err := lib.IDCache.Consume(candidate); err != nil {
+				return entry, nil, err
+			}
 			continue
 		}
-		return candidate
+		return entry, source, nil
 	}
 }
 
@@ -29,12 +51,17 @@ type lineProducer struct {
 	resp     http.ResponseWriter
 	ident    string
 	year     int
+	fromYear int
+	toYear   int
 	taskSize int
+	sampler  lib.LineSampler
 	progChan chan lib.ProgressMessage
 	lineChan chan []lib.OCRLine
+	// Closed once the client went away, so the source stops fetching
+	done chan struct{}
 }
 
-func newLineProducer(resp http.ResponseWriter, taskSize int, year int) (*lineProducer, error) {
+func newLineProducer(resp http.ResponseWriter, taskSize int, fromYear int, toYear int, sampler lib.LineSampler) (*lineProducer, error) {
 	if _, ok := resp.(http.Flusher); !ok {
 		return nil, fmt.Errorf("streaming unsupported")
 	}
@@ -44,27 +71,44 @@ func newLineProducer(resp http.ResponseWriter, taskSize int, year int) (*linePro
 	if taskSize == 0 {
 		taskSize = 50
 	}
-	return &lineProducer{resp: resp, taskSize: taskSize, year: year}, nil
+	if maxLines := store.Config.Targets.MaxLinesPerWork; maxLines > 0 && taskSize > maxLines {
+		taskSize = maxLines
+	}
+	return &lineProducer{
+		resp: resp, taskSize: taskSize, fromYear: fromYear, toYear: toYear,
+		sampler: sampler, done: make(chan struct{})}, nil
 }
 
-func (p *lineProducer) produceLines() {
-	p.ident = pickVolume(p.year)
-	p.progChan, p.lineChan = lib.FetchLines(p.ident)
-	log.Info().Str("identifier", p.ident).Msg("Fetching lines")
+func (p *lineProducer) produceLines() error {
+	entry, source, err := pickVolume(p.fromYear, p.toYear)
+	if err != nil {
+		return err
+	}
+	p.ident = entry.Identifier
+	p.year = entry.Year
+	doc, err := source.Metadata(entry)
+	if err != nil {
+		p.release()
+		return err
+	}
+	p.progChan, p.lineChan = source.FetchLines(entry, store.Config, p.done)
+	log.Info().Str("identifier", p.ident).Str("source", source.Name()).Msg("Fetching lines")
 	headers := p.resp.Header()
 	headers.Set("Content-Type", "text/event-stream")
 	headers.Set("Cache-Control", "no-cache")
 	headers.Set("Connection", "keep-alive")
 
-	metadata, _ := lib.GetMetadata(p.ident)
-	doc := lib.Document{
-		Identifier: p.ident,
-		Title:      metadata.Get("title").MustString(),
-		Year:       p.year,
-		Manifest:   fmt.Sprintf("https://iiif.archivelab.org/iiif/%s/manifest.json", p.ident),
-	}
 	p.writeMessage("document", doc)
 	p.streamLines()
+	return nil
+}
+
+// release returns the leased volume to the identifier cache
+func (p *lineProducer) release() {
+	if err := lib.IDCache.Release(p.ident); err != nil {
+		log.Error().Err(err).Str("identifier", p.ident).
+			Msg("Could not release identifier")
+	}
 }
 
 func (p *lineProducer) writeMessage(event string, msg interface{}) {
@@ -75,25 +119,18 @@ func (p *lineProducer) writeMessage(event string, msg interface{}) {
 }
 
 func (p *lineProducer) handleLines(lines []lib.OCRLine) {
-	lineIdxes := make([]int, 0, p.taskSize)
-	lineIdxesMap := map[int]bool{}
-	for len(lineIdxes) < p.taskSize {
-		pickIdx := rand.Intn(len(lines))
-		if lineIdxesMap[pickIdx] {
-			continue
-		}
-		lineIdxes = append(lineIdxes, pickIdx)
-		lineIdxesMap[pickIdx] = true
+	taskLines := p.sampler.Sample(lines, p.taskSize)
+	for idx := range taskLines {
+		taskLines[idx].SetLocalURLs(p.ident)
 	}
-	sort.Ints(lineIdxes)
-	randomLines := make([]lib.OCRLine, 0, len(lineIdxes))
-	for _, lineIdx := range lineIdxes {
-		randomLines = append(randomLines, lines[lineIdx])
+	// Cached before the lines are sent, so the client does not request
+	// images that are still being downloaded. Images that could not be
+	// cached are fetched again once they are requested.
+	if err := lib.LineCache.CacheLines(taskLines, p.ident); err != nil {
+		log.Warn().Err(err).Str("identifier", p.ident).Msg("Could not cache all lines")
+		p.writeMessage("warning", APIError{Err: err.Error()})
 	}
-	// Run in the background, the user does not have to wait for our
-	// caching
-	go lib.LineCache.CacheLines(randomLines, p.ident)
-	p.writeMessage("lines", randomLines)
+	p.writeMessage("lines", taskLines)
 }
 
 func (p *lineProducer) streamLines() {
@@ -106,6 +143,16 @@ func (p *lineProducer) streamLines() {
 				p.progChan = nil
 				break
 			}
+			if progMsg.Error == lib.ErrPageCountMismatch {
+				// The lines of the volume can not be cropped reliably
+				if err := lib.IDCache.Consume(p.ident); err != nil {
+					log.Error().Err(err).Str("identifier", p.ident).
+						Msg("Could not mark identifier as consumed")
+				}
+			} else if progMsg.Error != nil {
+				// The volume can be tried again, e.g. after a network error
+				p.release()
+			}
 			p.writeMessage("progress", progMsg)
 		case allLines, ok := <-p.lineChan:
 			if !ok {
@@ -118,6 +165,10 @@ func (p *lineProducer) streamLines() {
 				Msg("Picking lines and caching them")
 			p.handleLines(allLines)
 		case <-closer:
+			// The task was abandoned, so the volume can be picked for
+			// another task right away instead of once its lease expired
+			close(p.done)
+			p.release()
 			return
 		}
 		if p.progChan == nil && p.lineChan == nil {
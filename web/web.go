@@ -1,13 +1,22 @@
 package web
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"image"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gobuffalo/packr"
 	"github.com/julienschmidt/httprouter"
@@ -18,17 +27,21 @@ import (
 
 var taskChan = make(chan lib.TaskDefinition)
 var store *lib.DocumentStore
+var refresher *lib.IdentifierRefresher
 
 // APIError is for errors that are returned via the API
 type APIError struct {
-	Err  error `json:"error"`
-	Code int   `json:"code"`
+	Err        string          `json:"error"`
+	Code       int             `json:"code"`
+	Violations []lib.Violation `json:"violations,omitempty"`
 }
 
 func writeAPIError(err error, code int, w http.ResponseWriter) {
-	apiErr := APIError{
-		Err:  err,
-		Code: code}
+	writeAPIErrorValue(APIError{Err: err.Error(), Code: code}, w)
+}
+
+func writeAPIErrorValue(apiErr APIError, w http.ResponseWriter) {
+	code := apiErr.Code
 	out, _ := json.MarshalIndent(apiErr, "", "  ")
 	w.WriteHeader(code)
 	w.Header().Add("Content-Type", "application/json")
@@ -48,11 +61,35 @@ func SubmitDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 			Msg("Could not decode submitted document")
 		writeAPIError(err, 500, w)
 	} else {
+		if err := lib.CheckFlags(task.Document); err != nil {
+			writeAPIError(err, http.StatusBadRequest, w)
+			return
+		}
+		if err := lib.CheckMarkup(task.Document); err != nil {
+			writeAPIError(err, http.StatusBadRequest, w)
+			return
+		}
 		log.Info().
 			Bool("isUpdate", r.Method == "POST").
 			Int("numTranscriptions", len(task.Document.Lines)).
 			Str("documentId", task.Document.Identifier).
 			Msg("Received transcription")
+		// Only what is stored is validated, the server normalizes anyway
+		task.Document = store.NormalizeDocument(task.Document)
+		validator := lib.NewTranscriptionValidator(store.Config.Validation)
+		violations := validator.Validate(task.Document)
+		if validator.BlocksOn(violations) {
+			log.Info().
+				Int("numViolations", len(violations)).
+				Str("documentId", task.Document.Identifier).
+				Msg("Rejected transcription that violates the guidelines")
+			writeAPIErrorValue(APIError{
+				Err:        "Transcription violates the transcription guidelines",
+				Code:       http.StatusUnprocessableEntity,
+				Violations: violations,
+			}, w)
+			return
+		}
 		stored, err := store.Save(task.Document, task.Author, task.Email, task.Comment)
 		if err != nil {
 			log.Error().
@@ -62,6 +99,14 @@ func SubmitDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 			writeAPIError(err, 500, w)
 			return
 		}
+		err = lib.IDCache.Consume(task.Document.Identifier)
+		if err != nil && err != lib.ErrUnknownIdentifier {
+			log.Error().
+				Err(err).
+				Str("documentId", task.Document.Identifier).
+				Msg("Could not mark identifier as consumed")
+		}
+		stored.Violations = violations
 		js, _ := json.MarshalIndent(stored, "", "  ")
 		w.WriteHeader(http.StatusOK)
 		w.Header().Add("Content-Type", "application/json")
@@ -69,16 +114,60 @@ func SubmitDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	}
 }
 
-// ProduceLines begins generating OCR lines for a given identifier
+// ProduceLines begins generating OCR lines for a volume from a given year,
+// range of years (1850-1855), decade (1850s) or from the decade that is most
+// under-represented in the corpus (balanced)
 func ProduceLines(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	year, _ := strconv.Atoi(ps.ByName("year"))
+	var fromYear, toYear int
+	var err error
+	isBalanced := ps.ByName("year") == "balanced"
+	if isBalanced {
+		fromYear, toYear = 0, 9999
+	} else if fromYear, toYear, err = lib.ParseYearRange(ps.ByName("year")); err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	// Give priority to the most under-filled decade
+	if isBalanced || (store.Config.Targets.Prioritize && toYear/10 > fromYear/10) {
+		decade, err := lib.PickBalancedDecade(
+			lib.IDCache.AvailableByYear(), store.Coverage().DecadeScores(),
+			fromYear, toYear)
+		if err == lib.ErrNoIdentifiers {
+			writeAPIError(err, http.StatusConflict, resp)
+			return
+		}
+		if decade > fromYear {
+			fromYear = decade
+		}
+		if decade+9 < toYear {
+			toYear = decade + 9
+		}
+	}
 	taskSize, _ := strconv.Atoi(req.URL.Query().Get("taskSize"))
-	lineProd, err := newLineProducer(resp, taskSize, year)
+	strategy := req.URL.Query().Get("strategy")
+	if strategy == "" {
+		strategy = store.Config.Sampling.Strategy
+	}
+	sampler, err := lib.NewLineSampler(strategy)
+	if err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	lineProd, err := newLineProducer(resp, taskSize, fromYear, toYear, sampler)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create line producer")
 		resp.WriteHeader(http.StatusInternalServerError)
-	} else {
-		lineProd.produceLines()
+	} else if err := lineProd.produceLines(); err == lib.ErrUnknownYear {
+		writeAPIError(err, http.StatusNotFound, resp)
+	} else if err == lib.ErrNoIdentifiers {
+		writeAPIError(err, http.StatusConflict, resp)
+	} else if err != nil {
+		log.Error().
+			Err(err).
+			Int("fromYear", fromYear).
+			Int("toYear", toYear).
+			Msg("Failed to pick a volume")
+		writeAPIError(err, http.StatusInternalServerError, resp)
 	}
 }
 
@@ -96,15 +185,504 @@ func ListDocuments(resp http.ResponseWriter, req *http.Request, ps httprouter.Pa
 	}
 }
 
-// GetDocument returns a single document
-func GetDocument(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+// splitParam splits a comma-separated query parameter
+func splitParam(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// loadDocument loads a document with the transcription level requested in
+// the `level` query parameter and only the lines that have all flags from
+// `flags` and none from `excludeFlags`, errors are written to the response
+func loadDocument(resp http.ResponseWriter, req *http.Request, ps httprouter.Params, excludeFlags []string) *lib.Document {
 	doc := store.Details(ps.ByName("ident"))
 	log.Info().Str("identifier", ps.ByName("ident")).Msg("Loading document from store")
+	if doc == nil || doc.Identifier == "" {
+		resp.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	level := req.URL.Query().Get("level")
+	if err := store.SelectLevel(doc, level); err != nil {
+		writeAPIError(fmt.Errorf("Unknown transcription level '%s', must be one of %s",
+			level, strings.Join(store.Levels(), ", ")), http.StatusBadRequest, resp)
+		return nil
+	}
+	if _, ok := req.URL.Query()["excludeFlags"]; ok {
+		excludeFlags = splitParam(req.URL.Query().Get("excludeFlags"))
+	}
+	doc.FilterFlags(splitParam(req.URL.Query().Get("flags")), excludeFlags)
+	for idx := range doc.Lines {
+		doc.Lines[idx].SetLocalURLs(doc.Identifier)
+	}
+	return doc
+}
+
+// GetLineImage serves a line image from the corpus or from the line cache,
+// images that are neither are fetched into the cache
+func GetLineImage(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	lineID := ps.ByName("lineId")
+	if !lib.ValidLineImageID(lineID) {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	variant := req.URL.Query().Get("image")
+	if variant != "" && !store.HasImageVariant(variant) {
+		writeAPIError(fmt.Errorf("Unknown image variant '%s'", variant), http.StatusBadRequest, resp)
+		return
+	}
+	imgPath := store.LineImagePath(lineID, variant)
+	maxAge := 24 * time.Hour
+	if imgPath == "" && variant != "" {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	} else if imgPath == "" {
+		var err error
+		imgPath, err = lib.LineCache.FetchLine(lineID)
+		if err == lib.ErrUnknownLine {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("lineId", lineID).Msg("Could not fetch line image")
+			writeAPIError(err, http.StatusBadGateway, resp)
+			return
+		}
+		maxAge = time.Hour
+	}
+	data, err := ioutil.ReadFile(imgPath)
+	if err != nil {
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	finfo, _ := os.Stat(imgPath)
+	resp.Header().Set("Content-Type", "image/png")
+	resp.Header().Set("ETag", fmt.Sprintf("\"%x\"", sha1.Sum(data)))
+	resp.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	http.ServeContent(resp, req, "", finfo.ModTime(), bytes.NewReader(data))
+}
+
+// requestBaseURL returns the URL the application is served at, as seen by
+// the client
+func requestBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := req.Host
+	if fwdHost := req.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+		host = fwdHost
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// iiifImagePath resolves a IIIF image identifier, errors are written to the
+// response
+func iiifImagePath(resp http.ResponseWriter, id string) string {
+	imgPath, err := store.IIIFImagePath(id)
+	if err == lib.ErrUnknownImage {
+		resp.WriteHeader(http.StatusNotFound)
+		return ""
+	} else if err != nil {
+		log.Error().Err(err).Str("imageId", id).Msg("Could not fetch image")
+		writeAPIError(err, http.StatusBadGateway, resp)
+		return ""
+	}
+	return imgPath
+}
+
+// RedirectIIIFImage redirects the base URI of an image to its info.json
+func RedirectIIIFImage(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	http.Redirect(resp, req, req.URL.Path+"/info.json", http.StatusSeeOther)
+}
+
+// GetIIIFResource returns the info.json of an image for the IIIF Image API
+// or the IIIF Presentation manifest of a document
+func GetIIIFResource(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	var out interface{}
+	switch ps.ByName("region") {
+	case "info.json":
+		imgPath := iiifImagePath(resp, id)
+		if imgPath == "" {
+			return
+		}
+		width, height, err := lib.ImageSize(imgPath)
+		if err != nil {
+			writeAPIError(err, http.StatusInternalServerError, resp)
+			return
+		}
+		out = lib.IIIFImageInfo(
+			fmt.Sprintf("%s/iiif/%s", requestBaseURL(req), id), width, height, iiifVersion(req))
+	case "manifest.json":
+		doc := loadDocument(resp, req, httprouter.Params{{Key: "ident", Value: id}},
+			store.Config.Export.ExcludeFlags)
+		if doc == nil {
+			return
+		}
+		manifest, err := store.NewPresentationManifest(doc, requestBaseURL(req))
+		if err != nil {
+			log.Error().Err(err).Str("identifier", id).Msg("Could not create manifest")
+			writeAPIError(err, http.StatusBadGateway, resp)
+			return
+		}
+		out = manifest
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	raw, err := json.Marshal(out)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/ld+json")
+	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Write(raw)
+}
+
+// iiifVersion returns the version of the IIIF Image API a request is
+// answered in, 3 unless version 2 is requested via the Accept header
+func iiifVersion(req *http.Request) int {
+	if strings.Contains(req.Header.Get("Accept"), "iiif.io/api/image/2/") {
+		return 2
+	}
+	return 3
+}
+
+// GetIIIFImage serves a region of a line or page image according to the
+// IIIF Image API
+func GetIIIFImage(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	iiifReq, err := lib.ParseIIIFImageRequest(
+		ps.ByName("region"), ps.ByName("size"), ps.ByName("rotation"), ps.ByName("file"),
+		iiifVersion(req))
+	if err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	imgPath := iiifImagePath(resp, ps.ByName("id"))
+	if imgPath == "" {
+		return
+	}
+	file, err := os.Open(imgPath)
+	if err != nil {
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	img, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	out, err := iiifReq.Apply(img)
+	if err == lib.ErrIIIFNotImplemented {
+		writeAPIError(err, http.StatusNotImplemented, resp)
+		return
+	} else if err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	var buf bytes.Buffer
+	if err := iiifReq.Encode(&buf, out); err != nil {
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	finfo, _ := os.Stat(imgPath)
+	resp.Header().Set("Content-Type", iiifReq.ContentType())
+	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Header().Set("ETag", fmt.Sprintf("\"%x\"", sha1.Sum(buf.Bytes())))
+	resp.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeContent(resp, req, "", finfo.ModTime(), bytes.NewReader(buf.Bytes()))
+}
+
+// GetDocument returns a single document
+func GetDocument(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	doc := loadDocument(resp, req, ps, nil)
+	if doc == nil {
+		return
+	}
 	raw, err := json.Marshal(doc)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
-	} else if doc.Identifier == "" {
+	} else {
+		resp.Header().Add("Content-Type", "application/json")
+		resp.Write(raw)
+	}
+}
+
+// ExportDocument returns a single document in one of the export formats
+func ExportDocument(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	variant := req.URL.Query().Get("image")
+	if variant != "" && !store.HasImageVariant(variant) {
+		writeAPIError(fmt.Errorf("Unknown image variant '%s'", variant), http.StatusBadRequest, resp)
+		return
+	}
+	exporter, err := store.NewExporter(ps.ByName("format"), variant)
+	if err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	if annotations, ok := exporter.(*lib.AnnotationExporter); ok {
+		annotations.BaseURL = requestBaseURL(req)
+	}
+	doc := loadDocument(resp, req, ps, store.Config.Export.ExcludeFlags)
+	if doc == nil {
+		return
+	}
+	// The export is buffered, so failures can still be reported to the client
+	var out bytes.Buffer
+	if err := exporter.Export(doc, &out); err != nil {
+		log.Error().Err(err).Str("identifier", doc.Identifier).Msg("Failed to export document")
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	resp.Header().Add("Content-Type", exporter.ContentType())
+	resp.Header().Add("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"%s%s\"", doc.Identifier, exporter.Extension()))
+	out.WriteTo(resp)
+}
+
+// GetAnnotations returns the W3C Annotation Pages with the transcriptions of
+// a document on the canvases of its IIIF manifest, or only the page for the
+// page number given in the `page` query parameter
+func GetAnnotations(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	doc := loadDocument(resp, req, ps, store.Config.Export.ExcludeFlags)
+	if doc == nil {
+		return
+	}
+	pages, err := lib.NewAnnotationPages(doc, requestBaseURL(req))
+	if err != nil {
+		log.Error().Err(err).Str("identifier", doc.Identifier).Msg("Could not create annotations")
+		writeAPIError(err, http.StatusBadGateway, resp)
+		return
+	}
+	var out interface{} = pages
+	if pageParam := req.URL.Query().Get("page"); pageParam != "" {
+		pageNo, err := strconv.Atoi(pageParam)
+		if err != nil {
+			writeAPIError(fmt.Errorf("Invalid page '%s'", pageParam), http.StatusBadRequest, resp)
+			return
+		}
+		pageURL := lib.AnnotationPageURL(requestBaseURL(req), doc.Identifier, pageNo)
+		// Pages without transcribed lines are empty
+		out = lib.AnnotationPage{
+			Context: lib.AnnotationContext,
+			ID:      pageURL,
+			Type:    "AnnotationPage",
+			Items:   []lib.Annotation{},
+		}
+		for _, page := range pages {
+			if page.ID == pageURL {
+				out = page
+			}
+		}
+	}
+	raw, err := json.Marshal(out)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/ld+json")
+	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Write(raw)
+}
+
+// LineEdit is a request to split a line or to merge several lines of a
+// volume
+type LineEdit struct {
+	Document string `json:"document"`
+	// Source of the document, Archive.org if it is empty
+	Source  string        `json:"source,omitempty"`
+	Line    lib.OCRLine   `json:"line"`
+	Offsets []int         `json:"offsets"`
+	Lines   []lib.OCRLine `json:"lines"`
+}
+
+// EditLines splits or merges lines, caches the images of the resulting lines
+// and returns them
+func EditLines(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var edit LineEdit
+	if err := json.NewDecoder(req.Body).Decode(&edit); err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	if edit.Document == "" {
+		writeAPIError(fmt.Errorf("document must be set"), http.StatusBadRequest, resp)
+		return
+	}
+	source, err := store.Source(edit.Source)
+	if err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	operation := ps.ByName("operation")
+	if operation != lib.OperationSplit && operation != lib.OperationMerge {
 		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// The geometry of the lines is taken from the server
+	edited := edit.Lines
+	if operation == lib.OperationSplit {
+		edited = []lib.OCRLine{edit.Line}
+	}
+	edited, err = store.VerifyLines(edit.Document, edited)
+	if err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	var lines []lib.OCRLine
+	if operation == lib.OperationSplit {
+		lines, err = lib.SplitLine(source, edit.Document, edited[0], edit.Offsets)
+	} else {
+		var merged lib.OCRLine
+		merged, err = lib.MergeLines(source, edit.Document, edited)
+		lines = []lib.OCRLine{merged}
+	}
+	if err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	for idx := range lines {
+		// The new lines can be edited again
+		lines[idx].SetLocalURLs(edit.Document)
+	}
+	// Cached for when the document is submitted
+	result := map[string]interface{}{"lines": lines}
+	if err := lib.LineCache.CacheLines(lines, edit.Document); err != nil {
+		log.Warn().Err(err).Str("identifier", edit.Document).Msg("Could not cache edited lines")
+		result["warning"] = err.Error()
+	}
+	raw, _ := json.Marshal(result)
+	resp.Header().Add("Content-Type", "application/json")
+	resp.Write(raw)
+}
+
+// CorrectLineBox replaces the box of a line with a corrected or padded one
+// and re-crops its image
+func CorrectLineBox(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var correction lib.BoxCorrection
+	if err := json.NewDecoder(req.Body).Decode(&correction); err != nil {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	}
+	if correction.Box == nil && correction.Padding == nil {
+		writeAPIError(fmt.Errorf("Either box or padding must be set"), http.StatusBadRequest, resp)
+		return
+	}
+	doc, err := store.CorrectLineBox(ps.ByName("ident"), ps.ByName("lineId"), correction)
+	if err == lib.ErrUnknownLine {
+		writeAPIError(err, http.StatusNotFound, resp)
+		return
+	} else if err == lib.ErrInvalidBox {
+		writeAPIError(err, http.StatusBadRequest, resp)
+		return
+	} else if err != nil {
+		log.Error().
+			Err(err).
+			Str("documentId", ps.ByName("ident")).
+			Str("lineId", ps.ByName("lineId")).
+			Msg("Error correcting line box")
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	raw, _ := json.Marshal(doc)
+	resp.Header().Add("Content-Type", "application/json")
+	resp.Write(raw)
+}
+
+// GetCacheMetrics reports on the usage of the line image cache
+func GetCacheMetrics(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	raw, err := json.Marshal(lib.LineCache.Metrics())
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+	} else {
+		resp.Header().Add("Content-Type", "application/json")
+		resp.Write(raw)
+	}
+}
+
+// GetRefreshStatus reports on the refreshes of the identifier cache
+func GetRefreshStatus(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	isRunning, last := refresher.Status()
+	raw, err := json.Marshal(map[string]interface{}{
+		"running":     isRunning,
+		"lastRefresh": last,
+	})
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+	} else {
+		resp.Header().Add("Content-Type", "application/json")
+		resp.Write(raw)
+	}
+}
+
+// notModified sets the ETag for a response derived from the given commit
+// and responds with 304 if the client already has it
+func notModified(commit string, resp http.ResponseWriter, req *http.Request) bool {
+	etag := fmt.Sprintf(`"%s"`, commit)
+	resp.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		resp.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// GetStats returns aggregate statistics about the corpus
+func GetStats(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	stats, err := store.Stats()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compute statistics")
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	if notModified(stats.Commit, resp, req) {
+		return
+	}
+	raw, err := json.Marshal(stats)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to serialize statistics to JSON")
+		resp.WriteHeader(http.StatusInternalServerError)
+	} else {
+		resp.Header().Add("Content-Type", "application/json")
+		resp.Write(raw)
+	}
+}
+
+// GetCharStats returns the character inventory of the corpus
+func GetCharStats(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	head, err := store.Head()
+	if err != nil {
+		writeAPIError(err, http.StatusInternalServerError, resp)
+		return
+	}
+	if notModified(head, resp, req) {
+		return
+	}
+	raw, err := json.Marshal(store.CharInventory())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to serialize character statistics to JSON")
+		resp.WriteHeader(http.StatusInternalServerError)
+	} else {
+		resp.Header().Add("Content-Type", "application/json")
+		resp.Write(raw)
+	}
+}
+
+// GetCoverage reports the progress of the corpus against its targets
+func GetCoverage(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	coverage := store.Coverage()
+	if coverage.Commit != "" && notModified(coverage.Commit, resp, req) {
+		return
+	}
+	raw, err := json.Marshal(coverage)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to serialize coverage to JSON")
+		resp.WriteHeader(http.StatusInternalServerError)
 	} else {
 		resp.Header().Add("Content-Type", "application/json")
 		resp.Write(raw)
@@ -126,13 +704,25 @@ func addPrefix(prefix string, h http.Handler) http.Handler {
 	})
 }
 
-// Serve the web application
-func Serve(port int, repoPath string) {
+// Serve the web application, the identifier cache is refreshed at the
+// given interval unless it is zero
+func Serve(port int, repoPath string, refreshInterval time.Duration) {
 	s, err := lib.NewDocumentStore(repoPath)
 	if err != nil {
 		panic(err)
 	}
 	store = s
+	refresher = lib.NewIdentifierRefresher(lib.IDCache, store)
+	if lib.IDCache.Count() == 0 {
+		// Entries are only added once all sources were listed, so we never
+		// end up with a partial cache
+		// Failures are logged, the cache is filled by the next refresh
+		fmt.Println("Caching identifiers...")
+		refresher.Refresh(true)
+	}
+	if refreshInterval > 0 {
+		refresher.Schedule(refreshInterval)
+	}
 	box := packr.NewBox("../client/dist")
 
 	router := httprouter.New()
@@ -140,10 +730,23 @@ func Serve(port int, repoPath string) {
 		w.Write(box.Bytes("index.html"))
 	})
 	router.GET("/api/lines/:year", ProduceLines)
+	router.POST("/api/lines/:operation", EditLines)
 	router.GET("/api/documents", ListDocuments)
 	router.POST("/api/documents", SubmitDocument)
 	router.GET("/api/documents/:ident", GetDocument)
 	router.PUT("/api/documents/:ident", SubmitDocument)
+	router.GET("/api/documents/:ident/export/:format", ExportDocument)
+	router.GET("/api/documents/:ident/annotations", GetAnnotations)
+	router.PUT("/api/documents/:ident/lines/:lineId/box", CorrectLineBox)
+	router.GET("/api/admin/refresh", GetRefreshStatus)
+	router.GET("/api/admin/cache", GetCacheMetrics)
+	router.GET("/api/images/lines/:lineId", GetLineImage)
+	router.GET("/iiif/:id", RedirectIIIFImage)
+	router.GET("/iiif/:id/:region", GetIIIFResource)
+	router.GET("/iiif/:id/:region/:size/:rotation/:file", GetIIIFImage)
+	router.GET("/api/stats", GetStats)
+	router.GET("/api/stats/coverage", GetCoverage)
+	router.GET("/api/stats/characters", GetCharStats)
 
 	// NOTE: This is a bit clumsy, since Box.Open does not return an error
 	// that is recognized by os.IsNotExit, which is why we have to pass
@@ -160,8 +763,27 @@ func Serve(port int, repoPath string) {
 			w.WriteHeader(http.StatusNotFound)
 		}
 	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: router}
+	// Closed once all requests were drained
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Info().Msg("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Could not finish all requests")
+		}
+	}()
 	log.Info().Int("port", port).Msg("Serving application")
-	if err = http.ListenAndServe(fmt.Sprintf(":%d", port), router); err != nil {
+	if err = server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal().Err(err).Msg("Failed to serve application")
 	}
+	// ListenAndServe returns as soon as the shutdown starts
+	<-done
+	lib.LineCache.Close()
+	lib.IDCache.Close()
 }